@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File contents are identified by the SHA-256 of their bytes. The node
+// an upload reaches keeps the content and replicates only the hash;
+// every other node fetches the content from a peer once the CreateFile
+// entry is applied, and again on demand if a download finds it
+// missing. Content in transit is staged here by hash until the state
+// machine has placed it at the path of each file that has it.
+//
+// Once a node has placed content, it confirms that to the node the
+// content was uploaded to. The upload isn't answered until a majority
+// of voters have the content, so losing the node that took it doesn't
+// lose the content of a file the client was told was created.
+
+// How often content that couldn't be fetched is tried again.
+const blobRetryInterval = 5 * time.Second
+
+// How long one fetch from one peer may take.
+const blobFetchTimeout = 30 * time.Second
+
+// How long an upload waits for a majority to confirm they have its
+// content, once its CreateFile is applied.
+const blobConfirmTimeout = 10 * time.Second
+
+// Confirmations waiting to be sent. More are dropped rather than
+// holding up the state machine.
+const blobConfirmBacklog = 1024
+
+var errNoBlobSource = errors.New("content not available from any node")
+
+type blobStore struct {
+	dir string
+
+	// Returns the HTTP URLs of the nodes that may hold hash, best
+	// first, and whether a file on this node is still waiting for it.
+	sources func(hash string) ([]string, bool)
+	// Called once hash is staged, to place it.
+	arrived func(hash string)
+	// This node's Raft id, sent along with confirmations.
+	node uint64
+
+	mu      sync.Mutex
+	missing map[string]bool
+	// Uploads whose CreateFile hasn't been applied yet. Their staged
+	// content is kept until the upload is done with it.
+	pinned map[string]int
+	wake   chan struct{}
+	// Nodes that confirmed they have content uploaded here, by hash,
+	// while an upload waits for them.
+	confirmed map[string]*blobConfirmations
+	confirms  chan blobConfirm
+
+	client *http.Client
+}
+
+func newBlobStore(dir string) *blobStore {
+	os.MkdirAll(dir, 0755)
+	return &blobStore{
+		dir:       dir,
+		missing:   map[string]bool{},
+		pinned:    map[string]int{},
+		wake:      make(chan struct{}, 1),
+		confirmed: map[string]*blobConfirmations{},
+		confirms:  make(chan blobConfirm, blobConfirmBacklog),
+		client:    &http.Client{Timeout: blobFetchTimeout},
+	}
+}
+
+type blobConfirm struct {
+	origin string
+	hash   string
+}
+
+type blobConfirmations struct {
+	uploads int
+	nodes   map[uint64]bool
+	// Closed and replaced each time a node confirms.
+	changed chan struct{}
+}
+
+func validHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+func (b *blobStore) path(hash string) string {
+	return filepath.Join(b.dir, hash)
+}
+
+func (b *blobStore) has(hash string) bool {
+	return exists(b.path(hash))
+}
+
+// write stages the content read from r and returns its hash and size.
+// If want is set and the content doesn't hash to it, nothing is kept.
+// If pin is set the content stays staged until unpin is called.
+func (b *blobStore) write(r io.Reader, want string, pin bool) (string, int64, error) {
+	tmp, err := os.CreateTemp(b.dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return "", 0, err
+	}
+	// Windows can't rename an open file.
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(h.Sum(nil))
+	if want != "" && hash != want {
+		return "", 0, fmt.Errorf("content hashes to %s, expected %s", hash, want)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := os.Rename(tmp.Name(), b.path(hash)); err != nil {
+		return "", 0, err
+	}
+	if pin {
+		b.pinned[hash]++
+	}
+	return hash, n, nil
+}
+
+func (b *blobStore) unpin(hash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pinned[hash]--; b.pinned[hash] <= 0 {
+		delete(b.pinned, hash)
+		os.Remove(b.path(hash))
+	}
+}
+
+// discard drops staged content once it has been placed, unless an
+// upload still holds it.
+func (b *blobStore) discard(hash string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.missing, hash)
+	if b.pinned[hash] == 0 {
+		os.Remove(b.path(hash))
+	}
+}
+
+// linkOrCopy makes dst a hard link to src, or a copy where links
+// aren't supported. Content is never changed in place, so files with
+// the same content can share it.
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// want records that a file on this node is waiting for hash and wakes
+// the fetcher. It doesn't block, so the state machine can call it
+// while applying.
+func (b *blobStore) want(hash string) {
+	if !validHash(hash) {
+		return
+	}
+
+	b.mu.Lock()
+	b.missing[hash] = true
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// fetch copies hash from the first source that has it and has it
+// placed, unless no file is waiting for it any more.
+func (b *blobStore) fetch(ctx context.Context, hash string) error {
+	sources, needed := b.sources(hash)
+	if !needed {
+		return nil
+	}
+
+	if !b.has(hash) {
+		fetched := false
+		for _, source := range sources {
+			err := b.fetchFrom(ctx, source, hash)
+			if err == nil {
+				log.Printf("Fetched content %s from %s", hash, source)
+				fetched = true
+				break
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Printf("Fetching content %s from %s: %s", hash, source, err)
+		}
+		if !fetched {
+			return errNoBlobSource
+		}
+	}
+
+	b.arrived(hash)
+	return nil
+}
+
+func (b *blobStore) fetchFrom(ctx context.Context, source, hash string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source+"/blobs/"+hash, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := b.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", rsp.Status)
+	}
+	_, _, err = b.write(rsp.Body, hash, false)
+	return err
+}
+
+// confirm queues telling origin that this node has placed hash. It
+// doesn't block, so the state machine can call it while applying.
+func (b *blobStore) confirm(origin, hash string) {
+	if origin == "" || !validHash(hash) {
+		return
+	}
+	select {
+	case b.confirms <- blobConfirm{origin, hash}:
+	default:
+	}
+}
+
+// sendConfirms sends queued confirmations until ctx is done. They are
+// only of use while the upload waits, so one that fails is dropped.
+func (b *blobStore) sendConfirms(ctx context.Context) {
+	for {
+		var c blobConfirm
+		select {
+		case <-ctx.Done():
+			return
+		case c = <-b.confirms:
+		}
+
+		url := fmt.Sprintf("%s/blobs/%s?node=%d", c.origin, c.hash, b.node)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, nil)
+		if err != nil {
+			continue
+		}
+		rsp, err := b.client.Do(req)
+		if err != nil {
+			log.Printf("Confirming content %s to %s: %s", c.hash, c.origin, err)
+			continue
+		}
+		rsp.Body.Close()
+	}
+}
+
+// expect starts collecting confirmations for hash, for an upload that
+// will wait for them. The returned func stops collecting.
+func (b *blobStore) expect(hash string) func() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.confirmed[hash]
+	if c == nil {
+		c = &blobConfirmations{nodes: map[uint64]bool{}, changed: make(chan struct{})}
+		b.confirmed[hash] = c
+	}
+	c.uploads++
+
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if c.uploads--; c.uploads == 0 {
+			delete(b.confirmed, hash)
+		}
+	}
+}
+
+// confirmedBy records that node has hash, if an upload is waiting for
+// it.
+func (b *blobStore) confirmedBy(hash string, node uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.confirmed[hash]
+	if c == nil || c.nodes[node] {
+		return
+	}
+	c.nodes[node] = true
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitConfirmed waits until the nodes that confirmed hash are enough,
+// and reports whether they were before ctx was done. expect must have
+// been called for hash.
+func (b *blobStore) waitConfirmed(ctx context.Context, hash string, enough func(nodes map[uint64]bool) bool) bool {
+	for {
+		// enough may take other locks, so it gets a copy.
+		b.mu.Lock()
+		c := b.confirmed[hash]
+		nodes := make(map[uint64]bool, len(c.nodes))
+		for node := range c.nodes {
+			nodes[node] = true
+		}
+		changed := c.changed
+		b.mu.Unlock()
+
+		if enough(nodes) {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// run fetches the content this node is missing until ctx is done,
+// retrying what no peer could provide every blobRetryInterval.
+func (b *blobStore) run(ctx context.Context) {
+	go b.sendConfirms(ctx)
+
+	retry := time.NewTicker(blobRetryInterval)
+	defer retry.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.wake:
+		case <-retry.C:
+		}
+
+		b.mu.Lock()
+		var hashes []string
+		for hash := range b.missing {
+			hashes = append(hashes, hash)
+		}
+		b.mu.Unlock()
+
+		for _, hash := range hashes {
+			if err := b.fetch(ctx, hash); err != nil {
+				continue
+			}
+			b.mu.Lock()
+			delete(b.missing, hash)
+			b.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hashOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func staged(t *testing.T, b *blobStore) []string {
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func Test_blob_write(t *testing.T) {
+	b := newBlobStore(t.TempDir())
+	hash := hashOf("hello")
+
+	got, n, err := b.write(strings.NewReader("hello"), hash, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != hash || n != 5 || !b.has(hash) {
+		t.Fatalf("Expected %s (5 bytes) staged, got %s (%d bytes)", hash, got, n)
+	}
+
+	// Content that doesn't match the hash asked for is not kept.
+	b = newBlobStore(t.TempDir())
+	if _, _, err := b.write(strings.NewReader("goodbye"), hash, false); err == nil {
+		t.Fatal("Expected a hash mismatch")
+	}
+	if names := staged(t, b); len(names) != 0 {
+		t.Errorf("Expected nothing staged, got %v", names)
+	}
+}
+
+func Test_blob_pin(t *testing.T) {
+	b := newBlobStore(t.TempDir())
+	hash := hashOf("hello")
+
+	// Two uploads of the same content.
+	for i := 0; i < 2; i++ {
+		if _, _, err := b.write(strings.NewReader("hello"), "", true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.discard(hash)
+	if !b.has(hash) {
+		t.Fatal("Expected pinned content to survive being placed")
+	}
+	b.unpin(hash)
+	if !b.has(hash) {
+		t.Fatal("Expected content to stay while an upload still pins it")
+	}
+	b.unpin(hash)
+	if b.has(hash) {
+		t.Fatal("Expected content dropped once no upload pins it")
+	}
+
+	if _, _, err := b.write(strings.NewReader("hello"), "", false); err != nil {
+		t.Fatal(err)
+	}
+	b.discard(hash)
+	if b.has(hash) {
+		t.Fatal("Expected unpinned content dropped once placed")
+	}
+}
+
+func Test_blob_fetch(t *testing.T) {
+	hash := hashOf("hello")
+	serve := func(content string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/blobs/"+hash {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(content))
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	missing := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(missing.Close)
+	corrupt := serve("goodbye")
+	good := serve("hello")
+
+	b := newBlobStore(t.TempDir())
+	var arrived []string
+	b.arrived = func(hash string) { arrived = append(arrived, hash) }
+	b.sources = func(string) ([]string, bool) {
+		return []string{missing.URL, corrupt.URL, good.URL}, true
+	}
+
+	// The first two sources fail, the third one has it.
+	if err := b.fetch(context.Background(), hash); err != nil {
+		t.Fatal(err)
+	}
+	if !b.has(hash) || len(arrived) != 1 || arrived[0] != hash {
+		t.Fatalf("Expected %s fetched and placed, got %v", hash, arrived)
+	}
+
+	b = newBlobStore(t.TempDir())
+	b.sources = func(string) ([]string, bool) {
+		return []string{missing.URL, corrupt.URL}, true
+	}
+	if err := b.fetch(context.Background(), hash); err != errNoBlobSource {
+		t.Errorf("Expected errNoBlobSource, got %v", err)
+	}
+	if names := staged(t, b); len(names) != 0 {
+		t.Errorf("Expected nothing staged, got %v", names)
+	}
+
+	// Nothing is fetched once no file waits for the content.
+	b.sources = func(string) ([]string, bool) {
+		return []string{good.URL}, false
+	}
+	if err := b.fetch(context.Background(), hash); err != nil || b.has(hash) {
+		t.Errorf("Expected no fetch, got %v", err)
+	}
+}
+
+func Test_blob_confirm(t *testing.T) {
+	b := newBlobStore(t.TempDir())
+	hash := hashOf("hello")
+	two := func(nodes map[uint64]bool) bool { return len(nodes) >= 2 }
+
+	// Confirmations no upload waits for are dropped.
+	b.confirmedBy(hash, 2)
+
+	stop := b.expect(hash)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	b.confirmedBy(hash, 2)
+	b.confirmedBy(hash, 2)
+	if b.waitConfirmed(ctx, hash, two) {
+		t.Fatal("Expected one node not to be enough")
+	}
+
+	done := make(chan bool)
+	go func() { done <- b.waitConfirmed(context.Background(), hash, two) }()
+	b.confirmedBy(hash, 3)
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("Expected two nodes to be enough")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the wait to end once a second node confirmed")
+	}
+}
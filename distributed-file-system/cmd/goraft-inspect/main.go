@@ -0,0 +1,153 @@
+// goraft-inspect prints and checks the files a DFS node keeps its Raft
+// state in: the header page of md_<id>.dat, the WAL and the snapshot.
+// It can also cut the log back to a given index, or dump everything as
+// JSON. Only run it against a node that is stopped.
+//
+//	goraft-inspect -dir . -id 1
+//	goraft-inspect -dir . -id 1 -json > node1.json
+//	goraft-inspect -dir . -id 1 -truncate 120
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"distributed-file-system/command"
+	"distributed-file-system/goraft"
+)
+
+// entry adds the decoded DFS command to a log entry for printing.
+type entry struct {
+	goraft.LogEntry
+	Decoded string `json:",omitempty"`
+}
+
+func main() {
+	dir := flag.String("dir", ".", "directory holding the node's files")
+	id := flag.Uint64("id", 1, "id of the node whose files to read")
+	file := flag.String("file", "", "metadata file name (default md_<id>.dat)")
+	asJSON := flag.Bool("json", false, "print everything as JSON")
+	truncate := flag.Int64("truncate", -1, "discard every log entry after this index")
+	force := flag.Bool("force", false, "with -truncate, allow discarding committed entries")
+	flag.Parse()
+
+	log.SetFlags(0)
+	config := goraft.Config{MetadataDir: *dir, MetadataFile: *file}
+
+	if *truncate >= 0 {
+		if err := goraft.TruncateLog(config, *id, uint64(*truncate), *force); err != nil {
+			log.Fatalf("Truncating log: %s", err)
+		}
+		fmt.Printf("Log truncated after index %d\n", *truncate)
+		return
+	}
+
+	insn, err := goraft.Inspect(config, *id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var entries []entry
+	for _, e := range insn.Entries {
+		decoded, problem := decode(e)
+		if problem != "" {
+			insn.Problems = append(insn.Problems, fmt.Sprintf("Entry %d: %s", e.Index, problem))
+		}
+		entries = append(entries, entry{e, decoded})
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(struct {
+			Metadata goraft.Metadata
+			Snapshot *goraft.SnapshotInfo `json:",omitempty"`
+			Entries  []entry
+			Problems []string
+		}{insn.Metadata, insn.Snapshot, entries, insn.Problems})
+	} else {
+		printInspection(insn, entries)
+	}
+
+	if len(insn.Problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// decode describes the DFS command in a log entry. A command that
+// doesn't encode back to the same bytes is reported as malformed.
+func decode(e goraft.LogEntry) (string, string) {
+	switch e.Kind {
+	case goraft.CommandEntry.String(), goraft.SessionCommandEntry.String():
+	default:
+		return "", ""
+	}
+
+	if len(e.Command) == 0 {
+		// The no-op a new leader commits.
+		return "", ""
+	}
+
+	c := command.Decode(e.Command)
+	if !bytes.Equal(command.Encode(c), e.Command) {
+		return "", "malformed DFS command"
+	}
+	return c.String(), ""
+}
+
+func printInspection(insn *goraft.Inspection, entries []entry) {
+	md := insn.Metadata
+	fmt.Println("Header")
+	fmt.Printf("  term            %d\n", md.Term)
+	fmt.Printf("  voted for       %d\n", md.VotedFor)
+	fmt.Printf("  last log index  %d\n", md.LastLogIndex)
+	fmt.Printf("  commit index    %d\n", md.CommitIndex)
+	fmt.Printf("  snapshot        index %d, term %d\n", md.SnapshotIndex, md.SnapshotTerm)
+
+	if snap := insn.Snapshot; snap != nil {
+		fmt.Printf("\nSnapshot: index %d, term %d, %d bytes, members %s\n",
+			snap.Index, snap.Term, snap.Size, members(snap.Members))
+	}
+
+	fmt.Printf("\nLog: %d entries\n", len(entries))
+	for _, e := range entries {
+		detail := e.Decoded
+		switch e.Kind {
+		case goraft.ConfigurationEntry.String():
+			detail = members(e.Members)
+		case goraft.SessionCommandEntry.String():
+			detail = fmt.Sprintf("client %d seq %d: %s", e.ClientId, e.Sequence, e.Decoded)
+		case goraft.CommandEntry.String():
+			if len(e.Command) == 0 {
+				detail = "(no-op)"
+			}
+		}
+		fmt.Printf("  %8d  term %-4d %-16s %s\n", e.Index, e.Term, e.Kind, detail)
+	}
+
+	if len(insn.Problems) == 0 {
+		fmt.Println("\nNo problems found")
+		return
+	}
+	fmt.Printf("\n%d problems:\n", len(insn.Problems))
+	for _, p := range insn.Problems {
+		fmt.Printf("  %s\n", p)
+	}
+}
+
+func members(cluster []goraft.ClusterMember) string {
+	var parts []string
+	for _, m := range cluster {
+		part := fmt.Sprintf("%d=%s", m.Id, m.Address)
+		if m.Role != "" {
+			part += fmt.Sprintf(" (%s)", m.Role)
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,156 @@
+// Package command holds the file system commands the DFS replicates
+// through Raft, and their encoding in the log.
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+type Kind uint8
+
+const (
+	CreateFile Kind = iota
+	DeleteFile
+	RenameFile
+	MakeDir
+	RemoveDir
+	SetNodeAddress
+)
+
+func (k Kind) String() string {
+	switch k {
+	case CreateFile:
+		return "CreateFile"
+	case DeleteFile:
+		return "DeleteFile"
+	case RenameFile:
+		return "RenameFile"
+	case MakeDir:
+		return "MakeDir"
+	case RemoveDir:
+		return "RemoveDir"
+	case SetNodeAddress:
+		return "SetNodeAddress"
+	}
+	return fmt.Sprintf("Kind(%d)", uint8(k))
+}
+
+type Command struct {
+	Kind    Kind
+	Path    string
+	OldPath string
+	NewPath string
+	Size    int64
+
+	// For CreateFile, the SHA-256 of the content in hex, and the HTTP
+	// URL of the node it was uploaded to. Empty in commands written
+	// before content was replicated.
+	Hash   string
+	Origin string
+
+	// For SetNodeAddress, the Raft id of the node whose HTTP URL is
+	// in Origin.
+	Node uint64
+
+	// When the leader proposed the command, in Unix nanoseconds, so
+	// every node records the same modification times. Zero in
+	// commands written before it was set.
+	Time int64
+}
+
+func (c Command) String() string {
+	switch c.Kind {
+	case CreateFile:
+		return fmt.Sprintf("%s %s (%d bytes)", c.Kind, c.Path, c.Size)
+	case RenameFile:
+		return fmt.Sprintf("%s %s -> %s", c.Kind, c.OldPath, c.NewPath)
+	case SetNodeAddress:
+		return fmt.Sprintf("%s %d %s", c.Kind, c.Node, c.Origin)
+	}
+	return fmt.Sprintf("%s %s", c.Kind, c.Path)
+}
+
+func Encode(c Command) []byte {
+	msg := bytes.NewBuffer(nil)
+	msg.WriteByte(uint8(c.Kind))
+
+	binary.Write(msg, binary.LittleEndian, uint64(len(c.Path)))
+	msg.WriteString(c.Path)
+
+	binary.Write(msg, binary.LittleEndian, uint64(len(c.OldPath)))
+	msg.WriteString(c.OldPath)
+
+	binary.Write(msg, binary.LittleEndian, uint64(len(c.NewPath)))
+	msg.WriteString(c.NewPath)
+
+	binary.Write(msg, binary.LittleEndian, uint64(c.Size))
+
+	// Fields added later are written in the order they were added, up
+	// to the last one that is set, so older commands keep their
+	// encoding.
+	withTime := c.Time != 0
+	withNode := withTime || c.Node != 0
+	withHash := withNode || c.Hash != "" || c.Origin != ""
+
+	if withHash {
+		binary.Write(msg, binary.LittleEndian, uint64(len(c.Hash)))
+		msg.WriteString(c.Hash)
+
+		binary.Write(msg, binary.LittleEndian, uint64(len(c.Origin)))
+		msg.WriteString(c.Origin)
+	}
+	if withNode {
+		binary.Write(msg, binary.LittleEndian, c.Node)
+	}
+	if withTime {
+		binary.Write(msg, binary.LittleEndian, c.Time)
+	}
+
+	return msg.Bytes()
+}
+
+// Decode never panics on malformed input. A length running past the
+// end of msg takes only what is left, so a malformed command decodes
+// to one that doesn't encode back to msg.
+func Decode(msg []byte) Command {
+	var c Command
+	buf := bytes.NewBuffer(msg)
+
+	if kind, err := buf.ReadByte(); err == nil {
+		c.Kind = Kind(kind)
+	}
+
+	c.Path = readString(buf)
+	c.OldPath = readString(buf)
+	c.NewPath = readString(buf)
+
+	var size uint64
+	binary.Read(buf, binary.LittleEndian, &size)
+	c.Size = int64(size)
+
+	if buf.Len() > 0 {
+		c.Hash = readString(buf)
+		c.Origin = readString(buf)
+	}
+
+	if buf.Len() > 0 {
+		binary.Read(buf, binary.LittleEndian, &c.Node)
+	}
+
+	if buf.Len() > 0 {
+		binary.Read(buf, binary.LittleEndian, &c.Time)
+	}
+
+	return c
+}
+
+func readString(buf *bytes.Buffer) string {
+	var n uint64
+	binary.Read(buf, binary.LittleEndian, &n)
+	if n > uint64(buf.Len()) {
+		n = uint64(buf.Len())
+	}
+	return string(buf.Next(int(n)))
+}
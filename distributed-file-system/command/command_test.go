@@ -0,0 +1,36 @@
+package command
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func Test_encode_decode(t *testing.T) {
+	for _, c := range []Command{
+		{Kind: CreateFile, Path: "/a/b.txt", Size: 12},
+		{Kind: CreateFile, Path: "/a/b.txt", Size: 12, Hash: "abc", Origin: "http://localhost:8081"},
+		{Kind: DeleteFile, Path: "/a/b.txt"},
+		{Kind: RenameFile, OldPath: "/a", NewPath: "/b", Time: 1700000000000000000},
+		{Kind: SetNodeAddress, Node: 2, Origin: "http://localhost:8082"},
+	} {
+		if got := Decode(Encode(c)); got != c {
+			t.Errorf("Expected %+v to round-trip, got %+v", c, got)
+		}
+	}
+}
+
+func Test_decode_malformed(t *testing.T) {
+	huge := []byte{byte(CreateFile)}
+	huge = binary.LittleEndian.AppendUint64(huge, ^uint64(0))
+	huge = append(huge, "/a"...)
+
+	valid := Encode(Command{Kind: DeleteFile, Path: "/a/b.txt"})
+
+	for _, msg := range [][]byte{nil, huge, valid[:len(valid)-3]} {
+		// Must not panic, and mustn't pass for a valid command.
+		if bytes.Equal(Encode(Decode(msg)), msg) {
+			t.Errorf("Expected %x not to decode to a valid command", msg)
+		}
+	}
+}
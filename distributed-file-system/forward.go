@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"distributed-file-system/command"
+)
+
+// Followers pass requests only the leader can serve on to it, so
+// clients can send everything to any node. Each leader records its
+// HTTP URL in the Raft log when it is elected, and a follower proxies
+// to the URL recorded for the leader it last heard from.
+
+// Set on forwarded requests, so a node whose idea of the leader is out
+// of date doesn't pass the request on again.
+const forwardedHeader = "X-Dfs-Forwarded-By"
+
+// How long a new leader waits before trying again to record its URL.
+const announceRetryInterval = time.Second
+
+// announceAddress records this node's HTTP URL in the log, unless it
+// is already there. It runs as a leader task.
+func (hs *httpServer) announceAddress(ctx context.Context) {
+	id := hs.raft.Id()
+	cmd := command.Encode(command.Command{
+		Kind:   command.SetNodeAddress,
+		Node:   id,
+		Origin: hs.advertise,
+	})
+
+	for hs.stateMachine.nodeAddress(id) != hs.advertise {
+		applyCtx, cancel := context.WithTimeout(ctx, writeTimeout)
+		results, err := hs.raft.ApplyContext(applyCtx, [][]byte{cmd})
+		cancel()
+		if err == nil {
+			err = results[0].Error
+		}
+		if err == nil {
+			return
+		}
+		log.Printf("Recording HTTP address: %s", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(announceRetryInterval):
+		}
+	}
+}
+
+// leaderURL returns the HTTP URL of the leader this node last heard
+// from, or "" if it doesn't know it or is the leader itself.
+func (hs *httpServer) leaderURL() string {
+	leader := hs.raft.Leader()
+	if leader == 0 || leader == hs.raft.Id() {
+		return ""
+	}
+	return hs.stateMachine.nodeAddress(leader)
+}
+
+// forward proxies r to the leader. It returns false without writing a
+// response if it can't: when the leader is unknown, or r was already
+// forwarded once.
+func (hs *httpServer) forward(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	leader := hs.leaderURL()
+	if leader == "" {
+		return false
+	}
+	target, err := url.Parse(leader)
+	if err != nil {
+		log.Printf("Leader URL %s: %s", leader, err)
+		return false
+	}
+
+	log.Printf("Forwarding %s %s to the leader at %s", r.Method, r.URL.Path, leader)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("Forwarding %s %s: %s", r.Method, r.URL.Path, err)
+		http.Error(w, "Failed to reach the leader", http.StatusBadGateway)
+	}
+	r.Header.Set(forwardedHeader, hs.advertise)
+	proxy.ServeHTTP(w, r)
+	return true
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"distributed-file-system/command"
+)
+
+// startForwardingCluster starts three nodes and returns the leader,
+// once its URL is recorded, and a follower that knows it.
+func startForwardingCluster(t *testing.T) (leader, follower *httpServer) {
+	nodes := startTestCluster(t, 3)
+	leader = waitForLeader(t, nodes)
+	leader.announceAddress(context.Background())
+
+	for _, hs := range nodes {
+		if hs != leader {
+			follower = hs
+		}
+	}
+	waitFor(t, "the follower to learn the leader's URL", func() bool {
+		return follower.leaderURL() == leader.advertise
+	})
+	return leader, follower
+}
+
+func Test_forward_to_leader(t *testing.T) {
+	leader, follower := startForwardingCluster(t)
+
+	code, body := do(t, follower, http.MethodPost, "/dirs/reports", "")
+	if code != http.StatusCreated || body != "Directory '/reports' created" {
+		t.Fatalf("Expected the leader's response relayed, got %d %q", code, body)
+	}
+	leader.stateMachine.mu.RLock()
+	created := leader.stateMachine.ns.lookup("/reports") != nil
+	leader.stateMachine.mu.RUnlock()
+	if !created {
+		t.Error("Expected the leader to have applied the write")
+	}
+
+	// Errors come back as the leader wrote them.
+	if code, _ := do(t, follower, http.MethodDelete, "/files/missing.txt", ""); code != http.StatusNotFound {
+		t.Errorf("Expected the leader's 404 relayed, got %d", code)
+	}
+}
+
+func Test_forward_only_once(t *testing.T) {
+	_, follower := startForwardingCluster(t)
+
+	req, err := http.NewRequest(http.MethodPost, follower.advertise+"/dirs/reports", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(forwardedHeader, "http://elsewhere")
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected a forwarded request to be refused rather than passed on, got %d", rsp.StatusCode)
+	}
+}
+
+func Test_forward_without_leader_url(t *testing.T) {
+	// The leader never records its URL.
+	nodes := startTestCluster(t, 3)
+	leader := waitForLeader(t, nodes)
+	for _, hs := range nodes {
+		if hs == leader {
+			continue
+		}
+		waitFor(t, "the follower to hear from the leader", func() bool {
+			return hs.raft.Leader() == leader.raft.Id()
+		})
+		if code, _ := do(t, hs, http.MethodPost, "/dirs/reports", ""); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503 without the leader's URL, got %d", code)
+		}
+	}
+
+	// No leader is ever elected with one of two members running.
+	nodes = newTestCluster(t, 2)
+	nodes[0].raft.Start()
+	if code, _ := do(t, nodes[0], http.MethodPost, "/dirs/reports", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a leader, got %d", code)
+	}
+}
+
+func Test_node_address_snapshot(t *testing.T) {
+	s := openDFS(t, t.TempDir())
+	applyAll(t, s, command.Command{Kind: command.SetNodeAddress, Node: 2, Origin: "http://n2"})
+
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := openDFS(t, t.TempDir())
+	if err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if address := restored.nodeAddress(2); address != "http://n2" {
+		t.Errorf("Expected node 2 at http://n2 after restoring, got %q", address)
+	}
+
+	// Snapshots from before addresses were replicated have none.
+	if err := restored.Restore([]byte(`[{"name": "/a"}]`)); err != nil {
+		t.Fatal(err)
+	}
+	if address := restored.nodeAddress(2); address != "" {
+		t.Errorf("Expected no address from an old snapshot, got %q", address)
+	}
+}
@@ -0,0 +1,124 @@
+package goraft
+
+import "time"
+
+// Concurrent Apply calls are group committed: their commands are
+// queued, and a single flusher appends everything queued so far to the
+// log with one write and sync, then starts one round of replication.
+// While it is writing, new commands queue up for the next batch.
+
+const MAX_APPLY_BATCH = 1024
+
+// Short next to a disk sync, so the window mostly adds commands that
+// would otherwise have waited for the next batch anyway.
+const APPLY_BATCH_DELAY = 500 * time.Microsecond
+
+type proposal struct {
+	kind    EntryKind
+	command []byte
+	result  chan ApplyResult
+}
+
+// propose queues commands for the log, starting a flusher if none is
+// running. Results are delivered on each proposal's result channel.
+func (s *Server) propose(proposals []proposal) {
+	s.batchMu.Lock()
+	s.batch = append(s.batch, proposals...)
+	if len(s.batch) >= s.config.MaxApplyBatch {
+		select {
+		case s.batchFull <- struct{}{}:
+		default:
+		}
+	}
+
+	start := !s.flushing
+	s.flushing = true
+	s.batchMu.Unlock()
+
+	if start {
+		s.spawn(s.flushBatches)
+	}
+}
+
+// flushBatches appends queued commands until the queue is empty. Only
+// the first batch waits for more commands to arrive; those queued
+// while a batch was being written have already waited long enough.
+func (s *Server) flushBatches() {
+	wait := s.config.ApplyBatchDelay > 0
+
+	for {
+		if wait {
+			s.waitForBatch()
+			wait = false
+		}
+
+		s.batchMu.Lock()
+		n := min(len(s.batch), s.config.MaxApplyBatch)
+		if n == 0 {
+			s.flushing = false
+			s.batchMu.Unlock()
+			return
+		}
+
+		batch := s.batch[:n]
+		s.batch = append([]proposal(nil), s.batch[n:]...)
+		s.batchMu.Unlock()
+
+		s.appendBatch(batch)
+	}
+}
+
+// waitForBatch returns after ApplyBatchDelay, or sooner once a full
+// batch is queued.
+func (s *Server) waitForBatch() {
+	s.batchMu.Lock()
+	full := len(s.batch) >= s.config.MaxApplyBatch
+	s.batchMu.Unlock()
+	if full {
+		return
+	}
+
+	timer := time.NewTimer(s.config.ApplyBatchDelay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-s.batchFull:
+	}
+}
+
+func (s *Server) appendBatch(batch []proposal) {
+	s.mu.Lock()
+
+	// Leadership may have changed since the commands were queued.
+	var err error
+	if s.done {
+		err = ErrStopped
+	} else if s.state != leaderState {
+		err = ErrLeadershipLost
+	} else if s.transferee != 0 {
+		err = ErrLeadershipTransferInProgress
+	}
+
+	if err != nil {
+		s.mu.Unlock()
+		for _, p := range batch {
+			p.result <- ApplyResult{Error: err}
+		}
+		return
+	}
+
+	for _, p := range batch {
+		s.log = append(s.log, Entry{
+			Term:    s.currentTerm,
+			Command: p.command,
+			Kind:    p.kind,
+			result:  p.result,
+		})
+	}
+
+	s.persist(true, len(batch))
+	s.debugf("Appended a batch of %d commands", len(batch))
+	s.appendEntries()
+	s.mu.Unlock()
+}
@@ -0,0 +1,159 @@
+package goraft
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLeader(t testing.TB, config Config) *Server {
+	config.MetadataDir = t.TempDir()
+	s, err := NewServer(
+		[]ClusterMember{{Id: 1, Address: ":3030"}},
+		&testStateMachine{},
+		config,
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = NewInmemNetwork().NewTransport()
+	s.restore()
+	s.state = leaderState
+	s.currentTerm = 1
+	return s
+}
+
+// commitInBackground stands in for the main loop, committing and
+// applying entries as a single-member cluster would.
+func commitInBackground(s *Server) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.advanceCommitIndex()
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	return func() { close(done) }
+}
+
+func Test_group_commit(t *testing.T) {
+	s := newTestLeader(t, Config{})
+
+	// The flusher is started by whichever Apply call queues first.
+	var spawnMu sync.Mutex
+	var flusher func()
+	flushes := 0
+	s.spawn = func(f func()) {
+		spawnMu.Lock()
+		defer spawnMu.Unlock()
+		flusher = f
+		flushes++
+	}
+	flush := func() int {
+		spawnMu.Lock()
+		f, n := flusher, flushes
+		spawnMu.Unlock()
+		f()
+		return n
+	}
+	appended := func() (uint64, bool) {
+		s.mu.Lock()
+		last := s.lastLogIndex()
+		s.mu.Unlock()
+
+		s.batchMu.Lock()
+		defer s.batchMu.Unlock()
+		return last, s.flushing
+	}
+
+	results := make(chan []ApplyResult)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			r, _ := s.Apply([][]byte{[]byte(fmt.Sprint(i))})
+			results <- r
+		}(i)
+	}
+	waitFor(t, "commands to queue", func() bool {
+		s.batchMu.Lock()
+		defer s.batchMu.Unlock()
+		return len(s.batch) == 10
+	})
+	s.config.MaxApplyBatch = 4
+	if n := flush(); n != 1 {
+		t.Fatalf("Expected one flusher for concurrent commands, got %d", n)
+	}
+	if last, flushing := appended(); last != 10 || flushing {
+		t.Fatalf("Expected all 10 commands in the log, got %d", last)
+	}
+
+	stop := commitInBackground(s)
+	defer stop()
+	for i := 0; i < 10; i++ {
+		if r := <-results; r[0].Error != nil {
+			t.Fatal(r[0].Error)
+		}
+	}
+
+	// Commands still queued when the leader steps down are never
+	// appended.
+	go func() {
+		r, _ := s.Apply([][]byte{[]byte("late")})
+		results <- r
+	}()
+	waitFor(t, "command to queue", func() bool {
+		s.batchMu.Lock()
+		defer s.batchMu.Unlock()
+		return len(s.batch) == 1
+	})
+
+	s.mu.Lock()
+	s.state = followerState
+	s.mu.Unlock()
+	flush()
+
+	if r := <-results; r[0].Error != ErrLeadershipLost {
+		t.Errorf("Expected ErrLeadershipLost for the queued command, got %v", r[0].Error)
+	}
+	if last, _ := appended(); last != 10 {
+		t.Errorf("Expected the queued command not to be appended, got last index %d", last)
+	}
+}
+
+// BenchmarkApply measures concurrent Apply calls on a single-member
+// cluster, where the cost is dominated by syncing the log to disk.
+//
+//	go test ./goraft -run '^$' -bench Apply
+func BenchmarkApply(b *testing.B) {
+	for _, bc := range []struct {
+		name      string
+		batchSize int
+	}{
+		{"unbatched", 1},
+		{"batched", MAX_APPLY_BATCH},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			s := newTestLeader(b, Config{MaxApplyBatch: bc.batchSize})
+			stop := commitInBackground(s)
+			defer stop()
+
+			command := []byte("benchmark command")
+			b.SetParallelism(64)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := s.Apply([][]byte{command}); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package goraft
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Config holds the settings for a Server. Fields left at their zero
+// value take the default given in their comment.
+type Config struct {
+	// Directory holding the metadata file, the WAL and snapshots.
+	// Defaults to the working directory.
+	MetadataDir string
+	// Name of the file in MetadataDir holding the current term, vote
+	// and log bounds. Defaults to md_<id>.dat.
+	MetadataFile string
+
+	// How often the leader sends AppendEntries when it has nothing
+	// new to send. Defaults to 150ms.
+	HeartbeatInterval time.Duration
+	// A follower that hears from no leader for a random time between
+	// these bounds starts an election. Default to 2 and 4 heartbeat
+	// intervals.
+	ElectionTimeoutMin time.Duration
+	ElectionTimeoutMax time.Duration
+	// How often the main loop checks its timers and applies newly
+	// committed entries. Defaults to 10ms.
+	TickInterval time.Duration
+
+	// Most entries sent in one AppendEntries request. Defaults to
+	// MAX_APPEND_ENTRIES_BATCH.
+	MaxAppendEntriesBatch int
+	// Most AppendEntries requests in flight to one follower. Defaults
+	// to MAX_INFLIGHT_APPEND_ENTRIES.
+	MaxInflightAppendEntries int
+	// Most commands appended to the log in one batch. Defaults to
+	// MAX_APPLY_BATCH; 1 turns batching off.
+	MaxApplyBatch int
+	// How long the first command of a batch waits for others to join
+	// it. Defaults to APPLY_BATCH_DELAY; negative turns the wait off.
+	ApplyBatchDelay time.Duration
+	// Applied entries since the last snapshot that trigger a new one.
+	// Defaults to SNAPSHOT_THRESHOLD.
+	SnapshotThreshold uint64
+	// Size at which a new WAL segment is started. Defaults to
+	// WAL_SEGMENT_SIZE.
+	WALSegmentSize int64
+
+	// Defaults to FsyncAlways.
+	Fsync FsyncPolicy
+
+	// PEM files holding this server's certificate and key, and the CA
+	// that signs every member's certificate. If set, peers talk over
+	// mutual TLS and each certificate's CommonName must be the
+	// member's id; see tls.go. Set all three or none.
+	TLSCertFile string
+	TLSKeyFile  string
+	TLSCAFile   string
+
+	// Where warnings, and debug messages if Debug is set, are
+	// written. Defaults to standard output.
+	LogOutput io.Writer
+	Debug     bool
+}
+
+type FsyncPolicy int
+
+const (
+	// Sync the log and metadata to disk before acting on them, as
+	// Raft requires.
+	FsyncAlways FsyncPolicy = iota
+	// Never sync. A machine crash can lose entries and votes the
+	// server already acknowledged, breaking Raft's guarantees. Only
+	// for tests and benchmarks.
+	FsyncNever
+)
+
+const DEFAULT_HEARTBEAT_INTERVAL = 150 * time.Millisecond
+
+const DEFAULT_TICK_INTERVAL = 10 * time.Millisecond
+
+var ErrInvalidConfig = errors.New("Invalid configuration")
+
+// withDefaults fills in every field left at its zero value.
+func (c Config) withDefaults() Config {
+	if c.MetadataDir == "" {
+		c.MetadataDir = "."
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = DEFAULT_HEARTBEAT_INTERVAL
+	}
+	if c.ElectionTimeoutMin == 0 {
+		c.ElectionTimeoutMin = 2 * c.HeartbeatInterval
+	}
+	if c.ElectionTimeoutMax == 0 {
+		c.ElectionTimeoutMax = 2 * c.ElectionTimeoutMin
+	}
+	if c.TickInterval == 0 {
+		c.TickInterval = min(DEFAULT_TICK_INTERVAL, c.HeartbeatInterval)
+	}
+	if c.MaxAppendEntriesBatch == 0 {
+		c.MaxAppendEntriesBatch = MAX_APPEND_ENTRIES_BATCH
+	}
+	if c.MaxInflightAppendEntries == 0 {
+		c.MaxInflightAppendEntries = MAX_INFLIGHT_APPEND_ENTRIES
+	}
+	if c.MaxApplyBatch == 0 {
+		c.MaxApplyBatch = MAX_APPLY_BATCH
+	}
+	if c.ApplyBatchDelay == 0 {
+		c.ApplyBatchDelay = APPLY_BATCH_DELAY
+	}
+	if c.SnapshotThreshold == 0 {
+		c.SnapshotThreshold = SNAPSHOT_THRESHOLD
+	}
+	if c.WALSegmentSize == 0 {
+		c.WALSegmentSize = WAL_SEGMENT_SIZE
+	}
+	if c.LogOutput == nil {
+		c.LogOutput = os.Stdout
+	}
+	return c
+}
+
+// validate checks a config that already has its defaults filled in.
+func (c Config) validate() error {
+	invalid := func(format string, args ...any) error {
+		return fmt.Errorf("%w: %s", ErrInvalidConfig, fmt.Sprintf(format, args...))
+	}
+
+	switch {
+	case c.HeartbeatInterval < 0:
+		return invalid("HeartbeatInterval must be positive")
+	case c.ElectionTimeoutMin <= c.HeartbeatInterval:
+		return invalid("ElectionTimeoutMin (%s) must be longer than HeartbeatInterval (%s)",
+			c.ElectionTimeoutMin, c.HeartbeatInterval)
+	case c.ElectionTimeoutMax < c.ElectionTimeoutMin:
+		return invalid("ElectionTimeoutMax (%s) must not be shorter than ElectionTimeoutMin (%s)",
+			c.ElectionTimeoutMax, c.ElectionTimeoutMin)
+	case c.TickInterval < 0 || c.TickInterval > c.HeartbeatInterval:
+		return invalid("TickInterval (%s) must be positive and at most HeartbeatInterval (%s)",
+			c.TickInterval, c.HeartbeatInterval)
+	case c.MaxAppendEntriesBatch < 0:
+		return invalid("MaxAppendEntriesBatch must be positive")
+	case c.MaxInflightAppendEntries < 0:
+		return invalid("MaxInflightAppendEntries must be positive")
+	case c.MaxApplyBatch < 0:
+		return invalid("MaxApplyBatch must be positive")
+	case c.WALSegmentSize < 0:
+		return invalid("WALSegmentSize must be positive")
+	case c.Fsync != FsyncAlways && c.Fsync != FsyncNever:
+		return invalid("unknown Fsync policy %d", c.Fsync)
+	case (c.TLSCertFile == "") != (c.TLSKeyFile == "") || (c.TLSCertFile == "") != (c.TLSCAFile == ""):
+		return invalid("TLSCertFile, TLSKeyFile and TLSCAFile must be set together")
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package goraft
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func Test_config_defaults(t *testing.T) {
+	c := Config{HeartbeatInterval: 50 * time.Millisecond}.withDefaults()
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Timeouts left unset scale with the heartbeat.
+	if c.ElectionTimeoutMin != 100*time.Millisecond || c.ElectionTimeoutMax != 200*time.Millisecond {
+		t.Errorf("Expected election timeouts 100ms-200ms, got %s-%s", c.ElectionTimeoutMin, c.ElectionTimeoutMax)
+	}
+	if c.TickInterval != DEFAULT_TICK_INTERVAL || c.MaxApplyBatch != MAX_APPLY_BATCH || c.Fsync != FsyncAlways {
+		t.Errorf("Expected defaults, got %+v", c)
+	}
+
+	// A negative delay turns the wait off rather than taking the
+	// default.
+	c = Config{ApplyBatchDelay: -1}.withDefaults()
+	if err := c.validate(); err != nil || c.ApplyBatchDelay >= 0 {
+		t.Errorf("Expected a negative ApplyBatchDelay to be kept, got %s (%v)", c.ApplyBatchDelay, err)
+	}
+
+	s, err := NewServer([]ClusterMember{{Id: 7, Address: ":3030"}}, nil, Config{}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Metadata() != "md_7.dat" || s.config.MetadataDir != "." {
+		t.Errorf("Expected md_7.dat in the working directory, got %s in %s", s.Metadata(), s.config.MetadataDir)
+	}
+}
+
+func Test_config_validation(t *testing.T) {
+	for _, c := range []Config{
+		{HeartbeatInterval: -time.Second},
+		{HeartbeatInterval: time.Second, ElectionTimeoutMin: time.Second},
+		{ElectionTimeoutMin: time.Second, ElectionTimeoutMax: 500 * time.Millisecond},
+		{TickInterval: time.Second},
+		{MaxAppendEntriesBatch: -1},
+		{Fsync: FsyncPolicy(5)},
+	} {
+		_, err := NewServer([]ClusterMember{{Id: 1, Address: ":3030"}}, nil, c, 0)
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Expected ErrInvalidConfig for %+v, got %v", c, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package goraft
+
+import "fmt"
+
+// A DurableStateMachine keeps its own state on disk, along with the
+// index of the last entry applied to it. A restarted server resumes
+// applying after that index instead of restoring the latest snapshot
+// and replaying the log into the state machine.
+//
+// Entries that don't reach the state machine (configuration changes,
+// client registrations, leader no-ops) don't move its index, so a
+// restart goes over them again. The server rebuilds its configuration
+// and session table from the snapshot and the log up to the applied
+// index. Sessions can't recover the results of commands in that
+// stretch, so a retry of one of them gets ErrResultDiscarded. It is
+// not applied again.
+//
+// If the log no longer reaches the applied index, because it was
+// truncated, written without fsync, or removed, the state machine
+// holds entries the server doesn't have. It is then rebuilt: restored
+// from the snapshot, or reset with RestoreIndex(0, nil) if there is
+// none, and the log applied to it again.
+type DurableStateMachine interface {
+	StateMachine
+
+	// ApplyIndex applies cmd, the command of the entry at index, and
+	// records index as applied atomically with its effects. What it
+	// records need not be durable until Flush.
+	ApplyIndex(index uint64, cmd []byte) ([]byte, error)
+
+	// Flush makes what ApplyIndex recorded since the last call
+	// durable. The server calls it once it has applied all the
+	// entries committed so far, so one write can cover them.
+	Flush() error
+
+	// RestoreIndex replaces the state machine's contents with a
+	// snapshot taken at index, and records index as applied. A nil
+	// snapshot at index 0 is the empty state machine.
+	RestoreIndex(index uint64, snapshot []byte) error
+
+	// AppliedIndex returns the index last recorded by ApplyIndex or
+	// RestoreIndex, or 0 if there is none.
+	AppliedIndex() uint64
+}
+
+// resume catches the configuration and session table up to the index a
+// durable state machine has already applied, without applying anything
+// to the state machine, and reports whether it did. If it didn't, the
+// state machine is restored from the snapshot, or already reset if
+// there is none. Called with the lock held while restoring, once the
+// log and snapshot are loaded.
+func (s *Server) resume(snap snapshot, haveSnapshot bool) bool {
+	if s.statemachine == nil || s.statemachine.durable == nil {
+		return false
+	}
+
+	applied := s.statemachine.durable.AppliedIndex()
+	if applied == 0 || applied < s.snapshotIndex {
+		return false
+	}
+	if applied > s.lastLogIndex() {
+		s.warn(fmt.Sprintf("State machine applied through index %d, but the log ends at %d; rebuilding it",
+			applied, s.lastLogIndex()))
+		if !haveSnapshot {
+			if err := s.statemachine.restore(0, nil); err != nil {
+				panic(err)
+			}
+		}
+		return false
+	}
+
+	if haveSnapshot {
+		if err := s.statemachine.restoreSessions(snap.data); err != nil {
+			panic(err)
+		}
+		s.setConfiguration(snap.index, decodeConfiguration(snap.configuration))
+	}
+
+	s.statemachine.replaying = true
+	for i := s.snapshotIndex + 1; i <= applied; i++ {
+		e := s.log[s.entryIndex(i)]
+		switch e.Kind {
+		case ConfigurationEntry:
+			s.setConfiguration(i, decodeConfiguration(e.Command))
+		case RegisterClientEntry, SessionCommandEntry:
+			s.statemachine.applySession(i, e)
+		}
+	}
+	s.statemachine.replaying = false
+
+	s.commitIndex = max(s.commitIndex, applied)
+	s.lastApplied = applied
+	s.debugf("Resuming after index %d applied by the state machine", applied)
+	return true
+}
@@ -0,0 +1,151 @@
+package goraft
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keeps its state across servers the way one on disk would across
+// restarts.
+type durableStateMachine struct {
+	testStateMachine
+	index   uint64
+	flushes int
+}
+
+func (sm *durableStateMachine) ApplyIndex(index uint64, cmd []byte) ([]byte, error) {
+	sm.index = index
+	return sm.Apply(cmd)
+}
+
+func (sm *durableStateMachine) RestoreIndex(index uint64, snapshot []byte) error {
+	sm.index = index
+	return sm.Restore(snapshot)
+}
+
+func (sm *durableStateMachine) AppliedIndex() uint64 {
+	return sm.index
+}
+
+func (sm *durableStateMachine) Flush() error {
+	sm.flushes++
+	return nil
+}
+
+func Test_durable_resume(t *testing.T) {
+	dir := t.TempDir()
+	sm := &durableStateMachine{}
+	s := newTestServer(t, dir, sm)
+
+	now := time.Now()
+	members := []ClusterMember{
+		{Id: 1, Address: ":3030"},
+		{Id: 2, Address: ":3031", Role: Learner},
+	}
+	entries := []Entry{
+		{Term: 1, Command: []byte("a")},
+		{Term: 1, Kind: RegisterClientEntry, Command: encodeRegistration(now)},
+		{Term: 1, Kind: SessionCommandEntry, Command: encodeSessionCommand(2, 1, now, []byte("b"))},
+		{Term: 1, Kind: ConfigurationEntry, Command: encodeConfiguration(members)},
+		{Term: 1, Command: []byte("c")},
+	}
+
+	s.mu.Lock()
+	s.log = append(s.log, entries...)
+	s.persist(true, len(entries))
+	s.commitIndex = uint64(len(entries))
+	s.mu.Unlock()
+	s.advanceCommitIndex()
+
+	if sm.index != 5 || strings.Join(sm.applied, "") != "abc" {
+		t.Fatalf("Expected a, b and c applied through index 5, got %v at %d", sm.applied, sm.index)
+	}
+	if sm.flushes != 1 {
+		t.Errorf("Expected the entries applied together to be flushed once, got %d flushes", sm.flushes)
+	}
+
+	// Nothing is applied again, but the configuration and sessions
+	// are caught up to the state machine.
+	restored := newTestServer(t, dir, sm)
+	restored.mu.Lock()
+	defer restored.mu.Unlock()
+
+	if strings.Join(sm.applied, "") != "abc" {
+		t.Errorf("Expected no commands applied on restart, got %v", sm.applied)
+	}
+	if restored.lastApplied != 5 || restored.commitIndex != 5 {
+		t.Errorf("Expected to resume after index 5, got lastApplied %d, commitIndex %d", restored.lastApplied, restored.commitIndex)
+	}
+	if len(restored.cluster) != 2 || restored.configIndex != 4 {
+		t.Errorf("Expected the configuration from index 4, got %d members from %d", len(restored.cluster), restored.configIndex)
+	}
+
+	res := restored.statemachine.applySession(6, Entry{
+		Kind:    SessionCommandEntry,
+		Command: encodeSessionCommand(2, 1, now, []byte("b")),
+	})
+	if res.Error != ErrResultDiscarded || len(sm.applied) != 3 {
+		t.Errorf("Expected a retry to be refused without applying it, got %v", res)
+	}
+}
+
+func Test_durable_rebuild(t *testing.T) {
+	dir := t.TempDir()
+	sm := &durableStateMachine{}
+	s := newTestServer(t, dir, sm)
+
+	s.mu.Lock()
+	s.log = append(s.log,
+		Entry{Term: 1, Command: []byte("a")},
+		Entry{Term: 1, Command: []byte("b")},
+		Entry{Term: 1, Command: []byte("c")},
+	)
+	s.commitIndex = 3
+	s.persist(true, 3)
+	s.mu.Unlock()
+	s.advanceCommitIndex()
+	s.Shutdown()
+
+	// The log loses an entry the state machine has applied, which is
+	// rebuilt from what is left.
+	if err := TruncateLog(Config{MetadataDir: dir}, 1, 2, true); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestServer(t, dir, sm)
+	restored.advanceCommitIndex()
+	if sm.index != 2 || strings.Join(sm.applied, "") != "ab" {
+		t.Fatalf("Expected a and b applied through index 2, got %v at %d", sm.applied, sm.index)
+	}
+	restored.Shutdown()
+
+	// Without any log, it is reset.
+	if err := os.Remove(path.Join(dir, metadataFileName(1))); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(path.Join(dir, walDirName(1))); err != nil {
+		t.Fatal(err)
+	}
+	newTestServer(t, dir, sm)
+	if sm.index != 0 || len(sm.applied) != 0 {
+		t.Errorf("Expected the state machine reset, got %v at %d", sm.applied, sm.index)
+	}
+}
+
+func Test_flush_without_state_machine(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), nil)
+
+	// A leader's no-op has nothing to apply or flush.
+	s.mu.Lock()
+	s.log = append(s.log, Entry{Term: 1})
+	s.persist(true, 1)
+	s.commitIndex = 1
+	s.mu.Unlock()
+	s.advanceCommitIndex()
+
+	if s.lastApplied != 1 {
+		t.Errorf("Expected the no-op applied, lastApplied is %d", s.lastApplied)
+	}
+}
@@ -0,0 +1,86 @@
+package goraft
+
+// Observers are told about changes in leadership, terms, commits and
+// connectivity as they happen on this server.
+
+type EventKind string
+
+const (
+	// A leader for Term is known. LeaderId may be this server.
+	LeaderElected EventKind = "leader-elected"
+	// This server stopped being leader of Term.
+	SteppedDown EventKind = "stepped-down"
+	// This server moved to a new Term.
+	TermChanged EventKind = "term-changed"
+	// Every entry up to Index is committed and applied.
+	EntryCommitted EventKind = "entry-committed"
+	// An RPC to PeerId failed after the previous one succeeded.
+	PeerUnreachable EventKind = "peer-unreachable"
+	// An RPC to PeerId succeeded after the previous one failed.
+	PeerReachable EventKind = "peer-reachable"
+)
+
+type Event struct {
+	Kind     EventKind
+	Term     uint64
+	LeaderId uint64 `json:",omitempty"`
+	Index    uint64 `json:",omitempty"`
+	PeerId   uint64 `json:",omitempty"`
+}
+
+// Observe sends every event on this server to ch until the returned
+// function is called. Events are sent without blocking and dropped if
+// ch is full, so a slow observer can't hold up the server.
+func (s *Server) Observe(ch chan<- Event) (stop func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.observers == nil {
+		s.observers = map[int]chan<- Event{}
+	}
+	id := s.nextObserver
+	s.nextObserver++
+	s.observers[id] = ch
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.observers, id)
+	}
+}
+
+// emit is called with the lock held.
+func (s *Server) emit(e Event) {
+	if e.Term == 0 {
+		e.Term = s.currentTerm
+	}
+	for _, ch := range s.observers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// setLeader records the leader of the current term once it is known.
+func (s *Server) setLeader(id uint64) {
+	if s.leaderId != id {
+		s.leaderId = id
+		s.emit(Event{Kind: LeaderElected, LeaderId: id})
+	}
+}
+
+// setReachable records whether the last RPC to member id succeeded.
+func (s *Server) setReachable(id uint64, reachable bool) {
+	i := s.memberIndex(id)
+	if i < 0 || s.cluster[i].unreachable == !reachable {
+		return
+	}
+
+	s.cluster[i].unreachable = !reachable
+	if reachable {
+		s.emit(Event{Kind: PeerReachable, PeerId: id})
+	} else {
+		s.emit(Event{Kind: PeerUnreachable, PeerId: id})
+	}
+}
@@ -0,0 +1,96 @@
+package goraft
+
+import (
+	"errors"
+	"testing"
+)
+
+func Test_events(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	s := servers[0]
+	// Drop the RPCs the server sends so they can't report the other
+	// server unreachable halfway through the test.
+	s.spawn = func(func()) {}
+
+	events := make(chan Event, 16)
+	stop := s.Observe(events)
+
+	expect := func(want ...Event) {
+		t.Helper()
+		for _, w := range want {
+			select {
+			case e := <-events:
+				if e != w {
+					t.Fatalf("Expected %+v, got %+v", w, e)
+				}
+			default:
+				t.Fatalf("Expected %+v, got nothing", w)
+			}
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("Unexpected event %+v", e)
+		default:
+		}
+	}
+
+	var rsp AppendEntriesResponse
+	s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 1},
+		LeaderId:   2,
+	}, &rsp)
+	expect(
+		Event{Kind: TermChanged, Term: 1},
+		Event{Kind: LeaderElected, Term: 1, LeaderId: 2},
+	)
+
+	// Heartbeats from the same leader are not news.
+	s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 1},
+		LeaderId:   2,
+	}, &rsp)
+	expect()
+
+	s.mu.Lock()
+	s.startElection()
+	s.mu.Unlock()
+	expect(Event{Kind: TermChanged, Term: 2})
+
+	s.mu.Lock()
+	s.cluster[1].votedFor = s.id
+	s.mu.Unlock()
+	s.becomeLeader()
+	expect(Event{Kind: LeaderElected, Term: 2, LeaderId: 1})
+
+	s.mu.Lock()
+	s.cluster[1].matchIndex = s.lastLogIndex()
+	s.mu.Unlock()
+	s.advanceCommitIndex()
+	expect(Event{Kind: EntryCommitted, Term: 2, Index: 1})
+
+	down := errors.New("unreachable")
+	s.rpcCall(2, func(string) error { return down })
+	s.rpcCall(2, func(string) error { return down })
+	s.rpcCall(2, func(string) error { return nil })
+	expect(
+		Event{Kind: PeerUnreachable, Term: 2, PeerId: 2},
+		Event{Kind: PeerReachable, Term: 2, PeerId: 2},
+	)
+
+	s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 3},
+		LeaderId:   2,
+	}, &rsp)
+	expect(
+		Event{Kind: SteppedDown, Term: 2},
+		Event{Kind: TermChanged, Term: 3},
+		Event{Kind: LeaderElected, Term: 3, LeaderId: 2},
+	)
+
+	stop()
+	s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 4},
+		LeaderId:   2,
+	}, &rsp)
+	expect()
+}
@@ -0,0 +1,432 @@
+package goraft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// A Host runs many Raft groups in one process over a single listener.
+// Each group is an ordinary Server whose RPCs carry its group id, so
+// the host can hand incoming requests to the right group. One loop
+// ticks every group, and leaders send heartbeats on a shared schedule;
+// heartbeats leaving for the same peer at the same time go out
+// together in one AppendEntriesBatch.
+//
+// A process uses the same address, and the same member id, in every
+// group it hosts.
+
+// How long a heartbeat waits for others bound for the same peer
+// before they are sent. Hosted groups' heartbeats are spawned in the
+// same tick, so they arrive close together.
+const HEARTBEAT_BATCH_DELAY = time.Millisecond
+
+var (
+	ErrUnknownGroup = errors.New("No such Raft group on this host")
+	ErrGroupExists  = errors.New("Raft group already exists")
+)
+
+type Host struct {
+	mu      sync.Mutex
+	done    bool
+	started bool
+	config  Config
+	address string
+
+	// Carries every group's RPCs. Defaults as for Server; may be
+	// replaced before Start.
+	Transport Transport
+
+	groups map[uint64]*Server
+	// Heartbeats waiting to be sent, by peer address.
+	heartbeats map[string]*heartbeatQueue
+	// Closed once the tick loop has returned.
+	stopped chan struct{}
+}
+
+// AppendEntriesBatch carries AppendEntries requests for several groups
+// to the same host.
+type AppendEntriesBatch struct {
+	Requests []AppendEntriesRequest
+}
+
+type AppendEntriesBatchResponse struct {
+	Responses []AppendEntriesResponse
+	// The error handling each request returned, or "".
+	Errors []string
+}
+
+// batchHandler is implemented by RPC handlers that accept
+// AppendEntriesBatch. Host does.
+type batchHandler interface {
+	HandleAppendEntriesBatch(req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error
+}
+
+// batchTransport is implemented by transports that can send
+// AppendEntriesBatch. Without it a Host sends each heartbeat on its
+// own.
+type batchTransport interface {
+	AppendEntriesBatch(id uint64, address string, req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error
+}
+
+type heartbeatQueue struct {
+	pending []*pendingHeartbeat
+	sending bool
+}
+
+type pendingHeartbeat struct {
+	id   uint64
+	req  AppendEntriesRequest
+	rsp  *AppendEntriesResponse
+	done chan error
+}
+
+// NewHost returns a host listening on address. config is the template
+// for every group's Config; each group keeps its files in
+// group_<id> under config.MetadataDir.
+func NewHost(address string, config Config) (*Host, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Host{
+		config:     config,
+		address:    address,
+		Transport:  transport,
+		groups:     map[uint64]*Server{},
+		heartbeats: map[string]*heartbeatQueue{},
+	}, nil
+}
+
+func groupDirName(groupId uint64) string {
+	return fmt.Sprintf("group_%d", groupId)
+}
+
+// AddGroup creates the server for group groupId, in which this host is
+// cluster[clusterIndex]. A group added to a started host starts right
+// away; otherwise it starts with the host. Joining may be set on the
+// returned server before then.
+func (h *Host) AddGroup(groupId uint64, cluster []ClusterMember, statemachine StateMachine, clusterIndex int) (*Server, error) {
+	if groupId == 0 {
+		return nil, errors.New("Group id must not be 0")
+	}
+	if cluster[clusterIndex].Address != h.address {
+		return nil, fmt.Errorf("Member %d of group %d is at %s, not this host's address %s",
+			cluster[clusterIndex].Id, groupId, cluster[clusterIndex].Address, h.address)
+	}
+
+	config := h.config
+	config.MetadataDir = path.Join(h.config.MetadataDir, groupDirName(groupId))
+	// The host's transport does TLS for every group.
+	config.TLSCertFile, config.TLSKeyFile, config.TLSCAFile = "", "", ""
+	if err := os.MkdirAll(config.MetadataDir, 0755); err != nil {
+		return nil, err
+	}
+
+	s, err := NewServer(cluster, statemachine, config, clusterIndex)
+	if err != nil {
+		return nil, err
+	}
+	s.Transport = &groupTransport{host: h, groupId: groupId}
+	s.hosted = true
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.done {
+		return nil, ErrStopped
+	}
+	if _, ok := h.groups[groupId]; ok {
+		return nil, ErrGroupExists
+	}
+	h.groups[groupId] = s
+	if h.started {
+		s.open()
+	}
+	return s, nil
+}
+
+// Group returns the server for groupId, or nil.
+func (h *Host) Group(groupId uint64) *Server {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.groups[groupId]
+}
+
+// RemoveGroup stops group groupId and forgets it. Its files are left
+// in place.
+func (h *Host) RemoveGroup(ctx context.Context, groupId uint64) error {
+	h.mu.Lock()
+	s := h.groups[groupId]
+	delete(h.groups, groupId)
+	h.mu.Unlock()
+
+	if s == nil {
+		return ErrUnknownGroup
+	}
+	return s.Stop(ctx)
+}
+
+// Start starts every group added so far, listens for their RPCs and
+// starts ticking them.
+func (h *Host) Start() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if err := h.Transport.Listen(h.address, h); err != nil {
+		return err
+	}
+	for _, s := range h.groups {
+		s.open()
+	}
+
+	h.started = true
+	h.stopped = make(chan struct{})
+	go h.run(h.stopped)
+	return nil
+}
+
+func (h *Host) run(stopped chan struct{}) {
+	defer close(stopped)
+
+	var groups []*Server
+	for {
+		h.mu.Lock()
+		if h.done {
+			h.mu.Unlock()
+			return
+		}
+		groups = groups[:0]
+		for _, s := range h.groups {
+			groups = append(groups, s)
+		}
+		h.mu.Unlock()
+
+		for _, s := range groups {
+			s.mu.Lock()
+			done := s.done
+			s.mu.Unlock()
+			if !done {
+				s.tick()
+			}
+		}
+		time.Sleep(h.config.TickInterval)
+	}
+}
+
+// Stop stops the tick loop and the listener, then stops every group as
+// Server.Stop does, returning the first error.
+func (h *Host) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	h.done = true
+	stopped := h.stopped
+	var groups []*Server
+	for _, s := range h.groups {
+		groups = append(groups, s)
+	}
+	h.mu.Unlock()
+
+	if stopped != nil {
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	// Closing the transport also unblocks RPCs still waiting on peers.
+	err := h.Transport.Close()
+	for _, s := range groups {
+		if e := s.Stop(ctx); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (h *Host) group(groupId uint64) (*Server, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.groups[groupId]
+	if s == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownGroup, groupId)
+	}
+	return s, nil
+}
+
+func (h *Host) HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	s, err := h.group(req.GroupId)
+	if err != nil {
+		return err
+	}
+	return s.HandleRequestVoteRequest(req, rsp)
+}
+
+func (h *Host) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	s, err := h.group(req.GroupId)
+	if err != nil {
+		return err
+	}
+	return s.HandleAppendEntriesRequest(req, rsp)
+}
+
+func (h *Host) HandleInstallSnapshotRequest(req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	s, err := h.group(req.GroupId)
+	if err != nil {
+		return err
+	}
+	return s.HandleInstallSnapshotRequest(req, rsp)
+}
+
+func (h *Host) HandleTimeoutNowRequest(req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	s, err := h.group(req.GroupId)
+	if err != nil {
+		return err
+	}
+	return s.HandleTimeoutNowRequest(req, rsp)
+}
+
+// HandleAppendEntriesBatch handles each request in the batch
+// concurrently; every one is for a different group.
+func (h *Host) HandleAppendEntriesBatch(req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error {
+	rsp.Responses = make([]AppendEntriesResponse, len(req.Requests))
+	rsp.Errors = make([]string, len(req.Requests))
+
+	var wg sync.WaitGroup
+	for i := range req.Requests {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := h.HandleAppendEntriesRequest(req.Requests[i], &rsp.Responses[i]); err != nil {
+				rsp.Errors[i] = err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+	return nil
+}
+
+// sendHeartbeat queues a heartbeat for the peer at address and waits
+// for its response. The first caller to find the queue idle starts a
+// sender, which waits HEARTBEAT_BATCH_DELAY and then sends everything
+// queued in one batch, until the queue is empty.
+func (h *Host) sendHeartbeat(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	bt, ok := h.Transport.(batchTransport)
+	if !ok {
+		return h.Transport.AppendEntries(id, address, req, rsp)
+	}
+
+	hb := &pendingHeartbeat{id: id, req: req, rsp: rsp, done: make(chan error, 1)}
+	h.mu.Lock()
+	q := h.heartbeats[address]
+	if q == nil {
+		q = &heartbeatQueue{}
+		h.heartbeats[address] = q
+	}
+	q.pending = append(q.pending, hb)
+	send := !q.sending
+	q.sending = true
+	h.mu.Unlock()
+
+	if send {
+		go h.flushHeartbeats(bt, address, q)
+	}
+	return <-hb.done
+}
+
+func (h *Host) flushHeartbeats(bt batchTransport, address string, q *heartbeatQueue) {
+	for {
+		time.Sleep(HEARTBEAT_BATCH_DELAY)
+
+		h.mu.Lock()
+		batch := q.pending
+		q.pending = nil
+		if len(batch) == 0 {
+			q.sending = false
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+
+		if len(batch) == 1 {
+			hb := batch[0]
+			hb.done <- h.Transport.AppendEntries(hb.id, address, hb.req, hb.rsp)
+			continue
+		}
+
+		var req AppendEntriesBatch
+		for _, hb := range batch {
+			req.Requests = append(req.Requests, hb.req)
+		}
+		var rsp AppendEntriesBatchResponse
+		err := bt.AppendEntriesBatch(batch[0].id, address, req, &rsp)
+		if err == nil && len(rsp.Responses) != len(batch) {
+			err = fmt.Errorf("Expected %d responses in batch, got %d", len(batch), len(rsp.Responses))
+		}
+
+		for i, hb := range batch {
+			switch {
+			case err != nil:
+				hb.done <- err
+			case rsp.Errors[i] != "":
+				hb.done <- errors.New(rsp.Errors[i])
+			default:
+				*hb.rsp = rsp.Responses[i]
+				hb.done <- nil
+			}
+		}
+	}
+}
+
+// groupTransport is the Transport of a hosted server. It stamps the
+// group id on outgoing requests and sends them over the host's
+// transport; the host does the listening.
+type groupTransport struct {
+	host    *Host
+	groupId uint64
+}
+
+func (t *groupTransport) Listen(address string, handler RPCHandler) error {
+	return nil
+}
+
+func (t *groupTransport) RequestVote(id uint64, address string, req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	req.GroupId = t.groupId
+	return t.host.Transport.RequestVote(id, address, req, rsp)
+}
+
+func (t *groupTransport) AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	req.GroupId = t.groupId
+	if len(req.Entries) == 0 {
+		return t.host.sendHeartbeat(id, address, req, rsp)
+	}
+	return t.host.Transport.AppendEntries(id, address, req, rsp)
+}
+
+func (t *groupTransport) InstallSnapshot(id uint64, address string, req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	req.GroupId = t.groupId
+	return t.host.Transport.InstallSnapshot(id, address, req, rsp)
+}
+
+func (t *groupTransport) TimeoutNow(id uint64, address string, req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	req.GroupId = t.groupId
+	return t.host.Transport.TimeoutNow(id, address, req, rsp)
+}
+
+// Other groups may still talk to the peer, and the host closes every
+// connection when it stops.
+func (t *groupTransport) ClosePeer(id uint64, address string) {}
+
+func (t *groupTransport) Close() error {
+	return nil
+}
@@ -0,0 +1,105 @@
+package goraft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync/atomic"
+	"testing"
+)
+
+// countingTransport counts the heartbeat batches sent with more than
+// one request in them.
+type countingTransport struct {
+	Transport
+	batches *atomic.Int64
+}
+
+func (t countingTransport) AppendEntriesBatch(id uint64, address string, req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error {
+	if len(req.Requests) > 1 {
+		t.batches.Add(1)
+	}
+	return t.Transport.(batchTransport).AppendEntriesBatch(id, address, req, rsp)
+}
+
+func Test_host(t *testing.T) {
+	network := NewInmemNetwork()
+	var batches atomic.Int64
+	// With more groups than hosts, some host leads at least two
+	// groups and has heartbeats to batch.
+	groupIds := []uint64{1, 2, 3, 4}
+
+	var cluster []ClusterMember
+	for i := 0; i < 3; i++ {
+		cluster = append(cluster, ClusterMember{Id: uint64(i + 1), Address: fmt.Sprintf("host%d", i+1)})
+	}
+
+	dirs := map[int]string{}
+	groups := map[uint64][]*Server{}
+	sms := map[uint64][]*testStateMachine{}
+	for i := range cluster {
+		dirs[i] = t.TempDir()
+		h, err := NewHost(cluster[i].Address, Config{MetadataDir: dirs[i]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.Transport = countingTransport{network.NewTransport(), &batches}
+
+		for _, g := range groupIds {
+			sm := &testStateMachine{}
+			s, err := h.AddGroup(g, cluster, sm, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups[g] = append(groups[g], s)
+			sms[g] = append(sms[g], sm)
+		}
+		if _, err := h.AddGroup(1, cluster, nil, i); !errors.Is(err, ErrGroupExists) {
+			t.Fatalf("Expected adding group 1 twice to fail, got %v", err)
+		}
+
+		if err := h.Start(); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { h.Stop(context.Background()) })
+	}
+
+	// Each group elects its own leader and applies only its own
+	// commands.
+	for _, g := range groupIds {
+		leader := findLeader(t, groups[g], nil)
+		if _, err := leader.Apply([][]byte{[]byte(fmt.Sprintf("group %d", g))}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, g := range groupIds {
+		for i, s := range groups[g] {
+			sm := sms[g][i]
+			waitFor(t, fmt.Sprintf("group %d to apply on host %d", g, i+1), func() bool {
+				s.mu.Lock()
+				defer s.mu.Unlock()
+				return len(sm.applied) == 1 && sm.applied[0] == fmt.Sprintf("group %d", g)
+			})
+		}
+	}
+
+	waitFor(t, "heartbeats to be batched", func() bool { return batches.Load() > 0 })
+
+	for i := range cluster {
+		for _, g := range groupIds {
+			name := path.Join(dirs[i], groupDirName(g), metadataFileName(cluster[i].Id))
+			if _, err := os.Stat(name); err != nil {
+				t.Errorf("Expected group %d's metadata in its own directory: %s", g, err)
+			}
+		}
+	}
+
+	// A request for a group the host doesn't run is refused.
+	var rsp RequestVoteResponse
+	err := network.NewTransport().RequestVote(1, "host1", RequestVoteRequest{RPCMessage: RPCMessage{GroupId: 9}}, &rsp)
+	if !errors.Is(err, ErrUnknownGroup) {
+		t.Errorf("Expected ErrUnknownGroup, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package goraft
+
+import (
+	"errors"
+	"sync"
+)
+
+// InmemNetwork connects servers running in the same process, so a
+// whole cluster can run inside a test without opening sockets. Every
+// server needs its own transport from NewTransport.
+type InmemNetwork struct {
+	mu        sync.Mutex
+	endpoints map[string]*inmemEndpoint
+	isolated  map[string]bool
+}
+
+var ErrUnreachable = errors.New("Server is unreachable")
+
+// Each listening server gets a queue of incoming requests, served in
+// order by a single goroutine.
+type inmemEndpoint struct {
+	requests chan inmemRequest
+	done     chan struct{}
+}
+
+type inmemRequest struct {
+	handle func(RPCHandler) error
+	reply  chan error
+}
+
+const INMEM_QUEUE_SIZE = 64
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		endpoints: map[string]*inmemEndpoint{},
+		isolated:  map[string]bool{},
+	}
+}
+
+// Isolate cuts address off from every other server until Rejoin is
+// called. Requests to or from it fail with ErrUnreachable.
+func (n *InmemNetwork) Isolate(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.isolated[address] = true
+}
+
+func (n *InmemNetwork) Rejoin(address string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.isolated, address)
+}
+
+func (n *InmemNetwork) NewTransport() Transport {
+	return &inmemTransport{network: n}
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	address string
+}
+
+func (t *inmemTransport) Listen(address string, handler RPCHandler) error {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.endpoints[address]; ok {
+		return errors.New("Address already in use: " + address)
+	}
+
+	e := &inmemEndpoint{
+		requests: make(chan inmemRequest, INMEM_QUEUE_SIZE),
+		done:     make(chan struct{}),
+	}
+	n.endpoints[address] = e
+	t.address = address
+
+	go func() {
+		for {
+			select {
+			case req := <-e.requests:
+				req.reply <- req.handle(handler)
+			case <-e.done:
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (t *inmemTransport) call(address string, handle func(RPCHandler) error) error {
+	n := t.network
+	n.mu.Lock()
+	e := n.endpoints[address]
+	unreachable := e == nil || n.isolated[address] || n.isolated[t.address]
+	n.mu.Unlock()
+
+	if unreachable {
+		return ErrUnreachable
+	}
+
+	req := inmemRequest{handle: handle, reply: make(chan error, 1)}
+	select {
+	case e.requests <- req:
+	case <-e.done:
+		return ErrUnreachable
+	}
+
+	select {
+	case err := <-req.reply:
+		return err
+	case <-e.done:
+		return ErrUnreachable
+	}
+}
+
+func (t *inmemTransport) RequestVote(id uint64, address string, req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	return t.call(address, func(h RPCHandler) error {
+		return h.HandleRequestVoteRequest(req, rsp)
+	})
+}
+
+func (t *inmemTransport) AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	// The receiver must not share the sender's result channels, which
+	// net/rpc would never have encoded.
+	entries := make([]Entry, len(req.Entries))
+	for i := range req.Entries {
+		// Copying the whole entry would read the result channel,
+		// which the sender may be clearing.
+		e := &req.Entries[i]
+		entries[i] = Entry{Command: e.Command, Term: e.Term, Kind: e.Kind}
+	}
+	req.Entries = entries
+
+	return t.call(address, func(h RPCHandler) error {
+		return h.HandleAppendEntriesRequest(req, rsp)
+	})
+}
+
+func (t *inmemTransport) AppendEntriesBatch(id uint64, address string, req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error {
+	return t.call(address, func(h RPCHandler) error {
+		bh, ok := h.(batchHandler)
+		if !ok {
+			return errors.New("Server does not accept AppendEntriesBatch")
+		}
+		return bh.HandleAppendEntriesBatch(req, rsp)
+	})
+}
+
+func (t *inmemTransport) InstallSnapshot(id uint64, address string, req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	return t.call(address, func(h RPCHandler) error {
+		return h.HandleInstallSnapshotRequest(req, rsp)
+	})
+}
+
+func (t *inmemTransport) TimeoutNow(id uint64, address string, req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	return t.call(address, func(h RPCHandler) error {
+		return h.HandleTimeoutNowRequest(req, rsp)
+	})
+}
+
+func (t *inmemTransport) ClosePeer(id uint64, address string) {}
+
+func (t *inmemTransport) Close() error {
+	n := t.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if e, ok := n.endpoints[t.address]; ok && t.address != "" {
+		close(e.done)
+		delete(n.endpoints, t.address)
+	}
+	return nil
+}
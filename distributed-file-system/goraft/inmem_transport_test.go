@@ -0,0 +1,147 @@
+package goraft
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startInmemCluster(t *testing.T, network *InmemNetwork, n int) ([]*Server, []*testStateMachine) {
+	var cluster []ClusterMember
+	for i := 0; i < n; i++ {
+		cluster = append(cluster, ClusterMember{
+			Id:      uint64(i + 1),
+			Address: fmt.Sprintf("node%d", i+1),
+		})
+	}
+
+	var servers []*Server
+	var sms []*testStateMachine
+	for i := 0; i < n; i++ {
+		sm := &testStateMachine{}
+		s, err := NewServer(cluster, sm, Config{MetadataDir: t.TempDir()}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Transport = network.NewTransport()
+		s.Start()
+		t.Cleanup(s.Shutdown)
+
+		servers = append(servers, s)
+		sms = append(sms, sm)
+	}
+	return servers, sms
+}
+
+func findLeader(t *testing.T, servers []*Server, except *Server) *Server {
+	var leader *Server
+	waitFor(t, "a leader", func() bool {
+		for _, s := range servers {
+			if s != except && s.IsLeader() {
+				leader = s
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func Test_inmem_cluster(t *testing.T) {
+	network := NewInmemNetwork()
+	servers, sms := startInmemCluster(t, network, 3)
+
+	leader := findLeader(t, servers, nil)
+	if _, err := leader.Apply([][]byte{[]byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, s := range servers {
+		sm := sms[i]
+		waitFor(t, fmt.Sprintf("node %d to apply", s.Id()), func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(sm.applied) == 1 && sm.applied[0] == "a"
+		})
+	}
+
+	// Cut off the leader; the other two elect a new one and keep
+	// accepting commands.
+	network.Isolate(leader.address)
+	newLeader := findLeader(t, servers, leader)
+	if _, err := newLeader.Apply([][]byte{[]byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader notices it lost its majority, then catches up
+	// once it can reach the others again.
+	waitFor(t, "old leader to step down", func() bool { return !leader.IsLeader() })
+	network.Rejoin(leader.address)
+
+	for i, s := range servers {
+		sm := sms[i]
+		waitFor(t, fmt.Sprintf("node %d to apply", s.Id()), func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(sm.applied) == 2 && sm.applied[1] == "b"
+		})
+	}
+}
+
+func Test_stop_restart(t *testing.T) {
+	network := NewInmemNetwork()
+	servers, sms := startInmemCluster(t, network, 3)
+
+	leader := findLeader(t, servers, nil)
+	if _, err := leader.Apply([][]byte{[]byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A command the leader can't commit is failed by Stop.
+	network.Isolate(leader.address)
+	pending := make(chan []ApplyResult)
+	go func() {
+		r, _ := leader.Apply([][]byte{[]byte("lost")})
+		pending <- r
+	}()
+	waitFor(t, "command to be appended", func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.lastLogIndex() == 3
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := leader.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-pending; r[0].Error != ErrStopped {
+		t.Errorf("Expected ErrStopped for the pending command, got %v", r[0].Error)
+	}
+	if n := leader.spawned.Load(); n != 0 {
+		t.Errorf("Expected no goroutines left after Stop, got %d", n)
+	}
+	if _, err := leader.Apply([][]byte{[]byte("b")}); err != ErrStopped {
+		t.Errorf("Expected ErrStopped from a stopped server, got %v", err)
+	}
+	network.Rejoin(leader.address)
+
+	newLeader := findLeader(t, servers, leader)
+	if _, err := newLeader.Apply([][]byte{[]byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Restarted on the same data, the old leader catches up without
+	// applying anything twice.
+	leader.Start()
+	for i, s := range servers {
+		sm := sms[i]
+		waitFor(t, fmt.Sprintf("node %d to apply", s.Id()), func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return strings.Join(sm.applied, ",") == "a,b"
+		})
+	}
+}
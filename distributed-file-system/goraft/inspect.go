@@ -0,0 +1,315 @@
+package goraft
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Reading and repairing a server's files while it is not running, for
+// cmd/goraft-inspect. Unlike restore, inspection never changes the
+// files and reports every problem it finds instead of panicking.
+
+type Inspection struct {
+	Metadata Metadata
+	// Nil if no snapshot has been written.
+	Snapshot *SnapshotInfo `json:",omitempty"`
+	// Every entry in the WAL, including any left over from before the
+	// snapshot.
+	Entries  []LogEntry
+	Problems []string
+}
+
+type SnapshotInfo struct {
+	Index   uint64
+	Term    uint64
+	Members []ClusterMember
+	// Size of the state machine's part of the snapshot in bytes.
+	Size int
+}
+
+type LogEntry struct {
+	Index uint64
+	Term  uint64
+	Kind  string
+	// For session commands, the command without its session header.
+	Command  []byte
+	ClientId uint64 `json:",omitempty"`
+	Sequence uint64 `json:",omitempty"`
+	// For configuration entries, the configuration they commit.
+	Members []ClusterMember `json:",omitempty"`
+}
+
+var ErrNoMetadata = errors.New("No metadata file")
+
+// Inspect reads the metadata file, WAL and snapshot of server id in
+// config.MetadataDir and checks that they fit together.
+func Inspect(config Config, id uint64) (*Inspection, error) {
+	config = config.withDefaults()
+	if config.MetadataFile == "" {
+		config.MetadataFile = metadataFileName(id)
+	}
+
+	md, err := readMetadataFile(path.Join(config.MetadataDir, config.MetadataFile))
+	if err != nil {
+		return nil, err
+	}
+
+	insn := &Inspection{Metadata: md}
+	problem := func(format string, args ...any) {
+		insn.Problems = append(insn.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if md.CommitIndex > md.LastLogIndex {
+		problem("Commit index %d is past the last log index %d", md.CommitIndex, md.LastLogIndex)
+	}
+	if md.SnapshotIndex > md.CommitIndex {
+		problem("Snapshot index %d is past the commit index %d", md.SnapshotIndex, md.CommitIndex)
+	}
+	if md.SnapshotTerm > md.Term {
+		problem("Snapshot term %d is past the current term %d", md.SnapshotTerm, md.Term)
+	}
+
+	// The snapshot is written before the header page, so it may be
+	// ahead of it, but never behind.
+	snapshotIndex, snapshotTerm := md.SnapshotIndex, md.SnapshotTerm
+	snap, ok, err := readSnapshotFile(path.Join(config.MetadataDir, snapshotFileName(id)))
+	if err != nil {
+		problem("Unreadable snapshot: %s", err)
+	} else if ok {
+		info := &SnapshotInfo{Index: snap.index, Term: snap.term, Size: len(snap.data)}
+		if err := json.Unmarshal(snap.configuration, &info.Members); err != nil {
+			problem("Bad configuration in snapshot: %s", err)
+		}
+		insn.Snapshot = info
+
+		if snap.index < md.SnapshotIndex {
+			problem("Snapshot index %d is behind the header's %d", snap.index, md.SnapshotIndex)
+		}
+		snapshotIndex, snapshotTerm = snap.index, snap.term
+	} else if md.SnapshotIndex > 0 {
+		problem("Header has snapshot index %d but there is no snapshot", md.SnapshotIndex)
+	}
+
+	records, walProblems, err := inspectWal(path.Join(config.MetadataDir, walDirName(id)))
+	if err != nil {
+		return nil, err
+	}
+	insn.Problems = append(insn.Problems, walProblems...)
+
+	var prev *walRecord
+	for i := range records {
+		r := &records[i]
+		insn.Entries = append(insn.Entries, inspectEntry(r, problem))
+
+		if r.entry.Term > md.Term {
+			problem("Entry %d has term %d, past the current term %d", r.index, r.entry.Term, md.Term)
+		}
+		if prev != nil && r.entry.Term < prev.entry.Term {
+			problem("Entry %d has term %d, lower than entry %d's term %d",
+				r.index, r.entry.Term, prev.index, prev.entry.Term)
+		}
+		if r.index == snapshotIndex && r.entry.Term != snapshotTerm {
+			problem("Entry %d has term %d but the snapshot ends with term %d; it is discarded on start",
+				r.index, r.entry.Term, snapshotTerm)
+		}
+		prev = r
+	}
+
+	lastIndex := snapshotIndex
+	if len(records) > 0 {
+		first, last := records[0].index, records[len(records)-1].index
+		if first > snapshotIndex+1 {
+			problem("Log is missing entries %d to %d after the snapshot", snapshotIndex+1, first-1)
+		}
+		lastIndex = max(lastIndex, last)
+	}
+	if lastIndex < md.LastLogIndex {
+		problem("Log ends at %d but the header says %d; entries were lost", lastIndex, md.LastLogIndex)
+	}
+	if lastIndex < md.CommitIndex {
+		problem("Log ends at %d, before the commit index %d", lastIndex, md.CommitIndex)
+	}
+
+	return insn, nil
+}
+
+func inspectEntry(r *walRecord, problem func(string, ...any)) LogEntry {
+	e := LogEntry{Index: r.index, Term: r.entry.Term, Kind: r.entry.Kind.String(), Command: r.entry.Command}
+
+	switch r.entry.Kind {
+	case ConfigurationEntry:
+		if err := json.Unmarshal(r.entry.Command, &e.Members); err != nil {
+			problem("Entry %d has a bad configuration: %s", r.index, err)
+		}
+	case RegisterClientEntry:
+		if len(r.entry.Command) != 8 {
+			problem("Entry %d is a client registration of %d bytes, expected 8", r.index, len(r.entry.Command))
+		}
+	case SessionCommandEntry:
+		if len(r.entry.Command) < SESSION_HEADER {
+			problem("Entry %d is a session command of only %d bytes", r.index, len(r.entry.Command))
+			break
+		}
+		e.ClientId = binary.LittleEndian.Uint64(r.entry.Command[:8])
+		e.Sequence = binary.LittleEndian.Uint64(r.entry.Command[8:16])
+		e.Command = r.entry.Command[SESSION_HEADER:]
+	case CommandEntry:
+	default:
+		problem("Entry %d has unknown kind %d", r.index, r.entry.Kind)
+	}
+	return e
+}
+
+func readMetadataFile(name string) (Metadata, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return Metadata{}, fmt.Errorf("%w: %s", ErrNoMetadata, name)
+	} else if err != nil {
+		return Metadata{}, err
+	}
+	defer f.Close()
+
+	var page [PAGE_SIZE]byte
+	if _, err := io.ReadFull(f, page[:]); err != nil {
+		return Metadata{}, fmt.Errorf("Reading header page of %s: %w", name, err)
+	}
+	return decodeMetadata(page), nil
+}
+
+// inspectWal reads every segment in dir like openWal, but leaves torn
+// records in place and carries on past corruption to report it all.
+func inspectWal(dir string) ([]walRecord, []string, error) {
+	var problems []string
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	var segments []walSegment
+	for _, de := range dirEntries {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), WAL_SEGMENT_EXT) {
+			continue
+		}
+
+		var firstIndex uint64
+		if _, err := fmt.Sscanf(de.Name(), "%d"+WAL_SEGMENT_EXT, &firstIndex); err != nil {
+			problem("Bad segment name %s", de.Name())
+			continue
+		}
+		segments = append(segments, walSegment{name: de.Name(), firstIndex: firstIndex})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstIndex < segments[j].firstIndex
+	})
+
+	var records []walRecord
+	for i, seg := range segments {
+		data, err := os.ReadFile(path.Join(dir, seg.name))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(records) > 0 && seg.firstIndex != records[len(records)-1].index+1 {
+			problem("Segment %s does not follow index %d", seg.name, records[len(records)-1].index)
+		}
+
+		offset := 0
+		for offset < len(data) {
+			rec, n, ok := decodeWalRecord(data[offset:])
+			if !ok {
+				if i == len(segments)-1 {
+					problem("Torn record at offset %d of segment %s; it is truncated away on start", offset, seg.name)
+				} else {
+					problem("Bad record at offset %d of segment %s", offset, seg.name)
+				}
+				break
+			}
+
+			if want := seg.firstIndex + uint64(len(seg.offsets)); rec.index != want {
+				problem("Segment %s has index %d at offset %d, expected %d", seg.name, rec.index, offset, want)
+			}
+			seg.offsets = append(seg.offsets, int64(offset))
+			records = append(records, rec)
+			offset += n
+		}
+	}
+
+	return records, problems, nil
+}
+
+// TruncateLog discards every entry after index from the log of server
+// id, which must not be running. Entries up to the snapshot can't be
+// discarded. Discarding committed entries can lose acknowledged writes
+// if this server was part of the majority that committed them, so the
+// commit index is only moved back when force is set.
+//
+// Which entries are committed is only known as of the last time the
+// server wrote its header or snapshot. A leader doesn't write its
+// header each time its commit index advances, so later entries may
+// have been committed too: the check without force is best-effort.
+func TruncateLog(config Config, id uint64, index uint64, force bool) error {
+	config = config.withDefaults()
+	if config.MetadataFile == "" {
+		config.MetadataFile = metadataFileName(id)
+	}
+	name := path.Join(config.MetadataDir, config.MetadataFile)
+
+	md, err := readMetadataFile(name)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot is written before the header page, so it may be
+	// ahead of it.
+	snapshotIndex := md.SnapshotIndex
+	snap, ok, err := readSnapshotFile(path.Join(config.MetadataDir, snapshotFileName(id)))
+	if err != nil {
+		return err
+	} else if ok {
+		snapshotIndex = max(snapshotIndex, snap.index)
+	}
+
+	if index < snapshotIndex {
+		return fmt.Errorf("Entries through %d are compacted into the snapshot", snapshotIndex)
+	}
+	if committed := max(md.CommitIndex, snapshotIndex); index < committed && !force {
+		return fmt.Errorf("Entries through %d are committed", committed)
+	}
+
+	w, _, err := openWal(path.Join(config.MetadataDir, walDirName(id)))
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	if err := w.truncateFrom(index + 1); err != nil {
+		return err
+	}
+
+	md.LastLogIndex = min(md.LastLogIndex, index)
+	md.CommitIndex = min(md.CommitIndex, index)
+	page := md.encode()
+
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.WriteAt(page[:], 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
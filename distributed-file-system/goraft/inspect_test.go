@@ -0,0 +1,88 @@
+package goraft
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_inspect_and_truncate(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestServer(t, dir, &testStateMachine{})
+
+	s.mu.Lock()
+	s.currentTerm = 2
+	s.log = append(s.log,
+		Entry{Term: 1, Command: []byte("a")},
+		Entry{Term: 2, Kind: ConfigurationEntry, Command: encodeConfiguration(s.cluster)},
+		Entry{Term: 2, Kind: SessionCommandEntry, Command: encodeSessionCommand(7, 3, s.now(), []byte("b"))},
+		Entry{Term: 2, Command: []byte("c")},
+	)
+	s.commitIndex = 2
+	s.persist(true, 4)
+	s.mu.Unlock()
+	s.Shutdown()
+
+	config := Config{MetadataDir: dir}
+	insn, err := Inspect(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insn.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", insn.Problems)
+	}
+	if insn.Metadata.Term != 2 || insn.Metadata.LastLogIndex != 4 || insn.Metadata.CommitIndex != 2 {
+		t.Errorf("Unexpected header %+v", insn.Metadata)
+	}
+	if len(insn.Entries) != 4 {
+		t.Fatalf("Expected 4 entries, got %d", len(insn.Entries))
+	}
+	if e := insn.Entries[1]; e.Kind != "configuration" || len(e.Members) != 1 {
+		t.Errorf("Expected the configuration entry to list one member, got %+v", e)
+	}
+	if e := insn.Entries[2]; e.ClientId != 7 || e.Sequence != 3 || string(e.Command) != "b" {
+		t.Errorf("Expected the session command unwrapped, got %+v", e)
+	}
+
+	if err := TruncateLog(config, 1, 1, false); err == nil {
+		t.Fatal("Expected truncating committed entries to need force")
+	}
+	// The snapshot is written before the header, so it can be ahead.
+	s.writeSnapshot(snapshot{index: 2, term: 2, configuration: encodeConfiguration(s.cluster)})
+	if err := TruncateLog(config, 1, 1, true); err == nil {
+		t.Fatal("Expected entries in the snapshot not to be truncated")
+	}
+	if err := TruncateLog(config, 1, 3, false); err != nil {
+		t.Fatal(err)
+	}
+	insn, err = Inspect(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insn.Entries) != 3 || insn.Metadata.LastLogIndex != 3 || len(insn.Problems) != 0 {
+		t.Errorf("Expected 3 entries after truncating, got %d (%v)", len(insn.Entries), insn.Problems)
+	}
+
+	// A flipped byte is reported rather than repaired.
+	segment := path.Join(dir, walDirName(1), segmentName(1))
+	data, err := os.ReadFile(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[WAL_RECORD_HEADER+WAL_ENTRY_HEADER] ^= 0xff
+	if err := os.WriteFile(segment, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	insn, err = Inspect(config, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insn.Problems) == 0 || !strings.Contains(insn.Problems[0], "Torn record at offset 0") {
+		t.Errorf("Expected the corrupt record reported, got %v", insn.Problems)
+	}
+	if after, _ := os.ReadFile(segment); len(after) != len(data) {
+		t.Error("Expected Inspect to leave the WAL untouched")
+	}
+}
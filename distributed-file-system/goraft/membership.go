@@ -0,0 +1,245 @@
+package goraft
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// Membership changes add or remove one server at a time, so any
+// majority of the old configuration overlaps any majority of the new
+// one. A configuration takes effect once its entry is committed and
+// applied, and the next change is refused until then.
+
+var ErrConfigChangeInProgress = errors.New("A configuration change is already in progress")
+var ErrMemberExists = errors.New("Server is already a cluster member")
+var ErrUnknownMember = errors.New("Server is not a cluster member")
+var ErrNotVoter = errors.New("Server is not a voting member")
+var ErrNotLearner = errors.New("Server is not a learner")
+var ErrLearnerBehind = errors.New("Learner has not caught up with the leader's log")
+
+// A new server can join as a learner: it receives the log but doesn't
+// vote or count towards a quorum, so it can't hold up commits while
+// it copies the log. Once it has caught up it is promoted to voter.
+type MemberRole string
+
+const (
+	Voter   MemberRole = "voter"
+	Learner MemberRole = "learner"
+)
+
+// A learner may be promoted once it is at most this many entries
+// behind the leader.
+const PROMOTE_MAX_LAG = 100
+
+// voter reports whether the member votes. Configurations written
+// before roles existed leave Role empty; those members are voters.
+func (c ClusterMember) voter() bool {
+	return c.Role != Learner
+}
+
+// voter reports whether this server is a voting member.
+func (s *Server) voter() bool {
+	return s.clusterIndex >= 0 && s.cluster[s.clusterIndex].voter()
+}
+
+func encodeConfiguration(cluster []ClusterMember) []byte {
+	// Only the exported fields (Id, Address, Role, Priority) are
+	// encoded.
+	b, err := json.Marshal(cluster)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func decodeConfiguration(b []byte) []ClusterMember {
+	var cluster []ClusterMember
+	if err := json.Unmarshal(b, &cluster); err != nil {
+		panic(err)
+	}
+	return cluster
+}
+
+func (s *Server) memberIndex(id uint64) int {
+	for i := range s.cluster {
+		if s.cluster[i].Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// setConfiguration switches to the configuration committed at index,
+// keeping replication state for servers that remain members.
+func (s *Server) setConfiguration(index uint64, members []ClusterMember) {
+	old := s.cluster
+
+	var cluster []ClusterMember
+	for _, m := range members {
+		c := ClusterMember{
+			Id:        m.Id,
+			Address:   m.Address,
+			nextIndex: s.lastLogIndex() + 1,
+		}
+
+		for _, o := range old {
+			if o.Id == m.Id && o.Address == m.Address {
+				c = o
+			}
+		}
+		c.Role = m.Role
+		c.Priority = m.Priority
+
+		cluster = append(cluster, c)
+	}
+
+	for _, o := range old {
+		stillMember := false
+		for _, c := range cluster {
+			stillMember = stillMember || (c.Id == o.Id && c.Address == o.Address)
+		}
+
+		if !stillMember && o.Id != s.id {
+			s.Transport.ClosePeer(o.Id, o.Address)
+		}
+	}
+
+	s.cluster = cluster
+	s.configIndex = index
+	s.clusterIndex = s.memberIndex(s.id)
+	if s.clusterIndex >= 0 {
+		s.cluster[s.clusterIndex].votedFor = s.votedFor
+	}
+
+	s.debugf("Configuration at index %d: %d members", index, len(cluster))
+
+	if !s.voter() && s.state == leaderState {
+		s.debug("No longer a voter, stepping down")
+		s.stepDown()
+		s.resetElectionTimeout()
+	}
+}
+
+// Members returns the committed cluster configuration.
+func (s *Server) Members() []ClusterMember {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var members []ClusterMember
+	for _, c := range s.cluster {
+		members = append(members, ClusterMember{Id: c.Id, Address: c.Address, Role: c.Role, Priority: c.Priority})
+	}
+	return members
+}
+
+// AddMember adds a server to the cluster as a voter with the given
+// priority and returns once the new configuration is committed.
+func (s *Server) AddMember(id uint64, address string, priority int) error {
+	return s.addMember(ClusterMember{Id: id, Address: address, Role: Voter, Priority: priority})
+}
+
+// AddLearner adds a server to the cluster as a learner with the given
+// priority, which takes effect once it is promoted, and returns once
+// the new configuration is committed.
+func (s *Server) AddLearner(id uint64, address string, priority int) error {
+	return s.addMember(ClusterMember{Id: id, Address: address, Role: Learner, Priority: priority})
+}
+
+func (s *Server) addMember(member ClusterMember) error {
+	if member.Id == 0 {
+		panic("Id must not be 0.")
+	}
+
+	return s.changeConfiguration(func(cluster []ClusterMember) ([]ClusterMember, error) {
+		for _, c := range cluster {
+			if c.Id == member.Id {
+				return nil, ErrMemberExists
+			}
+		}
+
+		return append(cluster, member), nil
+	})
+}
+
+// PromoteLearner makes a learner a voter and returns once the new
+// configuration is committed. It fails with ErrLearnerBehind unless
+// the learner's log is within PROMOTE_MAX_LAG entries of the leader's.
+func (s *Server) PromoteLearner(id uint64) error {
+	return s.changeConfiguration(func(cluster []ClusterMember) ([]ClusterMember, error) {
+		i := s.memberIndex(id)
+		if i < 0 {
+			return nil, ErrUnknownMember
+		}
+		if s.cluster[i].voter() {
+			return nil, ErrNotLearner
+		}
+		if s.cluster[i].matchIndex+PROMOTE_MAX_LAG < s.lastLogIndex() {
+			return nil, ErrLearnerBehind
+		}
+
+		cluster[i].Role = Voter
+		return cluster, nil
+	})
+}
+
+// RemoveMember removes a server from the cluster and returns once
+// the new configuration is committed. A leader that removes itself
+// steps down at that point.
+func (s *Server) RemoveMember(id uint64) error {
+	return s.changeConfiguration(func(cluster []ClusterMember) ([]ClusterMember, error) {
+		for i, c := range cluster {
+			if c.Id == id {
+				return append(cluster[:i:i], cluster[i+1:]...), nil
+			}
+		}
+
+		return nil, ErrUnknownMember
+	})
+}
+
+func (s *Server) changeConfiguration(change func([]ClusterMember) ([]ClusterMember, error)) error {
+	s.mu.Lock()
+
+	if s.state != leaderState {
+		s.mu.Unlock()
+		return ErrApplyToLeader
+	}
+
+	if s.transferee != 0 {
+		s.mu.Unlock()
+		return ErrLeadershipTransferInProgress
+	}
+
+	for i := s.lastApplied + 1; i <= s.lastLogIndex(); i++ {
+		if s.log[s.entryIndex(i)].Kind == ConfigurationEntry {
+			s.mu.Unlock()
+			return ErrConfigChangeInProgress
+		}
+	}
+
+	var current []ClusterMember
+	for _, c := range s.cluster {
+		current = append(current, ClusterMember{Id: c.Id, Address: c.Address, Role: c.Role, Priority: c.Priority})
+	}
+
+	members, err := change(current)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+
+	result := make(chan ApplyResult, 1)
+	s.log = append(s.log, Entry{
+		Term:    s.currentTerm,
+		Kind:    ConfigurationEntry,
+		Command: encodeConfiguration(members),
+		result:  result,
+	})
+	s.debugf("Proposing configuration with %d members", len(members))
+
+	s.persist(true, 1)
+	s.appendEntries()
+	s.mu.Unlock()
+
+	return (<-result).Error
+}
@@ -0,0 +1,61 @@
+package goraft
+
+// Members can be given an election priority so that leadership
+// settles on the ones best suited to it. A voter waits one extra
+// election timeout spread for every distinct priority above its own
+// among the voters, so the preferred members normally time out, and
+// win, first. A leader that finds a higher-priority voter caught up
+// with its log, say after that member restarts, hands leadership to
+// it.
+
+// outranked returns how many distinct priorities among the voters
+// are higher than this server's.
+func (s *Server) outranked() int {
+	if s.clusterIndex < 0 {
+		return 0
+	}
+
+	own := s.cluster[s.clusterIndex].Priority
+	higher := map[int]bool{}
+	for _, m := range s.cluster {
+		if m.voter() && m.Priority > own {
+			higher[m.Priority] = true
+		}
+	}
+	return len(higher)
+}
+
+// preferLeader starts a leadership transfer to the highest-priority
+// voter that outranks this leader and has caught up with its log. A
+// failed transfer is retried once LEADERSHIP_TRANSFER_TIMEOUT has
+// passed.
+func (s *Server) preferLeader() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != leaderState || s.transferee != 0 || s.clusterIndex < 0 || s.now().Before(s.priorityTransferAt) {
+		return
+	}
+
+	target := -1
+	best := s.cluster[s.clusterIndex].Priority
+	for i, m := range s.cluster {
+		if i == s.clusterIndex || !m.voter() || m.unreachable || m.matchIndex != s.lastLogIndex() {
+			continue
+		}
+		if m.Priority > best {
+			target = i
+			best = m.Priority
+		}
+	}
+	if target < 0 {
+		return
+	}
+
+	id := s.cluster[target].Id
+	s.debugf("Node %d has priority %d; handing it leadership", id, best)
+	s.priorityTransferAt = s.now().Add(LEADERSHIP_TRANSFER_TIMEOUT)
+	// TransferLeadership warns if the target doesn't take over in
+	// time; either way the next attempt waits for priorityTransferAt.
+	s.spawn(func() { s.TransferLeadership(id) })
+}
@@ -0,0 +1,119 @@
+package goraft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_election_backoff(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	s.cluster = []ClusterMember{
+		{Id: 1, Address: "a", Priority: 1},
+		{Id: 2, Address: "b", Priority: 5},
+		{Id: 3, Address: "c", Priority: 5},
+		{Id: 4, Address: "d", Priority: 9, Role: Learner},
+		{Id: 5, Address: "e", Priority: 7},
+	}
+	if n := s.outranked(); n != 2 {
+		t.Fatalf("Expected two higher voting priorities, got %d", n)
+	}
+
+	// Outranked twice, the timeout falls past two spreads beyond the
+	// usual range.
+	spread := s.config.ElectionTimeoutMax - s.config.ElectionTimeoutMin
+	for i := 0; i < 20; i++ {
+		s.resetElectionTimeout()
+		interval := s.electionTimeout.Sub(now)
+		if interval < s.config.ElectionTimeoutMin+2*spread || interval > s.config.ElectionTimeoutMax+2*spread {
+			t.Fatalf("Election timeout %s outside the backed-off range", interval)
+		}
+	}
+}
+
+func Test_preferred_leader(t *testing.T) {
+	network := NewInmemNetwork()
+
+	var cluster []ClusterMember
+	for i := 0; i < 3; i++ {
+		cluster = append(cluster, ClusterMember{Id: uint64(i + 1), Address: fmt.Sprintf("node%d", i+1)})
+	}
+	cluster[2].Priority = 10
+
+	var servers []*Server
+	for i := range cluster {
+		s, err := NewServer(cluster, &testStateMachine{}, Config{MetadataDir: t.TempDir()}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Transport = network.NewTransport()
+		s.Start()
+		t.Cleanup(s.Shutdown)
+		servers = append(servers, s)
+	}
+	preferred := servers[2]
+
+	waitFor(t, "the preferred member to lead", preferred.IsLeader)
+
+	// Without it another member takes over, then hands leadership
+	// back once it has caught up again.
+	network.Isolate(preferred.address)
+	other := findLeader(t, servers, preferred)
+	if _, err := other.Apply([][]byte{[]byte("a")}); err != nil {
+		t.Fatal(err)
+	}
+	network.Rejoin(preferred.address)
+
+	deadline := time.Now().Add(2 * LEADERSHIP_TRANSFER_TIMEOUT)
+	for !preferred.IsLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected leadership to return to the preferred member")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_priority_replicated(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	s.state = leaderState
+	s.currentTerm = 1
+	s.cluster[0].Priority = 3
+	s.mu.Unlock()
+
+	done := make(chan error)
+	go func() { done <- s.AddMember(2, ":3031", 5) }()
+	waitFor(t, "configuration entry", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.lastLogIndex() == 1
+	})
+	s.advanceCommitIndex()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	members := s.Members()
+	if len(members) != 2 || members[0].Priority != 3 || members[1].Priority != 5 {
+		t.Fatalf("Expected priorities 3 and 5, got %v", members)
+	}
+
+	// A server applying the entry takes the priorities from it, also
+	// for members it already had.
+	s.mu.Lock()
+	entry := s.log[s.entryIndex(1)]
+	s.mu.Unlock()
+
+	other := newTestServer(t, t.TempDir(), &testStateMachine{})
+	other.mu.Lock()
+	other.setConfiguration(1, decodeConfiguration(entry.Command))
+	other.mu.Unlock()
+	if got := other.Members(); len(got) != 2 || got[0].Priority != 3 || got[1].Priority != 5 {
+		t.Fatalf("Expected priorities 3 and 5 from the entry, got %v", got)
+	}
+}
@@ -1,18 +1,16 @@
 package goraft
 
 import (
-	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math/rand"
-	"net"
-	"net/http"
-	"net/rpc"
 	"os"
 	"path"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,6 +22,15 @@ func Assert[T comparable](msg string, a, b T) {
 
 type StateMachine interface {
 	Apply(cmd []byte) ([]byte, error)
+
+	// Snapshot returns a serialized copy of the state machine
+	// reflecting every command applied so far. It is called with the
+	// server lock held, so no Apply runs concurrently.
+	Snapshot() ([]byte, error)
+
+	// Restore replaces the entire contents of the state machine with
+	// a snapshot previously produced by Snapshot.
+	Restore(snapshot []byte) error
 }
 
 type ApplyResult struct {
@@ -31,14 +38,44 @@ type ApplyResult struct {
 	Error  error
 }
 
+type EntryKind uint8
+
+const (
+	CommandEntry EntryKind = iota
+	// The entry's Command holds an encoded cluster configuration.
+	ConfigurationEntry
+	// The entry opens a client session; see session.go.
+	RegisterClientEntry
+	// The entry's Command is a command tagged with its client session.
+	SessionCommandEntry
+)
+
+func (k EntryKind) String() string {
+	switch k {
+	case CommandEntry:
+		return "command"
+	case ConfigurationEntry:
+		return "configuration"
+	case RegisterClientEntry:
+		return "register-client"
+	case SessionCommandEntry:
+		return "session-command"
+	}
+	return fmt.Sprintf("EntryKind(%d)", uint8(k))
+}
+
 type Entry struct {
 	Command []byte
 	Term    uint64
+	Kind    EntryKind
 	result  chan ApplyResult
 }
 
 type RPCMessage struct {
 	Term uint64
+	// The Raft group the message belongs to when servers are run by a
+	// Host; see host.go. Zero otherwise.
+	GroupId uint64
 }
 
 type RequestVoteRequest struct {
@@ -46,6 +83,10 @@ type RequestVoteRequest struct {
 	CandidateId  uint64
 	LastLogIndex uint64
 	LastLogTerm  uint64
+
+	// A pre-vote asks whether the candidate could win an election at
+	// Term without anyone, including the candidate, changing term.
+	PreVote bool
 }
 
 type RequestVoteResponse struct {
@@ -65,58 +106,147 @@ type AppendEntriesRequest struct {
 type AppendEntriesResponse struct {
 	RPCMessage
 	Success bool
+
+	// On rejection, where the follower's log stops agreeing with
+	// PrevLogIndex: the term of its entry there and the first index
+	// holding that term, or, if its log is too short, ConflictTerm 0
+	// and the index just past its last entry.
+	ConflictTerm  uint64
+	ConflictIndex uint64
 }
 
 type ClusterMember struct {
-	Id         uint64
-	Address    string
+	Id      uint64
+	Address string
+	Role    MemberRole `json:",omitempty"`
+	// Voters with a higher Priority are preferred as leader; see
+	// priority.go. Defaults to 0.
+	Priority int `json:",omitempty"`
+
 	nextIndex  uint64
 	matchIndex uint64
 	votedFor   uint64
-	rpcClient  *rpc.Client
+
+	// Set while an InstallSnapshot RPC to this member is in flight
+	// so heartbeats don't pile up additional copies.
+	installingSnapshot bool
+
+	preVoteGranted bool
+	// When the leader sent the latest request this member has
+	// answered in the current term.
+	lastContact time.Time
+
+	// AppendEntries requests sent but not yet answered. Until a
+	// request succeeds, only one is sent at a time while nextIndex is
+	// worked back to where the logs agree. Once replicating, nextIndex
+	// moves past entries as soon as they are sent, so up to
+	// Config.MaxInflightAppendEntries batches can be on the wire at once.
+	inflight    int
+	replicating bool
+
+	// Set when the last RPC to this member failed.
+	unreachable bool
 }
 
 type ServerState string
 
 const (
-	leaderState    ServerState = "leader"
-	followerState              = "follower"
-	candidateState             = "candidate"
+	leaderState       ServerState = "leader"
+	followerState                 = "follower"
+	preCandidateState             = "pre-candidate"
+	candidateState                = "candidate"
 )
 
 type Server struct {
 	done   bool
-	server *http.Server
-	Debug  bool
+	config Config
+
+	// How this server talks to its peers. Defaults to net/rpc over
+	// HTTP, over mutual TLS if the Config names certificates; may be
+	// replaced before Start.
+	Transport Transport
+
+	// Set before Start on a server being added to an existing
+	// cluster. It then ignores its bootstrap configuration and waits
+	// to learn the cluster's configuration from the leader.
+	Joining bool
+
+	// Set on servers run by a Host, which ticks them itself and lines
+	// up their heartbeats.
+	hosted bool
+
+	// Commands waiting for the next batch. flushing is set while a
+	// goroutine is appending batches to the log.
+	batchMu   sync.Mutex
+	batch     []proposal
+	flushing  bool
+	batchFull chan struct{}
 
 	mu          sync.Mutex
 	currentTerm uint64
-	log         []Entry
+
+	// log[0] is a sentinel standing in for the last entry covered by
+	// the most recent snapshot (index snapshotIndex, term
+	// snapshotTerm). Use entryIndex/lastLogIndex/termAt rather than
+	// indexing log directly with a log index.
+	log           []Entry
+	snapshotIndex uint64
+	snapshotTerm  uint64
 
 	id               uint64
 	address          string
 	electionTimeout  time.Time
-	heartbeatMs      int
+	leaderContact    time.Time
 	heartbeatTimeout time.Time
-	statemachine     StateMachine
-	metadataDir      string
+	statemachine     *sessionStateMachine
 	fd               *os.File
+	wal              *wal
+
+	commitIndex uint64
+	lastApplied uint64
+	state       ServerState
+	votedFor    uint64
 
-	commitIndex  uint64
-	lastApplied  uint64
-	state        ServerState
+	// The committed configuration. clusterIndex is this server's
+	// position in cluster, or -1 if it is not a member.
 	cluster      []ClusterMember
 	clusterIndex int
+	configIndex  uint64
+
+	// While leadership is being handed to this member, new commands
+	// are refused.
+	transferee uint64
+	// When the leader may next hand over to a higher-priority member.
+	priorityTransferAt time.Time
+
+	leaderSince time.Time
+	// The leader of currentTerm, or 0 while it isn't known.
+	leaderId uint64
+
+	observers    map[int]chan<- Event
+	nextObserver int
+
+	// Where the server gets the time, randomness and new goroutines
+	// from, and how it waits. Replaced in tests to make runs
+	// reproducible.
+	now   func() time.Time
+	sleep func(time.Duration)
+	rand  *rand.Rand
+	spawn func(func())
+
+	// Goroutines started by the default spawn that haven't returned,
+	// so Stop can wait for them.
+	spawned atomic.Int64
 }
 
-func min[T ~int | ~uint64](a, b T) T {
+func min[T ~int | ~int64 | ~uint64](a, b T) T {
 	if a < b {
 		return a
 	}
 	return b
 }
 
-func max[T ~int | ~uint64](a, b T) T {
+func max[T ~int | ~int64 | ~uint64](a, b T) T {
 	if a > b {
 		return a
 	}
@@ -129,33 +259,43 @@ func (s *Server) debugmsg(msg string) string {
 }
 
 func (s *Server) debug(msg string) {
-	if !s.Debug {
+	if !s.config.Debug {
 		return
 	}
-	fmt.Println(s.debugmsg(msg))
+	fmt.Fprintln(s.config.LogOutput, s.debugmsg(msg))
 }
 
 func (s *Server) debugf(msg string, args ...any) {
-	if !s.Debug {
+	if !s.config.Debug {
 		return
 	}
 	s.debug(fmt.Sprintf(msg, args...))
 }
 
 func (s *Server) warn(msg string) {
-	fmt.Println("[WARN] " + s.debugmsg(msg))
+	fmt.Fprintln(s.config.LogOutput, "[WARN] "+s.debugmsg(msg))
 }
 
 func Server_assert[T comparable](s *Server, msg string, a, b T) {
-	Assert(s.debugmsg(msg), a, b)
+	// Only build the message on failure; this is called on hot paths.
+	if a != b {
+		Assert(s.debugmsg(msg), a, b)
+	}
 }
 
+// NewServer returns a server for member clusterIndex of
+// clusterConfig. It returns ErrInvalidConfig if config can't work.
 func NewServer(
 	clusterConfig []ClusterMember,
 	statemachine StateMachine,
-	metadataDir string,
+	config Config,
 	clusterIndex int,
-) *Server {
+) (*Server, error) {
+	config = config.withDefaults()
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	var cluster []ClusterMember
 	for _, c := range clusterConfig {
 		if c.Id == 0 {
@@ -164,34 +304,132 @@ func NewServer(
 		cluster = append(cluster, c)
 	}
 
-	return &Server{
+	var sm *sessionStateMachine
+	if statemachine != nil {
+		sm = newSessionStateMachine(statemachine)
+	}
+
+	if config.MetadataFile == "" {
+		config.MetadataFile = metadataFileName(cluster[clusterIndex].Id)
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		config:       config,
 		id:           cluster[clusterIndex].Id,
 		address:      cluster[clusterIndex].Address,
 		cluster:      cluster,
-		statemachine: statemachine,
-		metadataDir:  metadataDir,
+		statemachine: sm,
 		clusterIndex: clusterIndex,
-		heartbeatMs:  150, // Reduced from 300ms for faster elections
 		mu:           sync.Mutex{},
-		Debug:        false, // Will be enabled in main.go
+		Transport:    transport,
+		batchFull:    make(chan struct{}, 1),
+		now:          time.Now,
+		sleep:        time.Sleep,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	s.spawn = func(f func()) {
+		s.spawned.Add(1)
+		go func() {
+			defer s.spawned.Add(-1)
+			f()
+		}()
 	}
+	return s, nil
 }
 
 const PAGE_SIZE = 4096
-const ENTRY_HEADER = 16
-const ENTRY_SIZE = 128
 
+func metadataFileName(id uint64) string {
+	return fmt.Sprintf("md_%d.dat", id)
+}
+
+// Metadata is the header page at the start of the metadata file,
+// rewritten by every persist.
+type Metadata struct {
+	Term     uint64
+	VotedFor uint64
+	// Last index in the log when the page was written. The WAL is
+	// written first, so it may be further ahead.
+	LastLogIndex  uint64
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+	CommitIndex   uint64
+}
+
+func (md Metadata) encode() [PAGE_SIZE]byte {
+	var page [PAGE_SIZE]byte
+	binary.LittleEndian.PutUint64(page[:8], md.Term)
+	binary.LittleEndian.PutUint64(page[8:16], md.VotedFor)
+	binary.LittleEndian.PutUint64(page[16:24], md.LastLogIndex)
+	binary.LittleEndian.PutUint64(page[24:32], md.SnapshotIndex)
+	binary.LittleEndian.PutUint64(page[32:40], md.SnapshotTerm)
+	binary.LittleEndian.PutUint64(page[40:48], md.CommitIndex)
+	return page
+}
+
+func decodeMetadata(page [PAGE_SIZE]byte) Metadata {
+	return Metadata{
+		Term:          binary.LittleEndian.Uint64(page[:8]),
+		VotedFor:      binary.LittleEndian.Uint64(page[8:16]),
+		LastLogIndex:  binary.LittleEndian.Uint64(page[16:24]),
+		SnapshotIndex: binary.LittleEndian.Uint64(page[24:32]),
+		SnapshotTerm:  binary.LittleEndian.Uint64(page[32:40]),
+		CommitIndex:   binary.LittleEndian.Uint64(page[40:48]),
+	}
+}
+
+// lastLogIndex returns the index of the last entry in the log,
+// including entries that have been compacted into a snapshot.
+func (s *Server) lastLogIndex() uint64 {
+	return s.snapshotIndex + uint64(len(s.log)-1)
+}
+
+// entryIndex converts a log index into a position in s.log. The
+// index must not be below snapshotIndex.
+func (s *Server) entryIndex(index uint64) int {
+	Server_assert(s, "Index not compacted", index >= s.snapshotIndex, true)
+	return int(index - s.snapshotIndex)
+}
+
+func (s *Server) termAt(index uint64) uint64 {
+	return s.log[s.entryIndex(index)].Term
+}
+
+// persist writes the last nNewEntries log entries to the WAL, if
+// writeLog is set, followed by the header page holding the current
+// term, vote and snapshot position.
 func (s *Server) persist(writeLog bool, nNewEntries int) {
 	if nNewEntries == 0 && writeLog {
 		nNewEntries = len(s.log)
 	}
 
+	if writeLog && nNewEntries > 0 {
+		newLogOffset := max(len(s.log)-nNewEntries, 0)
+		firstIndex := s.snapshotIndex + uint64(newLogOffset)
+
+		if err := s.wal.append(firstIndex, s.log[newLogOffset:]); err != nil {
+			panic(err)
+		}
+		if err := s.wal.sync(); err != nil {
+			panic(err)
+		}
+	}
+
 	s.fd.Seek(0, 0)
 
-	var page [PAGE_SIZE]byte
-	binary.LittleEndian.PutUint64(page[:8], s.currentTerm)
-	binary.LittleEndian.PutUint64(page[8:16], s.getVotedFor())
-	binary.LittleEndian.PutUint64(page[16:24], uint64(len(s.log)))
+	page := Metadata{
+		Term:          s.currentTerm,
+		VotedFor:      s.getVotedFor(),
+		LastLogIndex:  s.lastLogIndex(),
+		SnapshotIndex: s.snapshotIndex,
+		SnapshotTerm:  s.snapshotTerm,
+		CommitIndex:   s.commitIndex,
+	}.encode()
 
 	n, err := s.fd.Write(page[:])
 	if err != nil {
@@ -199,38 +437,11 @@ func (s *Server) persist(writeLog bool, nNewEntries int) {
 	}
 	Server_assert(s, "Wrote full page", n, PAGE_SIZE)
 
-	if writeLog && nNewEntries > 0 {
-		newLogOffset := max(len(s.log)-nNewEntries, 0)
-		s.fd.Seek(int64(PAGE_SIZE+ENTRY_SIZE*newLogOffset), 0)
-		bw := bufio.NewWriter(s.fd)
-
-		var entryBytes [ENTRY_SIZE]byte
-		for i := newLogOffset; i < len(s.log); i++ {
-			if len(s.log[i].Command) > ENTRY_SIZE-ENTRY_HEADER {
-				panic(fmt.Sprintf("Command too large (%d). Max: %d bytes.",
-					len(s.log[i].Command), ENTRY_SIZE-ENTRY_HEADER))
-			}
-
-			binary.LittleEndian.PutUint64(entryBytes[:8], s.log[i].Term)
-			binary.LittleEndian.PutUint64(entryBytes[8:16], uint64(len(s.log[i].Command)))
-			copy(entryBytes[16:], s.log[i].Command)
-
-			n, err := bw.Write(entryBytes[:])
-			if err != nil {
-				panic(err)
-			}
-			Server_assert(s, "Wrote full entry", n, ENTRY_SIZE)
-		}
-
-		err = bw.Flush()
-		if err != nil {
+	if s.config.Fsync == FsyncAlways {
+		if err := s.fd.Sync(); err != nil {
 			panic(err)
 		}
 	}
-
-	if err := s.fd.Sync(); err != nil {
-		panic(err)
-	}
 	s.debugf("Persisted: Term=%d, LogLen=%d (%d new), VotedFor=%d",
 		s.currentTerm, len(s.log), nNewEntries, s.getVotedFor())
 }
@@ -242,15 +453,28 @@ func (s *Server) ensureLog() {
 }
 
 func (s *Server) setVotedFor(id uint64) {
-	s.cluster[s.clusterIndex].votedFor = id
+	s.votedFor = id
+	if s.clusterIndex >= 0 {
+		s.cluster[s.clusterIndex].votedFor = id
+	}
 }
 
 func (s *Server) getVotedFor() uint64 {
-	return s.cluster[s.clusterIndex].votedFor
+	return s.votedFor
 }
 
 func (s *Server) Metadata() string {
-	return fmt.Sprintf("md_%d.dat", s.id)
+	return s.config.MetadataFile
+}
+
+// WalDir is the directory, relative to the metadata directory, that
+// holds the log segments.
+func (s *Server) WalDir() string {
+	return walDirName(s.id)
+}
+
+func walDirName(id uint64) string {
+	return fmt.Sprintf("wal_%d", id)
 }
 
 func (s *Server) restore() {
@@ -259,77 +483,141 @@ func (s *Server) restore() {
 
 	if s.fd == nil {
 		var err error
-		s.fd, err = os.OpenFile(
-			path.Join(s.metadataDir, s.Metadata()),
-			os.O_SYNC|os.O_CREATE|os.O_RDWR,
-			0755)
+		flags := os.O_CREATE | os.O_RDWR
+		if s.config.Fsync == FsyncAlways {
+			flags |= os.O_SYNC
+		}
+		s.fd, err = os.OpenFile(path.Join(s.config.MetadataDir, s.Metadata()), flags, 0755)
 		if err != nil {
 			panic(err)
 		}
 	}
 
+	if s.wal != nil {
+		s.wal.close()
+	}
+
+	var records []walRecord
+	var err error
+	s.wal, records, err = openWal(path.Join(s.config.MetadataDir, s.WalDir()))
+	if err != nil {
+		panic(err)
+	}
+	s.wal.segmentSize = s.config.WALSegmentSize
+	s.wal.noSync = s.config.Fsync == FsyncNever
+
+	// A server restarted in the same process keeps its state machine
+	// and configuration as of lastApplied.
+	restarted := s.lastApplied > 0
+
+	if s.Joining && !restarted {
+		s.setConfiguration(0, nil)
+	}
+
 	s.fd.Seek(0, 0)
 
 	var page [PAGE_SIZE]byte
 	n, err := s.fd.Read(page[:])
 	if err == io.EOF {
 		s.ensureLog()
+		s.resume(snapshot{}, false)
 		return
 	} else if err != nil {
 		panic(err)
 	}
 	Server_assert(s, "Read full page", n, PAGE_SIZE)
 
-	s.currentTerm = binary.LittleEndian.Uint64(page[:8])
-	s.setVotedFor(binary.LittleEndian.Uint64(page[8:16]))
-	lenLog := binary.LittleEndian.Uint64(page[16:24])
+	md := decodeMetadata(page)
+	s.currentTerm = md.Term
+	s.setVotedFor(md.VotedFor)
+	s.snapshotIndex = md.SnapshotIndex
+	s.snapshotTerm = md.SnapshotTerm
+	commitIndex := md.CommitIndex
 	s.log = nil
 
-	if lenLog > 0 {
-		s.fd.Seek(int64(PAGE_SIZE), 0)
+	// The snapshot file is written before the header page, so it may
+	// be ahead of it.
+	snap, haveSnapshot := s.readSnapshot()
+	if haveSnapshot {
+		Server_assert(s, "Snapshot not behind header", snap.index >= s.snapshotIndex, true)
+		s.snapshotIndex = snap.index
+		s.snapshotTerm = snap.term
+	}
+
+	// The WAL may still hold entries from before the last compaction.
+	for _, r := range records {
+		if r.index < s.snapshotIndex {
+			continue
+		}
 
-		for i := 0; uint64(i) < lenLog; i++ {
-			var entryBytes [ENTRY_SIZE]byte
-			n, err := s.fd.Read(entryBytes[:])
-			if err != nil {
+		if haveSnapshot && r.index == s.snapshotIndex && r.entry.Term != s.snapshotTerm {
+			// Left over from a log the snapshot replaced.
+			if err := s.wal.truncateFrom(s.snapshotIndex); err != nil {
 				panic(err)
 			}
-			Server_assert(s, "Read full entry", n, ENTRY_SIZE)
+			break
+		}
 
-			e := Entry{
-				Term: binary.LittleEndian.Uint64(entryBytes[:8]),
-			}
-			lenValue := binary.LittleEndian.Uint64(entryBytes[8:16])
-			e.Command = make([]byte, lenValue)
-			copy(e.Command, entryBytes[16:16+lenValue])
-			s.log = append(s.log, e)
+		if len(s.log) == 0 && r.index != s.snapshotIndex {
+			s.log = append(s.log, Entry{Term: s.snapshotTerm})
 		}
+		Server_assert(s, "WAL entries are contiguous", r.index, s.snapshotIndex+uint64(len(s.log)))
+		s.log = append(s.log, r.entry)
 	}
 
 	s.ensureLog()
-	s.debugf("Restored: Term=%d, LogLen=%d, VotedFor=%d",
-		s.currentTerm, len(s.log), s.getVotedFor())
+
+	if haveSnapshot {
+		s.log[0].Term = s.snapshotTerm
+	}
+
+	// Committed entries, including configuration changes, are
+	// re-applied from the log by advanceCommitIndex. After a restart
+	// the state machine already holds everything up to lastApplied,
+	// so only later entries are. So does a durable state machine
+	// after the process restarts.
+	s.commitIndex = min(commitIndex, s.lastLogIndex())
+	if restarted && s.lastApplied >= s.snapshotIndex && s.lastApplied <= s.lastLogIndex() {
+		s.commitIndex = max(s.commitIndex, s.lastApplied)
+	} else {
+		s.lastApplied = 0
+		if !s.resume(snap, haveSnapshot) && haveSnapshot {
+			s.restoreSnapshot(snap)
+		}
+	}
+
+	s.debugf("Restored: Term=%d, LogLen=%d, VotedFor=%d, SnapshotIndex=%d",
+		s.currentTerm, len(s.log), s.getVotedFor(), s.snapshotIndex)
 }
 
-func (s *Server) requestVote() {
+func (s *Server) requestVote(preVote bool) {
 	for i := range s.cluster {
-		if i == s.clusterIndex {
+		if i == s.clusterIndex || !s.cluster[i].voter() {
 			continue
 		}
 
-		go func(i int) {
+		id := s.cluster[i].Id
+		s.spawn(func() {
 			s.mu.Lock()
 			req := RequestVoteRequest{
 				RPCMessage:   RPCMessage{Term: s.currentTerm},
 				CandidateId:  s.id,
-				LastLogIndex: uint64(len(s.log) - 1),
+				LastLogIndex: s.lastLogIndex(),
 				LastLogTerm:  s.log[len(s.log)-1].Term,
+				PreVote:      preVote,
+			}
+			if preVote {
+				req.Term++
+				s.debugf("Requesting pre-vote from node %d", id)
+			} else {
+				s.debugf("Requesting vote from node %d", id)
 			}
-			s.debugf("Requesting vote from node %d", s.cluster[i].Id)
 			s.mu.Unlock()
 
 			var rsp RequestVoteResponse
-			ok := s.rpcCall(i, "Server.HandleRequestVoteRequest", req, &rsp)
+			ok := s.rpcCall(id, func(address string) error {
+				return s.Transport.RequestVote(id, address, req, &rsp)
+			})
 			if !ok {
 				return
 			}
@@ -341,22 +629,103 @@ func (s *Server) requestVote() {
 				return
 			}
 
-			if rsp.Term == req.Term && rsp.VoteGranted {
-				s.debugf("Vote granted by node %d", s.cluster[i].Id)
+			i := s.memberIndex(id)
+			if i < 0 || !rsp.VoteGranted {
+				return
+			}
+
+			// A late response from an earlier election doesn't count.
+			if !preVote && s.state == candidateState && req.Term == s.currentTerm {
+				s.debugf("Vote granted by node %d", id)
 				s.cluster[i].votedFor = s.id
 			}
-		}(i)
+
+			if preVote && s.state == preCandidateState && req.Term == s.currentTerm+1 {
+				s.debugf("Pre-vote granted by node %d", id)
+				s.cluster[i].preVoteGranted = true
+				if s.countPreVotes() >= s.quorum() {
+					s.startElection()
+				}
+			}
+		})
+	}
+}
+
+// quorum is the number of voters that make up a majority.
+func (s *Server) quorum() int {
+	voters := 0
+	for i := range s.cluster {
+		if s.cluster[i].voter() {
+			voters++
+		}
+	}
+	return voters/2 + 1
+}
+
+func (s *Server) countPreVotes() int {
+	votes := 0
+	for i := range s.cluster {
+		if s.cluster[i].voter() && (i == s.clusterIndex || s.cluster[i].preVoteGranted) {
+			votes++
+		}
 	}
+	return votes
+}
+
+func (s *Server) logUpToDate(lastLogIndex, lastLogTerm uint64) bool {
+	ourLastLogTerm := s.log[len(s.log)-1].Term
+	return lastLogTerm > ourLastLogTerm ||
+		(lastLogTerm == ourLastLogTerm && lastLogIndex >= s.lastLogIndex())
+}
+
+// heardFromLeader reports whether a leader contacted us within the
+// minimum election timeout, in which case there's no reason to
+// support a new election.
+func (s *Server) heardFromLeader() bool {
+	if s.state == leaderState {
+		return true
+	}
+	return s.now().Before(s.leaderContact.Add(s.config.ElectionTimeoutMin))
 }
 
 func (s *Server) HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVoteResponse) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.done {
+		return ErrStopped
+	}
+
+	rsp.VoteGranted = false
+
+	// Servers that have been removed from the cluster don't learn of
+	// it and keep campaigning; don't let their terms disrupt us.
+	if i := s.memberIndex(req.CandidateId); i < 0 || !s.cluster[i].voter() {
+		s.debugf("Rejecting vote from node %d: not a voter", req.CandidateId)
+		rsp.Term = s.currentTerm
+		return nil
+	}
+
+	if !s.voter() {
+		s.debugf("Rejecting vote from node %d: we are not a voter", req.CandidateId)
+		rsp.Term = s.currentTerm
+		return nil
+	}
+
+	if req.PreVote {
+		// Neither side changes term or vote for a pre-vote.
+		rsp.Term = s.currentTerm
+		rsp.VoteGranted = req.Term > s.currentTerm &&
+			s.logUpToDate(req.LastLogIndex, req.LastLogTerm) &&
+			!s.heardFromLeader()
+		s.debugf("Pre-vote request from node %d (term %d), granted: %t",
+			req.CandidateId, req.Term, rsp.VoteGranted)
+		return nil
+	}
+
 	s.updateTerm(req.RPCMessage)
 	s.debugf("Vote request from node %d (term %d)", req.CandidateId, req.Term)
 
-	rsp.VoteGranted = false
 	rsp.Term = s.currentTerm
 
 	if req.Term < s.currentTerm {
@@ -364,13 +733,8 @@ func (s *Server) HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVo
 		return nil
 	}
 
-	lastLogTerm := s.log[len(s.log)-1].Term
-	logLen := uint64(len(s.log) - 1)
-	logOk := req.LastLogTerm > lastLogTerm ||
-		(req.LastLogTerm == lastLogTerm && req.LastLogIndex >= logLen)
-
 	grant := req.Term == s.currentTerm &&
-		logOk &&
+		s.logUpToDate(req.LastLogIndex, req.LastLogTerm) &&
 		(s.getVotedFor() == 0 || s.getVotedFor() == req.CandidateId)
 
 	if grant {
@@ -389,23 +753,42 @@ func (s *Server) HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVo
 func (s *Server) updateTerm(msg RPCMessage) bool {
 	if msg.Term > s.currentTerm {
 		s.debugf("Updating term: %d -> %d", s.currentTerm, msg.Term)
+		if s.state == leaderState {
+			s.stepDown()
+		}
 		s.currentTerm = msg.Term
+		s.leaderId = 0
 		s.state = followerState
+		s.transferee = 0
 		s.setVotedFor(0)
 		s.resetElectionTimeout()
 		s.persist(false, 0)
+		s.emit(Event{Kind: TermChanged})
 		return true
 	}
 	return false
 }
 
+// stepDown ends this server's leadership, failing commands still
+// waiting to be committed.
+func (s *Server) stepDown() {
+	s.failPending(0, ErrLeadershipLost)
+	s.state = followerState
+	s.transferee = 0
+	s.emit(Event{Kind: SteppedDown})
+}
+
 func (s *Server) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.done {
+		return ErrStopped
+	}
+
 	s.updateTerm(req.RPCMessage)
 
-	if req.Term == s.currentTerm && s.state == candidateState {
+	if req.Term == s.currentTerm && (s.state == candidateState || s.state == preCandidateState) {
 		s.debug("Converting to follower (received AppendEntries from leader)")
 		s.state = followerState
 	}
@@ -424,45 +807,75 @@ func (s *Server) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *Appen
 	}
 
 	s.resetElectionTimeout()
+	s.leaderContact = s.now()
+	s.setLeader(req.LeaderId)
+
+	// Entries up to snapshotIndex are committed and already covered
+	// by our snapshot, so skip over them.
+	prevLogIndex := req.PrevLogIndex
+	prevLogTerm := req.PrevLogTerm
+	entries := req.Entries
+	if prevLogIndex < s.snapshotIndex {
+		skip := min(s.snapshotIndex-prevLogIndex, uint64(len(entries)))
+		entries = entries[skip:]
+		prevLogIndex = s.snapshotIndex
+		prevLogTerm = s.snapshotTerm
+	}
 
-	logLen := uint64(len(s.log))
-	validPreviousLog := req.PrevLogIndex == 0 ||
-		(req.PrevLogIndex < logLen && s.log[req.PrevLogIndex].Term == req.PrevLogTerm)
+	validPreviousLog := prevLogIndex == 0 ||
+		(prevLogIndex >= s.snapshotIndex && prevLogIndex <= s.lastLogIndex() &&
+			s.termAt(prevLogIndex) == prevLogTerm)
 
 	if !validPreviousLog {
-		s.debugf("Rejecting AppendEntries: invalid previous log")
+		if prevLogIndex > s.lastLogIndex() {
+			rsp.ConflictIndex = s.lastLogIndex() + 1
+		} else {
+			// Skip back over every entry from the conflicting term, so
+			// the leader needs one round trip per term, not per entry.
+			rsp.ConflictTerm = s.termAt(prevLogIndex)
+			rsp.ConflictIndex = prevLogIndex
+			for rsp.ConflictIndex-1 > s.snapshotIndex && s.termAt(rsp.ConflictIndex-1) == rsp.ConflictTerm {
+				rsp.ConflictIndex--
+			}
+		}
+
+		s.debugf("Rejecting AppendEntries: invalid previous log, conflict at index %d term %d",
+			rsp.ConflictIndex, rsp.ConflictTerm)
 		return nil
 	}
 
 	// Process entries
-	next := req.PrevLogIndex + 1
+	next := prevLogIndex + 1
 	nNewEntries := 0
 
-	for i := next; i < next+uint64(len(req.Entries)); i++ {
-		e := req.Entries[i-next]
+	for i := next; i < next+uint64(len(entries)); i++ {
+		e := entries[i-next]
+		pos := s.entryIndex(i)
 
-		if i >= uint64(cap(s.log)) {
-			newTotal := next + uint64(len(req.Entries))
-			newLog := make([]Entry, i, newTotal*2)
+		if pos >= cap(s.log) {
+			newTotal := pos + len(entries)
+			newLog := make([]Entry, pos, newTotal*2)
 			copy(newLog, s.log)
 			s.log = newLog
 		}
 
-		if i < uint64(len(s.log)) && s.log[i].Term != e.Term {
-			s.log = s.log[:i]
+		if pos < len(s.log) && s.log[pos].Term != e.Term {
+			s.failPending(i, ErrLeadershipLost)
+			s.log = s.log[:pos]
 		}
 
-		if i < uint64(len(s.log)) {
-			Server_assert(s, "Existing log matches", s.log[i].Term, e.Term)
+		if pos < len(s.log) {
+			Server_assert(s, "Existing log matches", s.log[pos].Term, e.Term)
 		} else {
 			s.log = append(s.log, e)
 			nNewEntries++
 		}
 	}
 
-	if req.LeaderCommit > s.commitIndex {
-		s.commitIndex = min(req.LeaderCommit, uint64(len(s.log)-1))
-	}
+	// Entries after the ones the leader sent haven't been checked
+	// against its log yet, so they can't be committed.
+	lastNewEntry := prevLogIndex + uint64(len(entries))
+	s.commitIndex = max(s.commitIndex, min(req.LeaderCommit, lastNewEntry))
 
 	s.persist(nNewEntries != 0, nNewEntries)
 	rsp.Success = true
@@ -475,106 +888,145 @@ func (s *Server) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *Appen
 }
 
 var ErrApplyToLeader = errors.New("Cannot apply message to follower, apply to leader")
+var ErrLeadershipLost = errors.New("Leadership lost before the command was committed")
+var ErrStopped = errors.New("Server is stopped")
 
 func (s *Server) Apply(commands [][]byte) ([]ApplyResult, error) {
+	return s.ApplyContext(context.Background(), commands)
+}
+
+// ApplyContext is like Apply but gives up waiting for the commands to
+// be applied once ctx is done, returning ctx.Err(). The commands may
+// still be applied later. A command whose result has Error
+// ErrLeadershipLost may or may not have been applied; this server
+// stopped being leader before it was committed.
+func (s *Server) ApplyContext(ctx context.Context, commands [][]byte) ([]ApplyResult, error) {
+	return s.apply(ctx, CommandEntry, commands)
+}
+
+func (s *Server) apply(ctx context.Context, kind EntryKind, commands [][]byte) ([]ApplyResult, error) {
 	s.mu.Lock()
 
+	if s.done {
+		s.mu.Unlock()
+		return nil, ErrStopped
+	}
+
 	if s.state != leaderState {
 		s.mu.Unlock()
 		return nil, ErrApplyToLeader
 	}
 
+	if s.transferee != 0 {
+		s.mu.Unlock()
+		return nil, ErrLeadershipTransferInProgress
+	}
+
+	s.mu.Unlock()
+
 	s.debugf("Processing %d new commands", len(commands))
 	resultChans := make([]chan ApplyResult, len(commands))
+	proposals := make([]proposal, len(commands))
 
 	for i, command := range commands {
-		resultChans[i] = make(chan ApplyResult)
-		s.log = append(s.log, Entry{
-			Term:    s.currentTerm,
-			Command: command,
-			result:  resultChans[i],
-		})
+		// Buffered, so the result can be delivered even if the caller
+		// stopped waiting for it.
+		resultChans[i] = make(chan ApplyResult, 1)
+		proposals[i] = proposal{kind: kind, command: command, result: resultChans[i]}
 	}
 
-	s.persist(true, len(commands))
-	s.mu.Unlock()
-
-	s.appendEntries()
+	s.propose(proposals)
 
 	results := make([]ApplyResult, len(commands))
-	var wg sync.WaitGroup
-	wg.Add(len(commands))
-
 	for i, ch := range resultChans {
-		go func(i int, c chan ApplyResult) {
-			results[i] = <-c
-			wg.Done()
-		}(i, ch)
+		select {
+		case results[i] = <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 
-	wg.Wait()
 	return results, nil
 }
 
-func (s *Server) rpcCall(i int, name string, req, rsp any) bool {
+// rpcCall looks up the address of member id and passes it to call,
+// which sends the RPC over s.Transport. It returns false if the call
+// failed or id is no longer a member.
+func (s *Server) rpcCall(id uint64, call func(address string) error) bool {
 	s.mu.Lock()
-	c := s.cluster[i]
-	var err error
-
-	if c.rpcClient == nil {
-		c.rpcClient, err = rpc.DialHTTP("tcp", c.Address)
-		if err == nil {
-			s.cluster[i].rpcClient = c.rpcClient // Store the connection
-		}
+	i := s.memberIndex(id)
+	if i < 0 || s.done {
+		// Removed from the configuration or stopped in the meantime.
+		s.mu.Unlock()
+		return false
 	}
-
-	rpcClient := c.rpcClient
+	address := s.cluster[i].Address
 	s.mu.Unlock()
 
-	if err == nil && rpcClient != nil {
-		err = rpcClient.Call(name, req, rsp)
-	}
-
+	err := call(address)
 	if err != nil {
 		// Only log errors occasionally to reduce spam
 		if rand.Intn(10) == 0 {
-			s.warn(fmt.Sprintf("RPC error to node %d: %s", c.Id, err))
+			s.warn(fmt.Sprintf("RPC error to node %d: %s", id, err))
 		}
+	}
 
-		// Close bad connection
-		s.mu.Lock()
-		if s.cluster[i].rpcClient != nil {
-			s.cluster[i].rpcClient.Close()
-			s.cluster[i].rpcClient = nil
-		}
-		s.mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		// Don't act on a response that arrived after Stop.
+		return false
 	}
+	s.setReachable(id, err == nil)
 
 	return err == nil
 }
 
 const MAX_APPEND_ENTRIES_BATCH = 8000
 
+const MAX_INFLIGHT_APPEND_ENTRIES = 4
+
 func (s *Server) appendEntries() {
 	for i := range s.cluster {
 		if i == s.clusterIndex {
 			continue
 		}
 
-		go func(i int) {
+		id := s.cluster[i].Id
+		s.spawn(func() {
 			s.mu.Lock()
 
-			next := s.cluster[i].nextIndex
+			i := s.memberIndex(id)
+			if i < 0 || s.state != leaderState {
+				s.mu.Unlock()
+				return
+			}
+
+			c := &s.cluster[i]
+			if c.inflight >= s.config.MaxInflightAppendEntries || (!c.replicating && c.inflight > 0) {
+				// The requests in flight double as heartbeats.
+				s.mu.Unlock()
+				return
+			}
+
+			next := c.nextIndex
+			if next <= s.snapshotIndex {
+				// The entries this follower needs have been compacted.
+				s.mu.Unlock()
+				s.installSnapshot(id)
+				return
+			}
+
 			prevLogIndex := next - 1
-			prevLogTerm := s.log[prevLogIndex].Term
+			prevLogTerm := s.termAt(prevLogIndex)
 
 			var entries []Entry
-			if uint64(len(s.log)-1) >= s.cluster[i].nextIndex {
-				entries = s.log[next:]
+			if s.lastLogIndex() >= next {
+				entries = s.log[s.entryIndex(next):]
 			}
 
-			if len(entries) > MAX_APPEND_ENTRIES_BATCH {
-				entries = entries[:MAX_APPEND_ENTRIES_BATCH]
+			if len(entries) > s.config.MaxAppendEntriesBatch {
+				entries = entries[:s.config.MaxAppendEntriesBatch]
 			}
 
 			req := AppendEntriesRequest{
@@ -586,114 +1038,243 @@ func (s *Server) appendEntries() {
 				LeaderCommit: s.commitIndex,
 			}
 
+			c.inflight++
+			if c.replicating {
+				c.nextIndex = next + uint64(len(entries))
+			}
+
 			s.mu.Unlock()
 
+			sent := s.now()
 			var rsp AppendEntriesResponse
-			ok := s.rpcCall(i, "Server.HandleAppendEntriesRequest", req, &rsp)
-			if !ok {
-				return
-			}
+			ok := s.rpcCall(id, func(address string) error {
+				return s.Transport.AppendEntries(id, address, req, &rsp)
+			})
 
 			s.mu.Lock()
 			defer s.mu.Unlock()
 
-			if s.updateTerm(rsp.RPCMessage) {
+			if ok && s.updateTerm(rsp.RPCMessage) {
+				return
+			}
+
+			i = s.memberIndex(id)
+			if i < 0 || s.state != leaderState || s.currentTerm != req.Term {
 				return
 			}
 
+			c = &s.cluster[i]
+			c.inflight = max(c.inflight-1, 0)
+
+			if !ok {
+				// The entries may never have arrived; send them again.
+				c.replicating = false
+				c.nextIndex = min(c.nextIndex, next)
+				return
+			}
+
+			if sent.After(c.lastContact) {
+				c.lastContact = sent
+			}
+
 			if rsp.Success {
-				s.cluster[i].nextIndex = max(prevLogIndex+uint64(len(entries))+1, 1)
-				s.cluster[i].matchIndex = s.cluster[i].nextIndex - 1
+				c.replicating = true
+				c.matchIndex = max(c.matchIndex, prevLogIndex+uint64(len(entries)))
+				c.nextIndex = max(c.nextIndex, c.matchIndex+1)
 				if len(entries) > 0 {
-					s.debugf("Node %d accepted %d entries", s.cluster[i].Id, len(entries))
+					s.debugf("Node %d accepted %d entries", c.Id, len(entries))
 				}
-			} else {
-				s.cluster[i].nextIndex = max(s.cluster[i].nextIndex-1, 1)
-				s.debugf("Node %d rejected, backing off to index %d", s.cluster[i].Id, s.cluster[i].nextIndex)
+				s.updateCommitIndex()
+			} else if prevLogIndex >= c.matchIndex {
+				// Rejections for entries the follower has since matched
+				// are stale and ignored.
+				c.replicating = false
+				c.nextIndex = max(s.nextIndexAfterReject(req, rsp), c.matchIndex+1)
+				s.debugf("Node %d rejected, backing off to index %d", c.Id, c.nextIndex)
 			}
-		}(i)
+		})
 	}
 }
 
-func (s *Server) advanceCommitIndex() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// nextIndexAfterReject picks where to resume replicating to a
+// follower that rejected req. If the leader has entries from the
+// conflicting term it resumes after the last of them, otherwise at the
+// first index the follower holds in that term.
+func (s *Server) nextIndexAfterReject(req AppendEntriesRequest, rsp AppendEntriesResponse) uint64 {
+	if rsp.ConflictIndex == 0 {
+		// No hint; back off by one.
+		return max(req.PrevLogIndex, 1)
+	}
 
-	if s.state == leaderState {
-		lastLogIndex := uint64(len(s.log) - 1)
+	if rsp.ConflictTerm != 0 {
+		for index := req.PrevLogIndex; index > s.snapshotIndex; index-- {
+			term := s.termAt(index)
+			if term == rsp.ConflictTerm {
+				return index + 1
+			} else if term < rsp.ConflictTerm {
+				break
+			}
+		}
+	}
 
-		for i := lastLogIndex; i > s.commitIndex; i-- {
-			quorum := len(s.cluster)/2 + 1
-			for j := range s.cluster {
-				if quorum == 0 {
-					break
-				}
+	return max(min(rsp.ConflictIndex, req.PrevLogIndex), 1)
+}
 
-				if j == s.clusterIndex || s.cluster[j].matchIndex >= i {
-					quorum--
-				}
-			}
+// updateCommitIndex moves the leader's commit index up to the highest
+// entry from its own term stored on a majority of voters.
+func (s *Server) updateCommitIndex() {
+	lastLogIndex := s.lastLogIndex()
 
-			if quorum == 0 && s.log[i].Term == s.currentTerm {
-				s.commitIndex = i
-				s.debugf("New commit index: %d", i)
+	for i := lastLogIndex; i > s.commitIndex; i-- {
+		quorum := s.quorum()
+		for j := range s.cluster {
+			if quorum == 0 {
 				break
 			}
+
+			if s.cluster[j].voter() && (j == s.clusterIndex || s.cluster[j].matchIndex >= i) {
+				quorum--
+			}
+		}
+
+		if quorum == 0 && s.termAt(i) == s.currentTerm {
+			s.commitIndex = i
+			s.debugf("New commit index: %d", i)
+			break
 		}
 	}
+}
 
+func (s *Server) advanceCommitIndex() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == leaderState {
+		s.updateCommitIndex()
+	}
+
+	applied := s.lastApplied
 	for s.lastApplied < s.commitIndex {
 		s.lastApplied++
-		entry := s.log[s.lastApplied]
-
-		if len(entry.Command) > 0 {
+		entry := &s.log[s.entryIndex(s.lastApplied)]
+
+		var res ApplyResult
+		if entry.Kind == ConfigurationEntry {
+			s.setConfiguration(s.lastApplied, decodeConfiguration(entry.Command))
+		} else if entry.Kind == RegisterClientEntry || entry.Kind == SessionCommandEntry {
+			s.debugf("Applying session entry %d", s.lastApplied)
+			res = s.statemachine.applySession(s.lastApplied, *entry)
+		} else if len(entry.Command) > 0 {
 			s.debugf("Applying entry %d", s.lastApplied)
-			res, err := s.statemachine.Apply(entry.Command)
+			r, err := s.statemachine.apply(s.lastApplied, entry.Command)
+			res = ApplyResult{Result: r, Error: err}
+		}
+
+		if entry.result != nil {
+			entry.result <- res
+			entry.result = nil
+		}
+	}
 
-			if entry.result != nil {
-				entry.result <- ApplyResult{Result: res, Error: err}
+	if s.lastApplied > applied {
+		if s.statemachine != nil {
+			if err := s.statemachine.flush(); err != nil {
+				panic(err)
 			}
 		}
+		s.emit(Event{Kind: EntryCommitted, Index: s.lastApplied})
+	}
+}
+
+// failPending fails every caller still waiting on an entry from index
+// on with err. Called with the lock held when this server steps down
+// as leader or stops, or before those entries are removed from the log. Entries
+// that were kept may still be committed by a later leader, so the
+// caller can't tell whether its command took effect.
+func (s *Server) failPending(index uint64, err error) {
+	for i := max(index, s.lastApplied+1); i <= s.lastLogIndex(); i++ {
+		e := &s.log[s.entryIndex(i)]
+		if e.result != nil {
+			e.result <- ApplyResult{Error: err}
+			e.result = nil
+		}
 	}
 }
 
 func (s *Server) resetElectionTimeout() {
-	interval := time.Duration(rand.Intn(s.heartbeatMs*2) + s.heartbeatMs*2)
-	s.electionTimeout = time.Now().Add(interval * time.Millisecond)
-	s.debugf("Election timeout reset: %dms", interval)
+	interval := s.config.ElectionTimeoutMin
+	if spread := s.config.ElectionTimeoutMax - s.config.ElectionTimeoutMin; spread > 0 {
+		interval += time.Duration(s.rand.Int63n(int64(spread)))
+		interval += time.Duration(s.outranked()) * spread
+	}
+	s.electionTimeout = s.now().Add(interval)
+	s.debugf("Election timeout reset: %s", interval)
 }
 
 func (s *Server) timeout() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if time.Now().After(s.electionTimeout) {
-		s.debug("Election timeout - starting new election")
-		s.state = candidateState
-		s.currentTerm++
-		s.setVotedFor(s.id)
+	if s.now().After(s.electionTimeout) && !s.voter() {
+		// Not a voting member (yet); nothing to campaign for.
+		s.resetElectionTimeout()
+	} else if s.now().After(s.electionTimeout) {
+		s.debug("Election timeout - starting pre-vote")
+		s.startPreVote()
+	}
+}
 
-		for i := range s.cluster {
-			if i != s.clusterIndex {
-				s.cluster[i].votedFor = 0
-			}
-		}
+// startPreVote checks that we could win an election before starting
+// one. A server that can't reach a majority, e.g. because it is
+// partitioned, then keeps its term instead of inflating it and
+// forcing a healthy leader to step down when it reconnects.
+func (s *Server) startPreVote() {
+	s.state = preCandidateState
+	for i := range s.cluster {
+		s.cluster[i].preVoteGranted = false
+	}
 
-		s.resetElectionTimeout()
-		s.persist(false, 0)
-		s.requestVote()
+	s.resetElectionTimeout()
+
+	if s.countPreVotes() >= s.quorum() {
+		s.startElection()
+		return
+	}
+
+	s.requestVote(true)
+}
+
+func (s *Server) startElection() {
+	s.state = candidateState
+	s.currentTerm++
+	s.leaderId = 0
+	s.emit(Event{Kind: TermChanged})
+	s.setVotedFor(s.id)
+
+	for i := range s.cluster {
+		if i != s.clusterIndex {
+			s.cluster[i].votedFor = 0
+		}
 	}
+
+	s.resetElectionTimeout()
+	s.persist(false, 0)
+	s.requestVote(false)
 }
 
 func (s *Server) becomeLeader() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	quorum := len(s.cluster)/2 + 1
+	if s.state != candidateState {
+		return
+	}
+
+	quorum := s.quorum()
 	votes := 0
 
 	for i := range s.cluster {
-		if s.cluster[i].votedFor == s.id {
+		if s.cluster[i].voter() && s.cluster[i].votedFor == s.id {
 			votes++
 		}
 	}
@@ -701,16 +1282,21 @@ func (s *Server) becomeLeader() {
 	if votes >= quorum {
 		s.debug("BECAME LEADER")
 		s.state = leaderState
+		s.leaderSince = s.now()
+		s.setLeader(s.id)
 
 		for i := range s.cluster {
-			s.cluster[i].nextIndex = uint64(len(s.log))
+			s.cluster[i].nextIndex = s.lastLogIndex() + 1
 			s.cluster[i].matchIndex = 0
+			s.cluster[i].lastContact = time.Time{}
+			s.cluster[i].inflight = 0
+			s.cluster[i].replicating = false
 		}
 
 		// Commit no-op entry
 		s.log = append(s.log, Entry{Term: s.currentTerm, Command: nil})
 		s.persist(true, 1)
-		s.heartbeatTimeout = time.Now()
+		s.heartbeatTimeout = s.now()
 	}
 }
 
@@ -718,14 +1304,104 @@ func (s *Server) heartbeat() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if time.Now().After(s.heartbeatTimeout) {
-		s.heartbeatTimeout = time.Now().Add(time.Duration(s.heartbeatMs) * time.Millisecond)
+	if s.now().After(s.heartbeatTimeout) {
+		s.heartbeatTimeout = s.nextHeartbeat()
 		s.debug("Sending heartbeat")
 		s.appendEntries()
 	}
 }
 
+// nextHeartbeat returns when the leader next sends heartbeats. Hosted
+// servers all send theirs on the same interval boundary, so that the
+// heartbeats of groups sharing a peer leave in the same tick and can
+// travel in one request.
+func (s *Server) nextHeartbeat() time.Time {
+	if s.hosted {
+		return s.now().Truncate(s.config.HeartbeatInterval).Add(s.config.HeartbeatInterval)
+	}
+	return s.now().Add(s.config.HeartbeatInterval)
+}
+
+// checkQuorum steps down a leader that hasn't heard from a majority
+// of the cluster within the maximum election timeout. It has most
+// likely been partitioned away and the rest of the cluster elected a
+// new leader, or is about to.
+func (s *Server) checkQuorum() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != leaderState {
+		return
+	}
+
+	// Give a new leader a full window to hear from everyone.
+	maxElectionTimeout := s.config.ElectionTimeoutMax
+	if s.now().Sub(s.leaderSince) < maxElectionTimeout {
+		return
+	}
+
+	active := 0
+	for i := range s.cluster {
+		if !s.cluster[i].voter() {
+			continue
+		}
+		if i == s.clusterIndex || s.now().Sub(s.cluster[i].lastContact) < maxElectionTimeout {
+			active++
+		}
+	}
+
+	if active < s.quorum() {
+		s.warn(fmt.Sprintf("Lost contact with a majority (%d of %d active), stepping down", active, len(s.cluster)))
+		s.stepDown()
+		s.resetElectionTimeout()
+	}
+}
+
+// tick does whatever periodic work the current state calls for.
+func (s *Server) tick() {
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	switch state {
+	case leaderState:
+		s.heartbeat()
+		s.checkQuorum()
+		s.advanceCommitIndex()
+		s.compact()
+		s.preferLeader()
+	case followerState, preCandidateState:
+		s.timeout()
+		s.advanceCommitIndex()
+		s.compact()
+	case candidateState:
+		s.timeout()
+		s.becomeLeader()
+	}
+}
+
 func (s *Server) Start() {
+	s.open()
+
+	// Main state machine loop
+	s.spawn(func() {
+		for {
+			s.mu.Lock()
+			if s.done {
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+
+			s.tick()
+			time.Sleep(s.config.TickInterval)
+		}
+	})
+}
+
+// open restores the server's state and starts listening, leaving it
+// ready to be driven by tick.
+func (s *Server) open() {
 	s.mu.Lock()
 	s.state = followerState
 	s.done = false
@@ -734,49 +1410,61 @@ func (s *Server) Start() {
 	s.restore()
 
 	// Start RPC server
-	rpcServer := rpc.NewServer()
-	rpcServer.Register(s)
-	l, err := net.Listen("tcp", s.address)
-	if err != nil {
+	if err := s.Transport.Listen(s.address, s); err != nil {
 		panic(err)
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle(rpc.DefaultRPCPath, rpcServer)
-	s.server = &http.Server{Handler: mux}
-	go s.server.Serve(l)
-
 	s.debug("Raft server started")
 
-	// Main state machine loop
-	go func() {
-		s.mu.Lock()
-		s.resetElectionTimeout()
+	s.mu.Lock()
+	s.resetElectionTimeout()
+	s.mu.Unlock()
+}
+
+// Stop shuts the server down so that Start can be called on it again.
+// Callers still waiting on Apply get ErrStopped, peer connections are
+// closed, and the server's goroutines are waited for before its files
+// are closed. If ctx is done first, Stop returns ctx.Err() and leaves
+// the files open for the goroutines still running; Start must not be
+// called until Stop has returned nil.
+func (s *Server) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if s.fd == nil {
 		s.mu.Unlock()
+		return nil
+	}
 
-		for {
-			s.mu.Lock()
-			if s.done {
-				s.mu.Unlock()
-				return
-			}
-			state := s.state
-			s.mu.Unlock()
+	// A retry after ctx ran out only has to wait again.
+	if !s.done {
+		s.debug("Stopping.")
+		s.done = true
+		s.failPending(0, ErrStopped)
+		if s.state == leaderState {
+			s.stepDown()
+		}
+		s.state = followerState
+		s.leaderId = 0
+	}
+	s.mu.Unlock()
 
-			switch state {
-			case leaderState:
-				s.heartbeat()
-				s.advanceCommitIndex()
-			case followerState:
-				s.timeout()
-				s.advanceCommitIndex()
-			case candidateState:
-				s.timeout()
-				s.becomeLeader()
-			}
+	// Closing the transport also unblocks RPCs still waiting on peers.
+	err := s.Transport.Close()
 
-			// CRITICAL FIX: Add sleep to prevent tight loop
-			time.Sleep(200 * time.Millisecond)
+	ticker := time.NewTicker(s.config.TickInterval)
+	defer ticker.Stop()
+	for s.spawned.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
-	}()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fd.Close()
+	s.fd = nil
+	s.wal.close()
+	s.wal = nil
+	return err
 }
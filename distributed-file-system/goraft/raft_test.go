@@ -2,11 +2,15 @@ package goraft
 
 import (
 	"bytes"
+	"context"
+	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func Test_persist_restore(t *testing.T) {
-	s := NewServer(
+	s, err := NewServer(
 		[]ClusterMember{
 			{
 				Id:      1,
@@ -14,9 +18,12 @@ func Test_persist_restore(t *testing.T) {
 			},
 		},
 		nil,
-		".",
+		Config{MetadataDir: t.TempDir()},
 		0,
 	)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	// Sets up the file
 	s.restore()
@@ -60,3 +67,782 @@ func Test_persist_restore(t *testing.T) {
 	}
 	s.mu.Unlock()
 }
+
+type testStateMachine struct {
+	applied []string
+}
+
+func (sm *testStateMachine) Apply(cmd []byte) ([]byte, error) {
+	sm.applied = append(sm.applied, string(cmd))
+	return cmd, nil
+}
+
+func (sm *testStateMachine) Snapshot() ([]byte, error) {
+	return []byte(strings.Join(sm.applied, "\n")), nil
+}
+
+func (sm *testStateMachine) Restore(snapshot []byte) error {
+	sm.applied = nil
+	if len(snapshot) > 0 {
+		sm.applied = strings.Split(string(snapshot), "\n")
+	}
+	return nil
+}
+
+func newTestServer(t *testing.T, dir string, sm StateMachine) *Server {
+	s, err := NewServer(
+		[]ClusterMember{
+			{
+				Id:      1,
+				Address: ":3030",
+			},
+		},
+		sm,
+		Config{MetadataDir: dir},
+		0,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Transport = NewInmemNetwork().NewTransport()
+	s.restore()
+	s.state = followerState
+	return s
+}
+
+func Test_compact_restore(t *testing.T) {
+	dir := t.TempDir()
+	sm := &testStateMachine{}
+	s := newTestServer(t, dir, sm)
+
+	n := SNAPSHOT_THRESHOLD + 10
+	s.mu.Lock()
+	for i := 0; i < n; i++ {
+		s.log = append(s.log, Entry{Term: 1, Command: []byte(fmt.Sprintf("cmd %d", i))})
+	}
+	s.persist(true, n)
+	s.commitIndex = uint64(n - 5)
+	s.mu.Unlock()
+
+	s.advanceCommitIndex()
+	s.compact()
+
+	s.mu.Lock()
+	if s.snapshotIndex != uint64(n-5) {
+		t.Errorf("Expected snapshot index %d, got %d", n-5, s.snapshotIndex)
+	}
+	if len(s.log) != 6 {
+		t.Errorf("Expected 6 entries after compaction, got %d", len(s.log))
+	}
+	if s.lastLogIndex() != uint64(n) {
+		t.Errorf("Expected last log index %d, got %d", n, s.lastLogIndex())
+	}
+	s.mu.Unlock()
+
+	restoredSm := &testStateMachine{}
+	restored := newTestServer(t, dir, restoredSm)
+	if restored.lastLogIndex() != uint64(n) {
+		t.Errorf("Expected restored last log index %d, got %d", n, restored.lastLogIndex())
+	}
+	if restored.lastApplied != uint64(n-5) {
+		t.Errorf("Expected restored lastApplied %d, got %d", n-5, restored.lastApplied)
+	}
+	if len(restoredSm.applied) != n-5 || restoredSm.applied[n-6] != fmt.Sprintf("cmd %d", n-6) {
+		t.Errorf("Expected state machine restored with %d commands, got %d", n-5, len(restoredSm.applied))
+	}
+	if string(restored.log[1].Command) != fmt.Sprintf("cmd %d", n-5) {
+		t.Errorf("Expected first retained entry to be 'cmd %d', got '%s'", n-5, restored.log[1].Command)
+	}
+}
+
+func Test_install_snapshot(t *testing.T) {
+	sm := &testStateMachine{}
+	s := newTestServer(t, t.TempDir(), sm)
+
+	var rsp InstallSnapshotResponse
+	err := s.HandleInstallSnapshotRequest(InstallSnapshotRequest{
+		RPCMessage:        RPCMessage{Term: 3},
+		LeaderId:          2,
+		LastIncludedIndex: 100,
+		LastIncludedTerm:  2,
+		Configuration: encodeConfiguration([]ClusterMember{
+			{Id: 1, Address: ":3030"},
+			{Id: 2, Address: ":3031"},
+		}),
+		Data: []byte("a\nb\nc"),
+	}, &rsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sm.applied) != 3 {
+		t.Errorf("Expected snapshot with 3 commands to be restored, got %d", len(sm.applied))
+	}
+	if s.commitIndex != 100 || s.lastApplied != 100 || s.lastLogIndex() != 100 {
+		t.Errorf("Expected commit/applied/last index 100, got %d/%d/%d", s.commitIndex, s.lastApplied, s.lastLogIndex())
+	}
+	if len(s.cluster) != 2 || s.cluster[1].Id != 2 {
+		t.Errorf("Expected configuration from snapshot, got %d members", len(s.cluster))
+	}
+
+	// The leader may still be sending entries that the snapshot covers.
+	var aeRsp AppendEntriesResponse
+	err = s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage:   RPCMessage{Term: 3},
+		LeaderId:     2,
+		PrevLogIndex: 98,
+		PrevLogTerm:  2,
+		Entries: []Entry{
+			{Term: 2, Command: []byte("b")},
+			{Term: 2, Command: []byte("c")},
+			{Term: 3, Command: []byte("d")},
+		},
+		LeaderCommit: 101,
+	}, &aeRsp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !aeRsp.Success {
+		t.Fatal("Expected AppendEntries overlapping the snapshot to succeed")
+	}
+	if s.lastLogIndex() != 101 || string(s.log[s.entryIndex(101)].Command) != "d" {
+		t.Errorf("Expected entry 'd' at index 101, last index is %d", s.lastLogIndex())
+	}
+}
+
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", msg)
+}
+
+func Test_membership_change(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	s.state = leaderState
+	s.currentTerm = 1
+	s.mu.Unlock()
+
+	lastLogIndex := func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.lastLogIndex()
+	}
+
+	done := make(chan error)
+	go func() { done <- s.AddMember(2, ":3031", 0) }()
+	waitFor(t, "configuration entry", func() bool { return lastLogIndex() == 1 })
+
+	// A single-member cluster commits on its own.
+	s.advanceCommitIndex()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if members := s.Members(); len(members) != 2 || members[1].Id != 2 {
+		t.Fatalf("Expected node 2 to be added, got %v", members)
+	}
+
+	go func() { done <- s.RemoveMember(2) }()
+	waitFor(t, "configuration entry", func() bool { return lastLogIndex() == 2 })
+
+	if err := s.AddMember(3, ":3032", 0); err != ErrConfigChangeInProgress {
+		t.Errorf("Expected ErrConfigChangeInProgress, got %v", err)
+	}
+
+	// Node 2 is part of the quorum now.
+	s.advanceCommitIndex()
+	if s.commitIndex != 1 {
+		t.Errorf("Expected removal to wait for node 2, commit index is %d", s.commitIndex)
+	}
+
+	s.mu.Lock()
+	s.cluster[s.memberIndex(2)].matchIndex = 2
+	s.mu.Unlock()
+	s.advanceCommitIndex()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if members := s.Members(); len(members) != 1 {
+		t.Fatalf("Expected node 2 to be removed, got %v", members)
+	}
+
+	// Removed servers can't force a term change.
+	var rsp RequestVoteResponse
+	s.HandleRequestVoteRequest(RequestVoteRequest{
+		RPCMessage:   RPCMessage{Term: 10},
+		CandidateId:  2,
+		LastLogIndex: 10,
+		LastLogTerm:  10,
+	}, &rsp)
+	if rsp.VoteGranted || s.currentTerm != 1 || !s.IsLeader() {
+		t.Errorf("Expected vote from removed node to be ignored")
+	}
+}
+
+func Test_leadership_transfer(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	s.state = leaderState
+	s.currentTerm = 1
+	s.transferee = 2
+	s.mu.Unlock()
+
+	if _, err := s.Apply([][]byte{[]byte("x")}); err != ErrLeadershipTransferInProgress {
+		t.Errorf("Expected Apply to be refused during transfer, got %v", err)
+	}
+
+	follower := newTestServer(t, t.TempDir(), &testStateMachine{})
+	follower.mu.Lock()
+	follower.currentTerm = 1
+	follower.mu.Unlock()
+
+	var rsp TimeoutNowResponse
+	follower.HandleTimeoutNowRequest(TimeoutNowRequest{
+		RPCMessage: RPCMessage{Term: 1},
+		LeaderId:   2,
+	}, &rsp)
+
+	if follower.state != candidateState || follower.currentTerm != 2 {
+		t.Errorf("Expected TimeoutNow to start an election, state %s term %d", follower.state, follower.currentTerm)
+	}
+}
+
+// newTestCluster returns servers that aren't listening, so every
+// RPC they send fails as if they were partitioned. Messages are
+// delivered by calling the handlers directly.
+func newTestCluster(t *testing.T, n int) []*Server {
+	var cluster []ClusterMember
+	for i := 0; i < n; i++ {
+		cluster = append(cluster, ClusterMember{
+			Id:      uint64(i + 1),
+			Address: fmt.Sprintf("127.0.0.1:%d", i+1),
+		})
+	}
+
+	network := NewInmemNetwork()
+	var servers []*Server
+	for i := 0; i < n; i++ {
+		s, err := NewServer(cluster, &testStateMachine{}, Config{MetadataDir: t.TempDir()}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Transport = network.NewTransport()
+		s.restore()
+		s.state = followerState
+		servers = append(servers, s)
+	}
+	return servers
+}
+
+func Test_prevote_partitioned_follower(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	leader, follower, partitioned := servers[0], servers[1], servers[2]
+
+	leader.mu.Lock()
+	leader.currentTerm = 1
+	leader.state = leaderState
+	leader.mu.Unlock()
+
+	var aeRsp AppendEntriesResponse
+	heartbeat := AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 1},
+		LeaderId:   1,
+	}
+	follower.HandleAppendEntriesRequest(heartbeat, &aeRsp)
+	partitioned.HandleAppendEntriesRequest(heartbeat, &aeRsp)
+
+	// Cut off, the server keeps timing out but can't win a pre-vote,
+	// so its term stays put.
+	for i := 0; i < 5; i++ {
+		partitioned.mu.Lock()
+		partitioned.electionTimeout = time.Now().Add(-time.Millisecond)
+		partitioned.mu.Unlock()
+		partitioned.timeout()
+	}
+
+	if partitioned.currentTerm != 1 || partitioned.state != preCandidateState {
+		t.Errorf("Expected partitioned server to stay at term 1 as pre-candidate, got term %d (%s)",
+			partitioned.currentTerm, partitioned.state)
+	}
+
+	// A follower that still hears from the leader refuses the
+	// pre-vote once the partition heals, and isn't moved to a new term.
+	var rvRsp RequestVoteResponse
+	follower.HandleRequestVoteRequest(RequestVoteRequest{
+		RPCMessage:   RPCMessage{Term: partitioned.currentTerm + 1},
+		CandidateId:  3,
+		LastLogIndex: partitioned.lastLogIndex(),
+		LastLogTerm:  1,
+		PreVote:      true,
+	}, &rvRsp)
+	if rvRsp.VoteGranted || follower.currentTerm != 1 {
+		t.Errorf("Expected pre-vote to be refused without a term change, granted %t term %d",
+			rvRsp.VoteGranted, follower.currentTerm)
+	}
+
+	// The leader's next heartbeat brings the server back in line.
+	partitioned.HandleAppendEntriesRequest(heartbeat, &aeRsp)
+	if !aeRsp.Success || partitioned.state != followerState || !leader.IsLeader() {
+		t.Errorf("Expected partitioned server to rejoin as follower of the same leader")
+	}
+
+	// Once the leader is gone for an election timeout, pre-votes are
+	// granted again.
+	follower.mu.Lock()
+	follower.leaderContact = time.Time{}
+	follower.mu.Unlock()
+	follower.HandleRequestVoteRequest(RequestVoteRequest{
+		RPCMessage:   RPCMessage{Term: 2},
+		CandidateId:  3,
+		LastLogIndex: partitioned.lastLogIndex(),
+		LastLogTerm:  1,
+		PreVote:      true,
+	}, &rvRsp)
+	if !rvRsp.VoteGranted || follower.currentTerm != 1 {
+		t.Errorf("Expected pre-vote to be granted without a term change")
+	}
+}
+
+func Test_check_quorum(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	leader := servers[0]
+
+	leader.mu.Lock()
+	leader.currentTerm = 1
+	leader.state = leaderState
+	leader.cluster[1].lastContact = time.Now()
+	leader.mu.Unlock()
+
+	// One follower plus itself is still a majority.
+	leader.checkQuorum()
+	if !leader.IsLeader() {
+		t.Fatal("Expected leader in contact with a majority to stay leader")
+	}
+
+	// Partitioned from both followers.
+	leader.mu.Lock()
+	leader.cluster[1].lastContact = time.Now().Add(-time.Minute)
+	leader.mu.Unlock()
+
+	leader.checkQuorum()
+	if leader.IsLeader() {
+		t.Error("Expected leader without a majority to step down")
+	}
+	if leader.currentTerm != 1 {
+		t.Errorf("Expected stepping down not to change term, got %d", leader.currentTerm)
+	}
+}
+
+func Test_read_index(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	leader := servers[0]
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := servers[1].ReadIndex(ctx); err != ErrApplyToLeader {
+		t.Fatalf("Expected ErrApplyToLeader from a follower, got %v", err)
+	}
+
+	leader.mu.Lock()
+	leader.currentTerm = 1
+	leader.log = append(leader.log, Entry{Term: 1, Command: []byte("x")})
+	leader.persist(true, 1)
+	leader.commitIndex = 1
+	leader.state = leaderState
+	leader.mu.Unlock()
+	go leader.advanceCommitIndex()
+
+	// Nobody answers the heartbeats, so leadership can't be confirmed.
+	if _, err := leader.ReadIndex(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected ReadIndex to time out without a majority, got %v", err)
+	}
+
+	// A follower answered a request sent after the read started.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		leader.mu.Lock()
+		leader.cluster[1].lastContact = time.Now()
+		leader.mu.Unlock()
+	}()
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	index, err := leader.ReadIndex(ctx)
+	if err != nil || index != 1 {
+		t.Fatalf("Expected read at index 1, got %d (%v)", index, err)
+	}
+	if leader.lastApplied < index {
+		t.Errorf("Expected read index to be applied, lastApplied is %d", leader.lastApplied)
+	}
+}
+
+func Test_lease_read(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	leader := servers[0]
+
+	leader.mu.Lock()
+	leader.currentTerm = 1
+	leader.log = append(leader.log, Entry{Term: 1})
+	leader.persist(true, 1)
+	leader.commitIndex = 1
+	leader.lastApplied = 1
+	leader.state = leaderState
+	leader.cluster[1].lastContact = time.Now()
+	leader.mu.Unlock()
+
+	// With a recent acknowledgement from a majority, no heartbeat
+	// round is needed.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := leader.LeaseRead(ctx); err != nil {
+		t.Fatalf("Expected lease read to succeed, got %v", err)
+	}
+
+	// No lease while leadership is being transferred.
+	leader.mu.Lock()
+	leader.transferee = 2
+	leader.mu.Unlock()
+	if _, err := leader.LeaseRead(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected lease read to need a heartbeat round, got %v", err)
+	}
+
+	leader.mu.Lock()
+	leader.transferee = 0
+	leader.cluster[1].lastContact = time.Now().Add(-time.Minute)
+	leader.mu.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := leader.LeaseRead(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected expired lease to need a heartbeat round, got %v", err)
+	}
+}
+
+func Test_commit_only_checked_entries(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	s.currentTerm = 3
+	// Entries 3 and 4 are left over from a deposed leader in term 2.
+	s.log = append(s.log,
+		Entry{Term: 1, Command: []byte("a")},
+		Entry{Term: 1, Command: []byte("b")},
+		Entry{Term: 2, Command: []byte("stale")},
+		Entry{Term: 2, Command: []byte("stale")},
+	)
+	s.persist(true, 4)
+	s.mu.Unlock()
+
+	// A heartbeat that only checks the log up to index 2 must not
+	// commit the entries after it.
+	var rsp AppendEntriesResponse
+	s.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage:   RPCMessage{Term: 3},
+		LeaderId:     2,
+		PrevLogIndex: 2,
+		PrevLogTerm:  1,
+		LeaderCommit: 4,
+	}, &rsp)
+
+	if !rsp.Success || s.commitIndex != 2 {
+		t.Errorf("Expected commit index 2, got %d (success %t)", s.commitIndex, rsp.Success)
+	}
+}
+
+func Test_learner(t *testing.T) {
+	s := newTestServer(t, t.TempDir(), &testStateMachine{})
+	s.mu.Lock()
+	s.state = leaderState
+	s.currentTerm = 1
+	s.mu.Unlock()
+
+	lastLogIndex := func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.lastLogIndex()
+	}
+
+	// The learner isn't part of the quorum, so the leader commits
+	// adding it, and everything after, on its own.
+	done := make(chan error)
+	go func() { done <- s.AddLearner(2, ":3031", 0) }()
+	waitFor(t, "configuration entry", func() bool { return lastLogIndex() == 1 })
+	s.advanceCommitIndex()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	s.mu.Lock()
+	for i := 0; i < PROMOTE_MAX_LAG+10; i++ {
+		s.log = append(s.log, Entry{Term: 1, Command: []byte("x")})
+	}
+	s.persist(true, PROMOTE_MAX_LAG+10)
+	s.mu.Unlock()
+
+	s.advanceCommitIndex()
+	if s.commitIndex != lastLogIndex() {
+		t.Fatalf("Expected leader to commit without the learner, commit index %d", s.commitIndex)
+	}
+
+	if err := s.PromoteLearner(2); err != ErrLearnerBehind {
+		t.Fatalf("Expected ErrLearnerBehind, got %v", err)
+	}
+	if err := s.TransferLeadership(2); err != ErrNotVoter {
+		t.Fatalf("Expected ErrNotVoter, got %v", err)
+	}
+
+	s.mu.Lock()
+	s.cluster[s.memberIndex(2)].matchIndex = s.lastLogIndex() - 5
+	s.mu.Unlock()
+
+	go func() { done <- s.PromoteLearner(2) }()
+	waitFor(t, "promotion entry", func() bool { return lastLogIndex() == PROMOTE_MAX_LAG+12 })
+
+	// Promotion itself still only needs the old voters.
+	s.advanceCommitIndex()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if members := s.Members(); members[1].Role != Voter || s.quorum() != 2 {
+		t.Fatalf("Expected node 2 to be a voter, got %v", members)
+	}
+}
+
+func Test_learner_does_not_vote(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	config := []ClusterMember{
+		{Id: 1, Address: "127.0.0.1:1"},
+		{Id: 2, Address: "127.0.0.1:2"},
+		{Id: 3, Address: "127.0.0.1:3", Role: Learner},
+	}
+	for _, s := range servers {
+		s.mu.Lock()
+		s.setConfiguration(0, config)
+		s.mu.Unlock()
+	}
+	candidate, learner := servers[0], servers[2]
+
+	var rsp RequestVoteResponse
+	learner.HandleRequestVoteRequest(RequestVoteRequest{
+		RPCMessage:  RPCMessage{Term: 1},
+		CandidateId: 1,
+	}, &rsp)
+	if rsp.VoteGranted {
+		t.Error("Expected learner to refuse to vote")
+	}
+
+	// A learner never campaigns.
+	learner.mu.Lock()
+	learner.electionTimeout = time.Now().Add(-time.Millisecond)
+	learner.mu.Unlock()
+	learner.timeout()
+	if learner.state != followerState || learner.currentTerm != 0 {
+		t.Errorf("Expected learner to stay a follower, got %s in term %d", learner.state, learner.currentTerm)
+	}
+
+	// A vote from a learner doesn't count towards a majority.
+	candidate.mu.Lock()
+	candidate.startElection()
+	candidate.cluster[2].votedFor = 1
+	candidate.mu.Unlock()
+	candidate.becomeLeader()
+	if candidate.IsLeader() {
+		t.Error("Expected learner's vote not to count")
+	}
+}
+
+func Test_fast_backtracking(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	leader, diverged, behind := servers[0], servers[1], servers[2]
+
+	appendTerms := func(s *Server, term uint64, n int) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i := 0; i < n; i++ {
+			s.log = append(s.log, Entry{Term: term, Command: []byte("x")})
+		}
+		s.persist(true, n)
+	}
+
+	// The logs agree on the first five entries. After that the leader
+	// has 100 entries from term 3 and one follower 100 from term 2,
+	// while the other follower stopped at index 3.
+	appendTerms(leader, 1, 5)
+	appendTerms(leader, 3, 100)
+	appendTerms(diverged, 1, 5)
+	appendTerms(diverged, 2, 100)
+	appendTerms(behind, 1, 3)
+	leader.currentTerm = 4
+
+	for _, follower := range []*Server{diverged, behind} {
+		next := leader.lastLogIndex() + 1
+		rejections := 0
+		for {
+			req := AppendEntriesRequest{
+				RPCMessage:   RPCMessage{Term: leader.currentTerm},
+				LeaderId:     leader.id,
+				PrevLogIndex: next - 1,
+				PrevLogTerm:  leader.termAt(next - 1),
+				Entries:      leader.log[leader.entryIndex(next):],
+			}
+			var rsp AppendEntriesResponse
+			follower.HandleAppendEntriesRequest(req, &rsp)
+			if rsp.Success {
+				break
+			}
+
+			rejections++
+			if rejections > 1 {
+				t.Fatalf("Expected node %d to need one rejection, still backing off at index %d", follower.id, next)
+			}
+			next = leader.nextIndexAfterReject(req, rsp)
+		}
+
+		if follower.lastLogIndex() != leader.lastLogIndex() || follower.termAt(follower.lastLogIndex()) != 3 {
+			t.Errorf("Expected node %d to match the leader's log, last index %d", follower.id, follower.lastLogIndex())
+		}
+	}
+}
+
+// blockingTransport holds every AppendEntries until it is released,
+// then delivers it straight to the follower.
+type blockingTransport struct {
+	Transport
+	follower RPCHandler
+	sent     chan AppendEntriesRequest
+	release  chan struct{}
+}
+
+func (t *blockingTransport) AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	t.sent <- req
+	<-t.release
+	return t.follower.HandleAppendEntriesRequest(req, rsp)
+}
+
+func Test_pipelined_append_entries(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	leader, follower := servers[0], servers[1]
+	transport := &blockingTransport{
+		Transport: leader.Transport,
+		follower:  follower,
+		sent:      make(chan AppendEntriesRequest, 100),
+		release:   make(chan struct{}),
+	}
+	leader.Transport = transport
+
+	leader.mu.Lock()
+	leader.state = leaderState
+	leader.currentTerm = 1
+	leader.log = append(leader.log, Entry{Term: 1, Command: []byte("a")})
+	leader.persist(true, 1)
+	leader.cluster[1].nextIndex = 1
+	leader.mu.Unlock()
+
+	sendAppendEntries := func(times int) {
+		for i := 0; i < times; i++ {
+			leader.mu.Lock()
+			leader.appendEntries()
+			leader.mu.Unlock()
+		}
+	}
+	countSent := func() int {
+		n := 0
+		for {
+			select {
+			case <-transport.sent:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+	matchIndex := func() uint64 {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.cluster[1].matchIndex
+	}
+
+	// Until the follower has accepted something, the leader probes
+	// with one request at a time.
+	sendAppendEntries(3)
+	if n := countSent(); n != 1 {
+		t.Fatalf("Expected a single probe in flight, got %d", n)
+	}
+	transport.release <- struct{}{}
+	waitFor(t, "probe to succeed", func() bool { return matchIndex() == 1 })
+
+	leader.mu.Lock()
+	for i := 0; i < 3; i++ {
+		leader.log = append(leader.log, Entry{Term: 1, Command: []byte("b")})
+	}
+	leader.persist(true, 3)
+	leader.mu.Unlock()
+
+	// Now the leader keeps sending without waiting for answers, up to
+	// the limit.
+	sendAppendEntries(MAX_INFLIGHT_APPEND_ENTRIES + 2)
+	if n := countSent(); n != MAX_INFLIGHT_APPEND_ENTRIES {
+		t.Fatalf("Expected %d requests in flight, got %d", MAX_INFLIGHT_APPEND_ENTRIES, n)
+	}
+
+	close(transport.release)
+	waitFor(t, "follower to catch up", func() bool {
+		sendAppendEntries(1)
+		return matchIndex() == 4
+	})
+	if follower.lastLogIndex() != 4 {
+		t.Errorf("Expected follower to have 4 entries, got %d", follower.lastLogIndex())
+	}
+}
+
+func Test_apply_context(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	leader := servers[0]
+	leader.mu.Lock()
+	leader.state = leaderState
+	leader.currentTerm = 1
+	leader.mu.Unlock()
+
+	// Without the other server nothing commits.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := leader.ApplyContext(ctx, [][]byte{[]byte("a")}); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	type applied struct {
+		results []ApplyResult
+		err     error
+	}
+	done := make(chan applied)
+	go func() {
+		results, err := leader.Apply([][]byte{[]byte("b")})
+		done <- applied{results, err}
+	}()
+	waitFor(t, "entry", func() bool {
+		leader.mu.Lock()
+		defer leader.mu.Unlock()
+		return leader.lastLogIndex() == 2
+	})
+
+	// A new leader overwrites both entries.
+	var rsp AppendEntriesResponse
+	leader.HandleAppendEntriesRequest(AppendEntriesRequest{
+		RPCMessage: RPCMessage{Term: 2},
+		LeaderId:   2,
+		Entries:    []Entry{{Term: 2, Command: []byte("c")}},
+	}, &rsp)
+
+	select {
+	case a := <-done:
+		if a.err != nil || a.results[0].Error != ErrLeadershipLost {
+			t.Errorf("Expected ErrLeadershipLost, got %v (%v)", a.results, a.err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Apply still blocked after the leader stepped down")
+	}
+}
@@ -0,0 +1,143 @@
+package goraft
+
+import (
+	"context"
+	"time"
+)
+
+// Reads are served by the leader without going through the log. The
+// leader records its commit index as the read index, confirms it is
+// still leader by hearing from a majority, and then waits until the
+// state machine has applied the read index. Anything committed before
+// the read started is then visible to it.
+
+const READ_POLL_INTERVAL = 5 * time.Millisecond
+
+// ReadIndex returns once the state machine reflects every command
+// committed before the call, so a subsequent read of it is
+// linearizable. It must be called on the leader. The returned index
+// is the log index the read is served at.
+func (s *Server) ReadIndex(ctx context.Context) (uint64, error) {
+	return s.readIndex(ctx, false)
+}
+
+// LeaseRead is like ReadIndex but skips the round of heartbeats while
+// the leader holds a lease: a majority acknowledged it recently enough
+// that no other leader can have been elected since. This relies on
+// clocks on the servers running at roughly the same rate.
+func (s *Server) LeaseRead(ctx context.Context) (uint64, error) {
+	return s.readIndex(ctx, true)
+}
+
+func (s *Server) readIndex(ctx context.Context, useLease bool) (uint64, error) {
+	s.mu.Lock()
+	if s.state != leaderState {
+		s.mu.Unlock()
+		return 0, ErrApplyToLeader
+	}
+	term := s.currentTerm
+	s.mu.Unlock()
+
+	stillLeader := true
+	isLeader := func() bool {
+		stillLeader = s.state == leaderState && s.currentTerm == term
+		return stillLeader
+	}
+
+	// A new leader only learns which entries are committed once an
+	// entry from its own term (the no-op it appends) is committed.
+	err := s.waitUntil(ctx, func() bool {
+		return !isLeader() || s.termAt(s.commitIndex) == term
+	})
+	if err != nil {
+		return 0, err
+	} else if !stillLeader {
+		return 0, ErrApplyToLeader
+	}
+
+	s.mu.Lock()
+	readIndex := s.commitIndex
+	confirmed := useLease && s.leaseValid()
+	start := s.now()
+	if !confirmed {
+		s.appendEntries()
+	}
+	s.mu.Unlock()
+
+	if !confirmed {
+		err = s.waitUntil(ctx, func() bool {
+			return !isLeader() || s.countContactedSince(start) >= s.quorum()
+		})
+		if err != nil {
+			return 0, err
+		} else if !stillLeader {
+			return 0, ErrApplyToLeader
+		}
+	}
+
+	err = s.waitUntil(ctx, func() bool {
+		return s.lastApplied >= readIndex
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return readIndex, nil
+}
+
+// waitUntil polls cond, which is called with the lock held, until it
+// returns true or ctx is done.
+func (s *Server) waitUntil(ctx context.Context, cond func() bool) error {
+	ticker := time.NewTicker(READ_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		s.mu.Lock()
+		ok := cond()
+		done := s.done
+		s.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+		if done {
+			return ErrStopped
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// countContactedSince counts this server plus every voter that has
+// answered a request sent at or after t.
+func (s *Server) countContactedSince(t time.Time) int {
+	n := 0
+	for i := range s.cluster {
+		if !s.cluster[i].voter() {
+			continue
+		}
+		if i == s.clusterIndex || !s.cluster[i].lastContact.Before(t) {
+			n++
+		}
+	}
+	return n
+}
+
+// leaseValid reports whether a majority answered requests sent within
+// the lease period. Followers that heard from us refuse to pre-vote
+// for anyone else until the minimum election timeout has passed, so
+// no new leader can exist until then. The lease is a little shorter
+// than that to allow for clock drift.
+func (s *Server) leaseValid() bool {
+	// Votes for the target of a leadership transfer skip the pre-vote.
+	if s.transferee != 0 {
+		return false
+	}
+
+	lease := s.config.ElectionTimeoutMin * 9 / 10
+	return s.countContactedSince(s.now().Add(-lease)) >= s.quorum()
+}
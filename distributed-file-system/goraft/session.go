@@ -0,0 +1,325 @@
+package goraft
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Client sessions make commands exactly-once. A client registers
+// once, then tags each command with its client id and a sequence
+// number that increases with every new command. A retry reuses the
+// sequence number, and if the original was already applied the
+// cached result is returned instead of applying it again.
+//
+// The session table is part of the replicated state, so it lives in
+// a wrapper around the state machine and is saved in its snapshots.
+// Sessions expire by the leader timestamps recorded in the log rather
+// than by local clocks, so every server expires them at the same
+// point in the log.
+
+var ErrSessionExpired = errors.New("Client session expired or was never registered")
+var ErrResultDiscarded = errors.New("Command is too old; its result is no longer kept")
+
+// A session is dropped after this long without a command.
+const SESSION_TIMEOUT = time.Hour
+
+// Results are kept for the latest this many sequence numbers of each
+// session, which bounds how far behind a retry may be.
+const SESSION_MAX_RESULTS = 128
+
+type sessionStateMachine struct {
+	StateMachine
+	// Set if the wrapped state machine is one.
+	durable DurableStateMachine
+
+	sessions map[uint64]*clientSession
+	// The latest leader timestamp applied, in Unix nanoseconds.
+	clock int64
+	// Set while catching the session table up to a durable state
+	// machine, which already holds the effects of the commands; see
+	// resume.
+	replaying bool
+}
+
+type clientSession struct {
+	LastActive   int64
+	LastSequence uint64
+	Results      map[uint64]sessionResult
+}
+
+type sessionResult struct {
+	Result []byte
+	Error  string `json:",omitempty"`
+	// The command was applied before a restart that didn't replay it,
+	// so its result isn't known.
+	Discarded bool `json:",omitempty"`
+}
+
+func newSessionStateMachine(sm StateMachine) *sessionStateMachine {
+	durable, _ := sm.(DurableStateMachine)
+	return &sessionStateMachine{
+		StateMachine: sm,
+		durable:      durable,
+		sessions:     map[uint64]*clientSession{},
+	}
+}
+
+// apply applies cmd, the command of the entry at index, passing the
+// index on to a durable state machine.
+func (sm *sessionStateMachine) apply(index uint64, cmd []byte) ([]byte, error) {
+	if sm.durable != nil {
+		return sm.durable.ApplyIndex(index, cmd)
+	}
+	return sm.Apply(cmd)
+}
+
+// flush makes what a durable state machine recorded since the last
+// call durable.
+func (sm *sessionStateMachine) flush() error {
+	if sm.durable != nil {
+		return sm.durable.Flush()
+	}
+	return nil
+}
+
+// A session command is prefixed by its client id, sequence number and
+// the leader's clock when it was proposed. A registration holds only
+// the timestamp.
+const SESSION_HEADER = 24
+
+func encodeSessionCommand(clientId, sequence uint64, now time.Time, command []byte) []byte {
+	b := make([]byte, SESSION_HEADER, SESSION_HEADER+len(command))
+	binary.LittleEndian.PutUint64(b[:8], clientId)
+	binary.LittleEndian.PutUint64(b[8:16], sequence)
+	binary.LittleEndian.PutUint64(b[16:24], uint64(now.UnixNano()))
+	return append(b, command...)
+}
+
+func encodeRegistration(now time.Time) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(now.UnixNano()))
+	return b[:]
+}
+
+// applySession applies a RegisterClientEntry or SessionCommandEntry
+// committed at index.
+func (sm *sessionStateMachine) applySession(index uint64, entry Entry) ApplyResult {
+	if entry.Kind == RegisterClientEntry {
+		sm.advanceClock(int64(binary.LittleEndian.Uint64(entry.Command)))
+		return sm.register(index)
+	}
+
+	clientId := binary.LittleEndian.Uint64(entry.Command[:8])
+	sequence := binary.LittleEndian.Uint64(entry.Command[8:16])
+	sm.advanceClock(int64(binary.LittleEndian.Uint64(entry.Command[16:24])))
+
+	session, ok := sm.sessions[clientId]
+	if !ok || sm.expired(session) {
+		delete(sm.sessions, clientId)
+		return ApplyResult{Error: ErrSessionExpired}
+	}
+	session.LastActive = sm.clock
+
+	if r, ok := session.Results[sequence]; ok {
+		return r.applyResult()
+	}
+	if sequence+SESSION_MAX_RESULTS <= session.LastSequence {
+		return ApplyResult{Error: ErrResultDiscarded}
+	}
+
+	var res []byte
+	var err error
+	r := sessionResult{Discarded: sm.replaying}
+	if !sm.replaying {
+		res, err = sm.apply(index, entry.Command[SESSION_HEADER:])
+		r.Result = res
+		if err != nil {
+			r.Error = err.Error()
+		}
+	}
+
+	session.Results[sequence] = r
+	session.LastSequence = max(session.LastSequence, sequence)
+	for seq := range session.Results {
+		if seq+SESSION_MAX_RESULTS <= session.LastSequence {
+			delete(session.Results, seq)
+		}
+	}
+
+	return ApplyResult{Result: res, Error: err}
+}
+
+// register opens a session whose client id is the index of its
+// registration entry, and drops every expired session.
+func (sm *sessionStateMachine) register(index uint64) ApplyResult {
+	for id, session := range sm.sessions {
+		if sm.expired(session) {
+			delete(sm.sessions, id)
+		}
+	}
+
+	sm.sessions[index] = &clientSession{
+		LastActive: sm.clock,
+		Results:    map[uint64]sessionResult{},
+	}
+
+	var id [8]byte
+	binary.LittleEndian.PutUint64(id[:], index)
+	return ApplyResult{Result: id[:]}
+}
+
+func (sm *sessionStateMachine) advanceClock(now int64) {
+	// A new leader's clock may be behind the last one's.
+	sm.clock = max(sm.clock, now)
+}
+
+func (sm *sessionStateMachine) expired(session *clientSession) bool {
+	return sm.clock-session.LastActive > int64(SESSION_TIMEOUT)
+}
+
+func (r sessionResult) applyResult() ApplyResult {
+	if r.Discarded {
+		return ApplyResult{Error: ErrResultDiscarded}
+	}
+	if r.Error != "" {
+		return ApplyResult{Result: r.Result, Error: errors.New(r.Error)}
+	}
+	return ApplyResult{Result: r.Result}
+}
+
+// Snapshots taken before sessions existed hold only the state
+// machine's data and lack this prefix.
+const SESSION_SNAPSHOT_MAGIC = "goraft-sessions\x00"
+
+type sessionSnapshot struct {
+	Clock    int64
+	Sessions map[uint64]*clientSession
+}
+
+// Snapshot prefixes the wrapped state machine's snapshot with a magic
+// string and the length and encoding of the session table.
+func (sm *sessionStateMachine) Snapshot() ([]byte, error) {
+	data, err := sm.StateMachine.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := json.Marshal(sessionSnapshot{Clock: sm.clock, Sessions: sm.sessions})
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 0, len(SESSION_SNAPSHOT_MAGIC)+8+len(sessions)+len(data))
+	b = append(b, SESSION_SNAPSHOT_MAGIC...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(sessions)))
+	b = append(b, sessions...)
+	return append(b, data...), nil
+}
+
+func (sm *sessionStateMachine) Restore(snapshot []byte) error {
+	snap, data, err := decodeSessionSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := sm.StateMachine.Restore(data); err != nil {
+		return err
+	}
+	sm.setSessions(snap)
+	return nil
+}
+
+// restore is Restore for a snapshot taken at index, which a durable
+// state machine records as applied.
+func (sm *sessionStateMachine) restore(index uint64, snapshot []byte) error {
+	if sm.durable == nil {
+		return sm.Restore(snapshot)
+	}
+
+	snap, data, err := decodeSessionSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := sm.durable.RestoreIndex(index, data); err != nil {
+		return err
+	}
+	sm.setSessions(snap)
+	return nil
+}
+
+// restoreSessions loads only the session table from a snapshot.
+func (sm *sessionStateMachine) restoreSessions(snapshot []byte) error {
+	snap, _, err := decodeSessionSnapshot(snapshot)
+	if err != nil {
+		return err
+	}
+	sm.setSessions(snap)
+	return nil
+}
+
+// decodeSessionSnapshot splits a snapshot into the session table and
+// the wrapped state machine's data.
+func decodeSessionSnapshot(snapshot []byte) (sessionSnapshot, []byte, error) {
+	var snap sessionSnapshot
+	if !bytes.HasPrefix(snapshot, []byte(SESSION_SNAPSHOT_MAGIC)) {
+		return snap, snapshot, nil
+	}
+
+	snapshot = snapshot[len(SESSION_SNAPSHOT_MAGIC):]
+	if len(snapshot) < 8 {
+		return snap, nil, errors.New("Snapshot too short for session table")
+	}
+
+	n := binary.LittleEndian.Uint64(snapshot[:8])
+	if uint64(len(snapshot)-8) < n {
+		return snap, nil, errors.New("Snapshot too short for session table")
+	}
+	if err := json.Unmarshal(snapshot[8:8+n], &snap); err != nil {
+		return snap, nil, err
+	}
+	return snap, snapshot[8+n:], nil
+}
+
+func (sm *sessionStateMachine) setSessions(snap sessionSnapshot) {
+	sm.clock = snap.Clock
+	sm.sessions = snap.Sessions
+	if sm.sessions == nil {
+		sm.sessions = map[uint64]*clientSession{}
+	}
+	for _, session := range sm.sessions {
+		if session.Results == nil {
+			session.Results = map[uint64]sessionResult{}
+		}
+	}
+}
+
+// RegisterClient opens a client session through the log and returns
+// its client id. It must be called on the leader.
+func (s *Server) RegisterClient(ctx context.Context) (uint64, error) {
+	results, err := s.apply(ctx, RegisterClientEntry, [][]byte{encodeRegistration(s.now())})
+	if err != nil {
+		return 0, err
+	} else if results[0].Error != nil {
+		return 0, results[0].Error
+	}
+	return binary.LittleEndian.Uint64(results[0].Result), nil
+}
+
+// ApplySession is like ApplyContext, but exactly-once within the session
+// clientId. The commands are numbered sequence, sequence+1, and so on.
+// Each new command must get a higher number than any before it, and a
+// retry must reuse the number of the command it repeats. A command
+// whose number was already applied is not applied again; its result
+// is the one recorded the first time.
+func (s *Server) ApplySession(ctx context.Context, clientId, sequence uint64, commands [][]byte) ([]ApplyResult, error) {
+	now := s.now()
+	encoded := make([][]byte, len(commands))
+	for i, command := range commands {
+		encoded[i] = encodeSessionCommand(clientId, sequence+uint64(i), now, command)
+	}
+
+	return s.apply(ctx, SessionCommandEntry, encoded)
+}
@@ -0,0 +1,115 @@
+package goraft
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func Test_session_exactly_once(t *testing.T) {
+	sm := &testStateMachine{}
+	s := newTestServer(t, t.TempDir(), sm)
+	s.mu.Lock()
+	s.state = leaderState
+	s.currentTerm = 1
+	s.mu.Unlock()
+
+	lastLogIndex := func() uint64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.lastLogIndex()
+	}
+
+	// A single-member cluster commits each entry as soon as
+	// advanceCommitIndex runs.
+	commit := func(apply func()) {
+		done := make(chan struct{})
+		index := lastLogIndex()
+		go func() {
+			apply()
+			close(done)
+		}()
+		waitFor(t, "entry", func() bool { return lastLogIndex() > index })
+		s.advanceCommitIndex()
+		<-done
+	}
+
+	var clientId uint64
+	var err error
+	commit(func() { clientId, err = s.RegisterClient(context.Background()) })
+	if err != nil || clientId != 1 {
+		t.Fatalf("Expected client id 1, got %d (%v)", clientId, err)
+	}
+
+	var results []ApplyResult
+	for i := 0; i < 2; i++ {
+		// The second call is a retry of the first.
+		commit(func() {
+			results, err = s.ApplySession(context.Background(), clientId, 1, [][]byte{[]byte("a"), []byte("b")})
+		})
+		if err != nil || len(results) != 2 || string(results[1].Result) != "b" {
+			t.Fatalf("Expected results a and b, got %v (%v)", results, err)
+		}
+	}
+	if len(sm.applied) != 2 {
+		t.Fatalf("Expected retried commands to be applied once, got %v", sm.applied)
+	}
+
+	commit(func() { results, err = s.ApplySession(context.Background(), clientId+1, 1, [][]byte{[]byte("c")}) })
+	if err != nil || results[0].Error != ErrSessionExpired {
+		t.Errorf("Expected ErrSessionExpired for an unknown client, got %v", results[0].Error)
+	}
+
+	// The session table survives a snapshot.
+	s.mu.Lock()
+	data, err := s.statemachine.Snapshot()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newSessionStateMachine(&testStateMachine{})
+	if err := restored.Restore(data); err != nil {
+		t.Fatal(err)
+	}
+	res := restored.applySession(10, Entry{
+		Kind:    SessionCommandEntry,
+		Command: encodeSessionCommand(clientId, 2, time.Now(), []byte("b")),
+	})
+	if string(res.Result) != "b" || len(restored.StateMachine.(*testStateMachine).applied) != 2 {
+		t.Errorf("Expected restored session to return the cached result, got %v", res)
+	}
+}
+
+func Test_session_expiry(t *testing.T) {
+	sm := newSessionStateMachine(&testStateMachine{})
+	start := time.Now()
+
+	apply := func(at time.Time, clientId, sequence uint64) ApplyResult {
+		return sm.applySession(0, Entry{
+			Kind:    SessionCommandEntry,
+			Command: encodeSessionCommand(clientId, sequence, at, []byte("x")),
+		})
+	}
+
+	sm.applySession(1, Entry{Kind: RegisterClientEntry, Command: encodeRegistration(start)})
+	if res := apply(start.Add(SESSION_TIMEOUT/2), 1, 1); res.Error != nil {
+		t.Fatalf("Expected command to apply, got %v", res.Error)
+	}
+
+	// A later leader whose clock is behind doesn't move time backwards.
+	if res := apply(start, 1, 2); res.Error != nil {
+		t.Fatalf("Expected command to apply, got %v", res.Error)
+	}
+
+	for sequence := uint64(3); sequence < SESSION_MAX_RESULTS+3; sequence++ {
+		apply(start.Add(SESSION_TIMEOUT/2), 1, sequence)
+	}
+	if res := apply(start.Add(SESSION_TIMEOUT/2), 1, 2); res.Error != ErrResultDiscarded {
+		t.Errorf("Expected ErrResultDiscarded for an old retry, got %v", res.Error)
+	}
+
+	if res := apply(start.Add(2*SESSION_TIMEOUT), 1, 1000); res.Error != ErrSessionExpired {
+		t.Errorf("Expected ErrSessionExpired after the timeout, got %v", res.Error)
+	}
+}
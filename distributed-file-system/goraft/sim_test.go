@@ -0,0 +1,792 @@
+package goraft
+
+import (
+	"container/heap"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The simulation runs a whole cluster on a fake clock and network
+// inside the test. Server goroutines are started through the spawn
+// hook, and the simulation waits until each one has finished or is
+// blocked on the network before doing anything else. Only one
+// goroutine ever makes progress at a time, so a seed always produces
+// the same run, and a failure can be replayed with -sim.seed.
+//
+// A normal run simulates a few thousand seeds, and -short a few
+// hundred. For a longer soak:
+//
+//	go test ./goraft -run Test_sim -sim.seeds=20000
+
+var simSeeds = flag.Int("sim.seeds", 2000, "Number of random schedules to simulate")
+var simSeed = flag.Int64("sim.seed", 0, "Simulate only this seed")
+
+var errSimUnreachable = errors.New("simulated network failure")
+
+const (
+	SIM_DURATION     = 10 * time.Second
+	SIM_SETTLE       = 10 * time.Second
+	SIM_TICK         = 10 * time.Millisecond
+	SIM_RPC_TIMEOUT  = 100 * time.Millisecond
+	SIM_MAX_DELAY    = 20 * time.Millisecond
+	SIM_LONG_DELAY   = time.Second
+	SIM_FAULT_PERIOD = 250 * time.Millisecond
+)
+
+type simEvent struct {
+	at  time.Time
+	seq int
+	run func()
+}
+
+type simQueue []*simEvent
+
+func (q simQueue) Len() int { return len(q) }
+func (q simQueue) Less(i, j int) bool {
+	return q[i].at.Before(q[j].at) || (q[i].at.Equal(q[j].at) && q[i].seq < q[j].seq)
+}
+func (q simQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x any)   { *q = append(*q, x.(*simEvent)) }
+func (q *simQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type simNode struct {
+	id     uint64
+	dir    string
+	server *Server
+	sm     *simStateMachine
+	up     bool
+	// Closed when this incarnation of the node crashes. Goroutines
+	// blocked on the network then exit without touching the server.
+	crashed chan struct{}
+	// Goroutines of this incarnation blocked on the network.
+	parked int
+}
+
+// A call is an RPC in flight from one node to another.
+type simCall struct {
+	from    *simNode
+	crashed chan struct{}
+	reply   chan error
+	done    bool
+}
+
+type sim struct {
+	rand    *rand.Rand
+	now     time.Time
+	seq     int
+	events  simQueue
+	cluster []ClusterMember
+	nodes   []*simNode
+
+	// Faults
+	dropRate  float64
+	dupRate   float64
+	partition map[uint64]int
+	faults    bool
+
+	// Guards the fields below, which goroutines started by servers
+	// touch as well.
+	mu      sync.Mutex
+	quiet   *sync.Cond
+	running int
+	tasks   []func()
+
+	leaders     map[uint64]uint64
+	committed   []string
+	nextCommand int
+	trace       []string
+	failure     string
+}
+
+func newSim(t *testing.T, seed int64, n int) *sim {
+	sim := &sim{
+		rand:      rand.New(rand.NewSource(seed)),
+		now:       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		partition: map[uint64]int{},
+		leaders:   map[uint64]uint64{},
+		faults:    true,
+	}
+	sim.quiet = sync.NewCond(&sim.mu)
+	sim.dropRate = sim.rand.Float64() * 0.1
+	sim.dupRate = sim.rand.Float64() * 0.05
+
+	for i := 0; i < n; i++ {
+		id := uint64(i + 1)
+		sim.cluster = append(sim.cluster, ClusterMember{Id: id, Address: fmt.Sprintf("node%d", id)})
+		sim.nodes = append(sim.nodes, &simNode{id: id, dir: t.TempDir()})
+	}
+
+	for _, node := range sim.nodes {
+		sim.start(node)
+	}
+
+	return sim
+}
+
+func (sim *sim) node(id uint64) *simNode {
+	return sim.nodes[id-1]
+}
+
+func (sim *sim) schedule(after time.Duration, run func()) {
+	sim.seq++
+	heap.Push(&sim.events, &simEvent{at: sim.now.Add(after), seq: sim.seq, run: run})
+}
+
+func (sim *sim) randDuration(max time.Duration) time.Duration {
+	return time.Duration(sim.rand.Int63n(int64(max)))
+}
+
+func (sim *sim) tracef(msg string, args ...any) {
+	sim.trace = append(sim.trace, sim.now.Format("05.000")+" "+fmt.Sprintf(msg, args...))
+}
+
+func (sim *sim) fail(msg string, args ...any) {
+	if sim.failure == "" {
+		sim.failure = fmt.Sprintf(msg, args...)
+	}
+}
+
+// Scheduling
+
+func (sim *sim) spawn(crashed chan struct{}, f func()) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	sim.tasks = append(sim.tasks, func() {
+		select {
+		case <-crashed:
+		default:
+			f()
+		}
+	})
+}
+
+// settle runs spawned goroutines one at a time until none are left
+// that can make progress.
+func (sim *sim) settle() {
+	sim.wait()
+
+	for {
+		sim.mu.Lock()
+		if len(sim.tasks) == 0 {
+			sim.mu.Unlock()
+			return
+		}
+		f := sim.tasks[0]
+		sim.tasks = sim.tasks[1:]
+		sim.running++
+		sim.mu.Unlock()
+
+		go func() {
+			defer sim.exited()
+			f()
+		}()
+		sim.wait()
+	}
+}
+
+func (sim *sim) wait() {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	for sim.running > 0 {
+		sim.quiet.Wait()
+	}
+}
+
+func (sim *sim) exited() {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.running--
+	sim.quiet.Broadcast()
+}
+
+// Network
+
+type simTransport struct {
+	sim     *sim
+	node    *simNode
+	crashed chan struct{}
+}
+
+func (t *simTransport) Listen(address string, handler RPCHandler) error { return nil }
+func (t *simTransport) ClosePeer(id uint64, address string)             {}
+func (t *simTransport) Close() error                                    { return nil }
+
+// call sends a request and parks the calling goroutine until the
+// simulation delivers a response or gives up on it. deliver runs the
+// handler on the receiver and returns a function that copies the
+// response back to the caller.
+func (t *simTransport) call(to uint64, deliver func(RPCHandler) (func(), error)) error {
+	sim := t.sim
+	call := &simCall{from: t.node, crashed: t.crashed, reply: make(chan error, 1)}
+
+	sim.mu.Lock()
+	sim.send(call, to, deliver)
+	t.node.parked++
+	sim.running--
+	sim.quiet.Broadcast()
+	sim.mu.Unlock()
+
+	select {
+	case err := <-call.reply:
+		return err
+	case <-t.crashed:
+		runtime.Goexit()
+		return nil
+	}
+}
+
+// sleep parks the calling goroutine for d of simulated time, the way
+// call parks it until a response arrives.
+func (sim *sim) sleep(node *simNode, crashed chan struct{}, d time.Duration) {
+	wake := make(chan struct{})
+
+	sim.mu.Lock()
+	sim.schedule(d, func() {
+		select {
+		case <-crashed:
+			return
+		default:
+		}
+
+		sim.mu.Lock()
+		node.parked--
+		sim.running++
+		sim.mu.Unlock()
+		close(wake)
+	})
+	node.parked++
+	sim.running--
+	sim.quiet.Broadcast()
+	sim.mu.Unlock()
+
+	select {
+	case <-wake:
+	case <-crashed:
+		runtime.Goexit()
+	}
+}
+
+// delay picks how long a message takes to arrive. A few messages are
+// held up long enough to arrive after an election or two.
+func (sim *sim) delay() time.Duration {
+	if sim.rand.Float64() < 0.02 {
+		return sim.randDuration(SIM_LONG_DELAY)
+	}
+	return sim.randDuration(SIM_MAX_DELAY)
+}
+
+func (sim *sim) connected(a, b uint64) bool {
+	return sim.partition[a] == sim.partition[b]
+}
+
+// send is called with sim.mu held.
+func (sim *sim) send(call *simCall, to uint64, deliver func(RPCHandler) (func(), error)) {
+	from := call.from.id
+	if sim.rand.Float64() < sim.dropRate {
+		sim.schedule(SIM_RPC_TIMEOUT, func() { sim.resume(call, nil, errSimUnreachable) })
+		return
+	}
+
+	sim.schedule(sim.delay(), func() {
+		sim.deliver(call, from, to, deliver, false)
+	})
+
+	if sim.rand.Float64() < sim.dupRate {
+		sim.schedule(sim.delay(), func() {
+			sim.deliver(call, from, to, deliver, true)
+		})
+	}
+}
+
+func (sim *sim) deliver(call *simCall, from, to uint64, deliver func(RPCHandler) (func(), error), duplicate bool) {
+	dst := sim.node(to)
+	if !dst.up || !sim.connected(from, to) {
+		if !duplicate {
+			sim.schedule(SIM_RPC_TIMEOUT, func() { sim.resume(call, nil, errSimUnreachable) })
+		}
+		return
+	}
+
+	copyResponse, err := deliver(dst.server)
+	if duplicate {
+		return
+	}
+
+	if sim.rand.Float64() < sim.dropRate {
+		sim.schedule(SIM_RPC_TIMEOUT, func() { sim.resume(call, nil, errSimUnreachable) })
+		return
+	}
+
+	sim.schedule(sim.delay(), func() {
+		if !sim.connected(from, to) {
+			copyResponse, err = nil, errSimUnreachable
+		}
+		sim.resume(call, copyResponse, err)
+	})
+}
+
+// resume wakes the goroutine waiting on call, unless its node has
+// crashed since.
+func (sim *sim) resume(call *simCall, copyResponse func(), err error) {
+	select {
+	case <-call.crashed:
+		return
+	default:
+	}
+
+	if call.done {
+		return
+	}
+	call.done = true
+
+	if copyResponse != nil {
+		copyResponse()
+	}
+
+	sim.mu.Lock()
+	call.from.parked--
+	sim.running++
+	sim.mu.Unlock()
+
+	call.reply <- err
+}
+
+func (t *simTransport) RequestVote(id uint64, address string, req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	return t.call(id, func(h RPCHandler) (func(), error) {
+		var r RequestVoteResponse
+		err := h.HandleRequestVoteRequest(req, &r)
+		return func() { *rsp = r }, err
+	})
+}
+
+func (t *simTransport) AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	// Copy the entries now, as encoding them would; the sender's log
+	// may change while the request is in flight.
+	entries := make([]Entry, len(req.Entries))
+	for i, e := range req.Entries {
+		entries[i] = Entry{Command: e.Command, Term: e.Term, Kind: e.Kind}
+	}
+	req.Entries = entries
+
+	return t.call(id, func(h RPCHandler) (func(), error) {
+		var r AppendEntriesResponse
+		err := h.HandleAppendEntriesRequest(req, &r)
+		return func() { *rsp = r }, err
+	})
+}
+
+func (t *simTransport) InstallSnapshot(id uint64, address string, req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	return t.call(id, func(h RPCHandler) (func(), error) {
+		var r InstallSnapshotResponse
+		err := h.HandleInstallSnapshotRequest(req, &r)
+		return func() { *rsp = r }, err
+	})
+}
+
+func (t *simTransport) TimeoutNow(id uint64, address string, req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	return t.call(id, func(h RPCHandler) (func(), error) {
+		var r TimeoutNowResponse
+		err := h.HandleTimeoutNowRequest(req, &r)
+		return func() { *rsp = r }, err
+	})
+}
+
+// Nodes
+
+type simStateMachine struct {
+	sim     *sim
+	id      uint64
+	applied int
+}
+
+func (sm *simStateMachine) Apply(cmd []byte) ([]byte, error) {
+	sim := sm.sim
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	// Every state machine must apply the same commands in the same
+	// order.
+	k := sm.applied
+	if k < len(sim.committed) && sim.committed[k] != string(cmd) {
+		sim.fail("Node %d applied %q as command %d, another node applied %q",
+			sm.id, cmd, k, sim.committed[k])
+	} else if k == len(sim.committed) {
+		sim.committed = append(sim.committed, string(cmd))
+	}
+
+	sm.applied++
+	return nil, nil
+}
+
+func (sm *simStateMachine) Snapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(sm.applied)), nil
+}
+
+func (sm *simStateMachine) Restore(snapshot []byte) error {
+	var err error
+	sm.applied, err = strconv.Atoi(string(snapshot))
+	return err
+}
+
+func (sim *sim) start(node *simNode) {
+	crashed := make(chan struct{})
+	sm := &simStateMachine{sim: sim, id: node.id}
+
+	// A simulated crash kills the server, not the machine, so what it
+	// wrote survives without syncing.
+	s, err := NewServer(sim.cluster, sm, Config{MetadataDir: node.dir, Fsync: FsyncNever}, int(node.id-1))
+	if err != nil {
+		panic(err)
+	}
+	s.Transport = &simTransport{sim: sim, node: node, crashed: crashed}
+	s.now = func() time.Time { return sim.now }
+	s.sleep = func(d time.Duration) { sim.sleep(node, crashed, d) }
+	s.rand = rand.New(rand.NewSource(sim.rand.Int63()))
+	s.spawn = func(f func()) { sim.spawn(crashed, f) }
+
+	// What Start does, without the listener and main loop.
+	s.restore()
+	s.state = followerState
+	s.resetElectionTimeout()
+
+	node.server = s
+	node.sm = sm
+	node.crashed = crashed
+	node.up = true
+
+	var tick func()
+	tick = func() {
+		select {
+		case <-crashed:
+			return
+		default:
+		}
+
+		s.tick()
+		sim.schedule(SIM_TICK+sim.randDuration(SIM_TICK/2), tick)
+	}
+	sim.schedule(sim.randDuration(SIM_TICK), tick)
+}
+
+// crash stops a node as if its process died. Whatever it had synced
+// to disk is all it has when it restarts.
+func (sim *sim) crash(node *simNode) {
+	sim.tracef("node %d crashed", node.id)
+	node.up = false
+
+	sim.mu.Lock()
+	sim.running += node.parked
+	node.parked = 0
+	close(node.crashed)
+	sim.mu.Unlock()
+	sim.wait()
+
+	node.server.Shutdown()
+}
+
+func (sim *sim) restart(node *simNode) {
+	sim.tracef("node %d restarted", node.id)
+	sim.start(node)
+}
+
+// Workload and faults
+
+// propose submits a command to a node that believes it is leader,
+// which may be a stale leader cut off from the rest.
+func (sim *sim) propose() {
+	start := sim.rand.Intn(len(sim.nodes))
+	for i := range sim.nodes {
+		node := sim.nodes[(start+i)%len(sim.nodes)]
+		if node.up && node.server.IsLeader() {
+			sim.proposeTo(node.server)
+			return
+		}
+	}
+}
+
+func (sim *sim) proposeTo(s *Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// What Apply does, without waiting for the result.
+	sim.nextCommand++
+	s.log = append(s.log, Entry{
+		Term:    s.currentTerm,
+		Command: []byte(fmt.Sprintf("cmd %d", sim.nextCommand)),
+	})
+	s.persist(true, 1)
+	s.appendEntries()
+}
+
+func (sim *sim) fault() {
+	if !sim.faults {
+		return
+	}
+
+	switch r := sim.rand.Float64(); {
+	case r < 0.15:
+		node := sim.nodes[sim.rand.Intn(len(sim.nodes))]
+		if !node.up {
+			return
+		}
+		sim.crash(node)
+		sim.schedule(sim.randDuration(2*time.Second), func() {
+			if !node.up {
+				sim.restart(node)
+			}
+		})
+
+	case r < 0.3:
+		for _, node := range sim.nodes {
+			sim.partition[node.id] = sim.rand.Intn(2)
+		}
+		sim.tracef("partitioned %v", sim.partition)
+		sim.schedule(sim.randDuration(3*time.Second), sim.heal)
+
+	case r < 0.35:
+		for _, node := range sim.nodes {
+			if node.up && node.server.IsLeader() {
+				sim.tracef("node %d transferring leadership", node.id)
+				s := node.server
+				s.spawn(func() { s.TransferLeadership(0) })
+				return
+			}
+		}
+	}
+}
+
+func (sim *sim) heal() {
+	for id := range sim.partition {
+		sim.partition[id] = 0
+	}
+}
+
+// Safety checks
+
+// checkElectionSafety verifies there is at most one leader per term.
+func (sim *sim) checkElectionSafety() {
+	for _, node := range sim.nodes {
+		if !node.up {
+			continue
+		}
+
+		s := node.server
+		s.mu.Lock()
+		if s.state == leaderState {
+			leader, ok := sim.leaders[s.currentTerm]
+			if !ok {
+				sim.tracef("node %d leader for term %d", node.id, s.currentTerm)
+				sim.leaders[s.currentTerm] = node.id
+			} else if leader != node.id {
+				sim.fail("Nodes %d and %d are both leader for term %d", leader, node.id, s.currentTerm)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// checkLogMatching verifies that if two logs have an entry with the
+// same index and term, they are identical up to that index.
+func (sim *sim) checkLogMatching() {
+	for _, a := range sim.nodes {
+		for _, b := range sim.nodes {
+			if a.id >= b.id || !a.up || !b.up {
+				continue
+			}
+
+			sa, sb := a.server, b.server
+			sa.mu.Lock()
+			sb.mu.Lock()
+
+			lo := max(sa.snapshotIndex, sb.snapshotIndex) + 1
+			hi := min(sa.lastLogIndex(), sb.lastLogIndex())
+			for i := hi; i >= lo; i-- {
+				if sa.termAt(i) != sb.termAt(i) {
+					continue
+				}
+
+				for j := lo; j <= i; j++ {
+					ea, eb := sa.log[sa.entryIndex(j)], sb.log[sb.entryIndex(j)]
+					if ea.Term != eb.Term || string(ea.Command) != string(eb.Command) {
+						sim.fail("Nodes %d and %d agree on index %d but differ at index %d",
+							a.id, b.id, i, j)
+						break
+					}
+				}
+				break
+			}
+
+			sb.mu.Unlock()
+			sa.mu.Unlock()
+		}
+	}
+}
+
+func (sim *sim) step() {
+	e := heap.Pop(&sim.events).(*simEvent)
+	sim.now = e.at
+	e.run()
+	sim.settle()
+	sim.checkElectionSafety()
+}
+
+func (sim *sim) runFor(d time.Duration) {
+	end := sim.now.Add(d)
+	steps := 0
+	for len(sim.events) > 0 && !sim.events[0].at.After(end) && sim.failure == "" {
+		sim.step()
+
+		steps++
+		if steps%100 == 0 {
+			sim.checkLogMatching()
+		}
+	}
+	sim.now = end
+	sim.checkLogMatching()
+}
+
+// run simulates a random schedule of client commands, crashes and
+// partitions, then lets the cluster recover and checks that every
+// node caught up.
+func (sim *sim) run() {
+	var propose, fault func()
+	propose = func() {
+		if sim.faults {
+			sim.propose()
+			sim.schedule(10*time.Millisecond+sim.randDuration(100*time.Millisecond), propose)
+		}
+	}
+	fault = func() {
+		if sim.faults {
+			sim.fault()
+			sim.schedule(SIM_FAULT_PERIOD, fault)
+		}
+	}
+	sim.schedule(0, propose)
+	sim.schedule(SIM_FAULT_PERIOD, fault)
+
+	sim.runFor(SIM_DURATION)
+	if sim.failure != "" {
+		return
+	}
+
+	sim.faults = false
+	sim.dropRate = 0
+	sim.dupRate = 0
+	sim.heal()
+	for _, node := range sim.nodes {
+		if !node.up {
+			sim.restart(node)
+		}
+	}
+
+	sim.runFor(SIM_SETTLE)
+	if sim.failure != "" {
+		return
+	}
+
+	leaders := 0
+	for _, node := range sim.nodes {
+		if node.server.IsLeader() {
+			leaders++
+		}
+		if node.sm.applied != len(sim.committed) {
+			sim.fail("Node %d applied %d of %d commands after recovering", node.id, node.sm.applied, len(sim.committed))
+		}
+	}
+	if leaders != 1 {
+		sim.fail("Expected one leader after recovering, got %d", leaders)
+	}
+}
+
+func (sim *sim) shutdown() {
+	for _, node := range sim.nodes {
+		if node.up {
+			sim.crash(node)
+		}
+	}
+}
+
+// describe adds the state of every node to the trace.
+func (sim *sim) describe() {
+	for _, node := range sim.nodes {
+		s := node.server
+		s.mu.Lock()
+		sim.tracef("node %d: up %t, %s, term %d, last index %d, commit %d, applied %d",
+			node.id, node.up, s.state, s.currentTerm, s.lastLogIndex(), s.commitIndex, node.sm.applied)
+		if s.state == leaderState {
+			for _, c := range s.cluster {
+				sim.tracef("    node %d: next %d, match %d", c.Id, c.nextIndex, c.matchIndex)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func runSim(t *testing.T, seed int64) *sim {
+	// Odd seeds get a three node cluster, even seeds five.
+	sim := newSim(t, seed, 3+2*int(1-seed%2))
+	sim.run()
+	if sim.failure != "" {
+		sim.describe()
+	}
+	sim.shutdown()
+
+	if sim.failure != "" {
+		for _, line := range sim.trace {
+			t.Log(line)
+		}
+		t.Fatalf("Seed %d: %s", seed, sim.failure)
+	}
+	return sim
+}
+
+func Test_sim(t *testing.T) {
+	if *simSeed != 0 {
+		runSim(t, *simSeed)
+		return
+	}
+
+	seeds := *simSeeds
+	if testing.Short() {
+		seeds = min(seeds, 200)
+	}
+
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		seed := seed
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			runSim(t, seed)
+		})
+	}
+}
+
+func Test_sim_deterministic(t *testing.T) {
+	hash := func(trace []string) uint64 {
+		h := fnv.New64a()
+		for _, line := range trace {
+			h.Write([]byte(line))
+		}
+		return h.Sum64()
+	}
+
+	a := runSim(t, 42)
+	b := runSim(t, 42)
+	if hash(a.trace) != hash(b.trace) || len(a.committed) != len(b.committed) {
+		t.Errorf("Expected the same seed to produce the same run")
+	}
+}
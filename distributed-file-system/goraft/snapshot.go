@@ -0,0 +1,314 @@
+package goraft
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+)
+
+// Once this many applied entries have accumulated since the last
+// snapshot, the state machine is snapshotted and the log truncated.
+const SNAPSHOT_THRESHOLD = 1024
+
+const SNAPSHOT_HEADER = 32
+
+type InstallSnapshotRequest struct {
+	RPCMessage
+	LeaderId          uint64
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Configuration     []byte
+	Data              []byte
+}
+
+type InstallSnapshotResponse struct {
+	RPCMessage
+}
+
+type snapshot struct {
+	index uint64
+	term  uint64
+	// The encoded configuration in effect as of index.
+	configuration []byte
+	data          []byte
+}
+
+func (s *Server) snapshotFile() string {
+	return snapshotFileName(s.id)
+}
+
+func snapshotFileName(id uint64) string {
+	return fmt.Sprintf("snap_%d.dat", id)
+}
+
+// writeSnapshot durably replaces the snapshot file. The new file is
+// written next to the old one and renamed over it so a crash never
+// leaves a partially written snapshot behind.
+func (s *Server) writeSnapshot(snap snapshot) {
+	name := path.Join(s.config.MetadataDir, s.snapshotFile())
+	tmp := name + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	var header [SNAPSHOT_HEADER]byte
+	binary.LittleEndian.PutUint64(header[:8], snap.index)
+	binary.LittleEndian.PutUint64(header[8:16], snap.term)
+	binary.LittleEndian.PutUint64(header[16:24], uint64(len(snap.configuration)))
+	binary.LittleEndian.PutUint64(header[24:32], uint64(len(snap.data)))
+
+	if _, err := f.Write(header[:]); err != nil {
+		panic(err)
+	}
+	if _, err := f.Write(snap.configuration); err != nil {
+		panic(err)
+	}
+	if _, err := f.Write(snap.data); err != nil {
+		panic(err)
+	}
+	if s.config.Fsync == FsyncAlways {
+		if err := f.Sync(); err != nil {
+			panic(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		panic(err)
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		panic(err)
+	}
+	// The rename itself is only durable once the directory is synced.
+	if s.config.Fsync == FsyncAlways {
+		if err := syncDir(s.config.MetadataDir); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// readSnapshot returns the snapshot on disk. ok is false if no
+// snapshot has been written yet.
+func (s *Server) readSnapshot() (snapshot, bool) {
+	snap, ok, err := readSnapshotFile(path.Join(s.config.MetadataDir, s.snapshotFile()))
+	if err != nil {
+		panic(err)
+	}
+	return snap, ok
+}
+
+func readSnapshotFile(name string) (snapshot, bool, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return snapshot{}, false, nil
+	} else if err != nil {
+		return snapshot{}, false, err
+	}
+	defer f.Close()
+
+	var header [SNAPSHOT_HEADER]byte
+	if _, err := io.ReadFull(f, header[:]); err != nil {
+		return snapshot{}, false, err
+	}
+
+	configurationLen := binary.LittleEndian.Uint64(header[16:24])
+	dataLen := binary.LittleEndian.Uint64(header[24:32])
+	fi, err := f.Stat()
+	if err != nil {
+		return snapshot{}, false, err
+	}
+	if configurationLen+dataLen != uint64(fi.Size()-SNAPSHOT_HEADER) {
+		return snapshot{}, false, fmt.Errorf("Snapshot %s is %d bytes, header says %d",
+			name, fi.Size(), SNAPSHOT_HEADER+configurationLen+dataLen)
+	}
+
+	snap := snapshot{
+		index:         binary.LittleEndian.Uint64(header[:8]),
+		term:          binary.LittleEndian.Uint64(header[8:16]),
+		configuration: make([]byte, configurationLen),
+		data:          make([]byte, dataLen),
+	}
+	if _, err := io.ReadFull(f, snap.configuration); err != nil {
+		return snapshot{}, false, err
+	}
+	if _, err := io.ReadFull(f, snap.data); err != nil {
+		return snapshot{}, false, err
+	}
+
+	return snap, true, nil
+}
+
+// discardLogThrough drops every entry up to and including index from
+// the log, leaving a sentinel for index/term in its place. Entries
+// after index are kept only if the log agrees on the term at index;
+// otherwise the whole log is superseded by the snapshot.
+func (s *Server) discardLogThrough(index, term uint64) {
+	sentinel := Entry{Term: term}
+
+	if index <= s.lastLogIndex() && index >= s.snapshotIndex && s.termAt(index) == term {
+		rest := s.log[s.entryIndex(index)+1:]
+		s.log = append([]Entry{sentinel}, rest...)
+	} else {
+		s.failPending(0, ErrLeadershipLost)
+		s.log = []Entry{sentinel}
+		if err := s.wal.truncateFrom(index); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := s.wal.compact(index); err != nil {
+		panic(err)
+	}
+
+	s.snapshotIndex = index
+	s.snapshotTerm = term
+}
+
+// restoreSnapshot loads a snapshot into the state machine and
+// configuration. Called with the lock held, once snapshotIndex
+// reflects the snapshot.
+func (s *Server) restoreSnapshot(snap snapshot) {
+	if s.statemachine != nil {
+		if err := s.statemachine.restore(snap.index, snap.data); err != nil {
+			panic(err)
+		}
+	}
+
+	s.setConfiguration(snap.index, decodeConfiguration(snap.configuration))
+	s.commitIndex = max(s.commitIndex, snap.index)
+	s.lastApplied = snap.index
+}
+
+// compact snapshots the state machine and truncates the log once
+// enough entries have been applied since the last snapshot.
+func (s *Server) compact() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.statemachine == nil || s.lastApplied-s.snapshotIndex < s.config.SnapshotThreshold {
+		return
+	}
+
+	data, err := s.statemachine.Snapshot()
+	if err != nil {
+		s.warn(fmt.Sprintf("Snapshot failed: %s", err))
+		return
+	}
+
+	snap := snapshot{
+		index:         s.lastApplied,
+		term:          s.termAt(s.lastApplied),
+		configuration: encodeConfiguration(s.cluster),
+		data:          data,
+	}
+	s.writeSnapshot(snap)
+	s.discardLogThrough(snap.index, snap.term)
+	s.persist(false, 0)
+
+	s.debugf("Compacted log through index %d (%d bytes snapshot)", snap.index, len(data))
+}
+
+func (s *Server) installSnapshot(id uint64) {
+	s.mu.Lock()
+	i := s.memberIndex(id)
+	if i < 0 || s.cluster[i].installingSnapshot {
+		s.mu.Unlock()
+		return
+	}
+
+	snap, ok := s.readSnapshot()
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+
+	s.cluster[i].installingSnapshot = true
+	req := InstallSnapshotRequest{
+		RPCMessage:        RPCMessage{Term: s.currentTerm},
+		LeaderId:          s.id,
+		LastIncludedIndex: snap.index,
+		LastIncludedTerm:  snap.term,
+		Configuration:     snap.configuration,
+		Data:              snap.data,
+	}
+	s.debugf("Sending snapshot through index %d to node %d", snap.index, id)
+	s.mu.Unlock()
+
+	sent := s.now()
+	var rsp InstallSnapshotResponse
+	ok = s.rpcCall(id, func(address string) error {
+		return s.Transport.InstallSnapshot(id, address, req, &rsp)
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i = s.memberIndex(id)
+	if i >= 0 {
+		s.cluster[i].installingSnapshot = false
+	}
+	if !ok || s.updateTerm(rsp.RPCMessage) {
+		return
+	}
+
+	if i >= 0 && s.state == leaderState && rsp.Term == req.Term {
+		if sent.After(s.cluster[i].lastContact) {
+			s.cluster[i].lastContact = sent
+		}
+		s.cluster[i].nextIndex = max(s.cluster[i].nextIndex, snap.index+1)
+		s.cluster[i].matchIndex = max(s.cluster[i].matchIndex, snap.index)
+	}
+}
+
+func (s *Server) HandleInstallSnapshotRequest(req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return ErrStopped
+	}
+
+	s.updateTerm(req.RPCMessage)
+
+	if req.Term == s.currentTerm && (s.state == candidateState || s.state == preCandidateState) {
+		s.debug("Converting to follower (received InstallSnapshot from leader)")
+		s.state = followerState
+	}
+
+	rsp.Term = s.currentTerm
+
+	if req.Term < s.currentTerm {
+		s.debugf("Rejecting InstallSnapshot from node %d: stale term", req.LeaderId)
+		return nil
+	}
+
+	s.resetElectionTimeout()
+	s.leaderContact = s.now()
+	s.setLeader(req.LeaderId)
+
+	if req.LastIncludedIndex <= s.snapshotIndex {
+		return nil
+	}
+
+	snap := snapshot{
+		index:         req.LastIncludedIndex,
+		term:          req.LastIncludedTerm,
+		configuration: req.Configuration,
+		data:          req.Data,
+	}
+	s.writeSnapshot(snap)
+	s.discardLogThrough(snap.index, snap.term)
+
+	if snap.index > s.lastApplied {
+		s.restoreSnapshot(snap)
+	}
+	s.commitIndex = max(s.commitIndex, snap.index)
+
+	s.persist(false, 0)
+	s.debugf("Installed snapshot through index %d from leader %d", req.LastIncludedIndex, req.LeaderId)
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package goraft
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	file string
+}
+
+func writePEM(t *testing.T, name, kind string, der []byte) {
+	if err := os.WriteFile(name, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := &testCA{cert: cert, key: key, file: path.Join(dir, name+".pem")}
+	writePEM(t, ca.file, "CERTIFICATE", der)
+	return ca
+}
+
+// transport returns a TLS transport whose certificate has commonName.
+func (ca *testCA) transport(t *testing.T, dir, commonName string) Transport {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := path.Join(dir, fmt.Sprintf("%s-%s.pem", ca.cert.Subject.CommonName, commonName))
+	keyFile := certFile + ".key"
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDer)
+
+	transport, err := NewTLSTransport(certFile, keyFile, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// recordingHandler answers every RPC, counting AppendEntries.
+type recordingHandler struct {
+	appendEntries int
+}
+
+func (h *recordingHandler) HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	return nil
+}
+
+func (h *recordingHandler) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	h.appendEntries++
+	rsp.Success = true
+	return nil
+}
+
+func (h *recordingHandler) HandleInstallSnapshotRequest(req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	return nil
+}
+
+func (h *recordingHandler) HandleTimeoutNowRequest(req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	return nil
+}
+
+func freeAddress(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func Test_mutual_tls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "cluster-ca")
+
+	server := ca.transport(t, dir, "1")
+	handler := &recordingHandler{}
+	address := freeAddress(t)
+	if err := server.Listen(address, handler); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	appendEntries := func(client Transport, to, from uint64) error {
+		defer client.Close()
+		var rsp AppendEntriesResponse
+		return client.AppendEntries(to, address, AppendEntriesRequest{LeaderId: from}, &rsp)
+	}
+
+	if err := appendEntries(ca.transport(t, dir, "2"), 1, 2); err != nil {
+		t.Fatalf("Expected a member's request to succeed, got %s", err)
+	}
+	if handler.appendEntries != 1 {
+		t.Fatalf("Expected the request to reach the handler")
+	}
+
+	for _, tc := range []struct {
+		name   string
+		client Transport
+		to     uint64
+		from   uint64
+		err    string
+	}{
+		{"sender doesn't match certificate", ca.transport(t, dir, "2"), 1, 3, "certificate of 2"},
+		{"server isn't the expected member", ca.transport(t, dir, "2"), 3, 2, "expected member 3"},
+		{"certificate isn't a member id", ca.transport(t, dir, "intruder"), 1, 2, ""},
+		{"certificate from another CA", newTestCA(t, dir, "other-ca").transport(t, dir, "2"), 1, 2, ""},
+		{"plaintext", NewNetRPCTransport(), 1, 2, ""},
+	} {
+		err := appendEntries(tc.client, tc.to, tc.from)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.name, tc.err, err)
+		}
+	}
+
+	if handler.appendEntries != 1 {
+		t.Errorf("Expected rejected requests not to reach the handler, got %d", handler.appendEntries)
+	}
+}
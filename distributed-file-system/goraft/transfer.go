@@ -0,0 +1,154 @@
+package goraft
+
+import (
+	"errors"
+	"time"
+)
+
+// How long the leader waits for the target to catch up and win an
+// election before giving up and resuming normal operation.
+const LEADERSHIP_TRANSFER_TIMEOUT = 5 * time.Second
+
+var ErrLeadershipTransferInProgress = errors.New("Leadership transfer in progress, retry once a new leader is elected")
+var ErrLeadershipTransferFailed = errors.New("Leadership transfer did not complete in time")
+
+type TimeoutNowRequest struct {
+	RPCMessage
+	LeaderId uint64
+}
+
+type TimeoutNowResponse struct {
+	RPCMessage
+}
+
+// TransferLeadership hands leadership to another member. New
+// commands are refused while the target is brought up to date, then
+// the target is told to start an election immediately. If targetId
+// is 0 the most up-to-date follower is chosen. Returns once this
+// server has stepped down.
+func (s *Server) TransferLeadership(targetId uint64) error {
+	s.mu.Lock()
+
+	if s.state != leaderState {
+		s.mu.Unlock()
+		return ErrApplyToLeader
+	}
+
+	if s.transferee != 0 {
+		s.mu.Unlock()
+		return ErrLeadershipTransferInProgress
+	}
+
+	if targetId == 0 {
+		var bestMatch uint64
+		for i := range s.cluster {
+			if i != s.clusterIndex && s.cluster[i].voter() && (targetId == 0 || s.cluster[i].matchIndex > bestMatch) {
+				targetId = s.cluster[i].Id
+				bestMatch = s.cluster[i].matchIndex
+			}
+		}
+	}
+
+	if targetId == s.id {
+		s.mu.Unlock()
+		return nil
+	}
+
+	if i := s.memberIndex(targetId); i < 0 {
+		s.mu.Unlock()
+		return ErrUnknownMember
+	} else if !s.cluster[i].voter() {
+		s.mu.Unlock()
+		return ErrNotVoter
+	}
+
+	s.debugf("Transferring leadership to node %d", targetId)
+	s.transferee = targetId
+	term := s.currentTerm
+	s.mu.Unlock()
+
+	deadline := s.now().Add(LEADERSHIP_TRANSFER_TIMEOUT)
+	interval := s.config.HeartbeatInterval / 2
+	sentTimeoutNow := false
+
+	for s.now().Before(deadline) {
+		s.mu.Lock()
+		if s.state != leaderState || s.currentTerm != term {
+			s.mu.Unlock()
+			s.debugf("Leadership transferred")
+			return nil
+		}
+
+		i := s.memberIndex(targetId)
+		if i < 0 {
+			s.transferee = 0
+			s.mu.Unlock()
+			return ErrUnknownMember
+		}
+
+		caughtUp := s.cluster[i].matchIndex == s.lastLogIndex()
+		if !caughtUp {
+			s.appendEntries()
+		}
+		s.mu.Unlock()
+
+		if caughtUp && !sentTimeoutNow {
+			sentTimeoutNow = s.timeoutNow(targetId)
+		}
+
+		s.sleep(interval)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != leaderState || s.currentTerm != term {
+		return nil
+	}
+
+	s.warn("Leadership transfer timed out")
+	s.transferee = 0
+	return ErrLeadershipTransferFailed
+}
+
+func (s *Server) timeoutNow(id uint64) bool {
+	s.mu.Lock()
+	req := TimeoutNowRequest{
+		RPCMessage: RPCMessage{Term: s.currentTerm},
+		LeaderId:   s.id,
+	}
+	s.mu.Unlock()
+
+	var rsp TimeoutNowResponse
+	ok := s.rpcCall(id, func(address string) error {
+		return s.Transport.TimeoutNow(id, address, req, &rsp)
+	})
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updateTerm(rsp.RPCMessage)
+	return true
+}
+
+func (s *Server) HandleTimeoutNowRequest(req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done {
+		return ErrStopped
+	}
+
+	s.updateTerm(req.RPCMessage)
+	rsp.Term = s.currentTerm
+
+	if req.Term < s.currentTerm || s.state == leaderState || s.state == candidateState || !s.voter() {
+		return nil
+	}
+
+	s.debugf("Leader %d asked us to take over", req.LeaderId)
+	s.startElection()
+	return nil
+}
@@ -0,0 +1,219 @@
+package goraft
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// RPCHandler is the receiving side of every Raft RPC. Server
+// implements it.
+type RPCHandler interface {
+	HandleRequestVoteRequest(req RequestVoteRequest, rsp *RequestVoteResponse) error
+	HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *AppendEntriesResponse) error
+	HandleInstallSnapshotRequest(req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error
+	HandleTimeoutNowRequest(req TimeoutNowRequest, rsp *TimeoutNowResponse) error
+}
+
+// Transport carries RPCs between servers. Calls are made concurrently
+// from many goroutines and identify the peer by both its member id and
+// address. An error means the peer could not be reached or did not
+// answer; the caller will retry later.
+type Transport interface {
+	// Listen starts delivering requests sent to address to handler.
+	Listen(address string, handler RPCHandler) error
+
+	RequestVote(id uint64, address string, req RequestVoteRequest, rsp *RequestVoteResponse) error
+	AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error
+	InstallSnapshot(id uint64, address string, req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error
+	TimeoutNow(id uint64, address string, req TimeoutNowRequest, rsp *TimeoutNowResponse) error
+
+	// ClosePeer drops any connection held open to a server that is
+	// no longer a member.
+	ClosePeer(id uint64, address string)
+
+	// Close stops listening and closes every connection.
+	Close() error
+}
+
+var ErrRPCTimeout = errors.New("RPC timed out")
+
+// Snapshots can be far larger than any AppendEntries request, so
+// sending one may take longer than the usual timeout.
+const INSTALL_SNAPSHOT_TIMEOUT = time.Minute
+
+// netRPCTransport sends RPCs with net/rpc over HTTP, keeping one
+// connection open to each peer.
+type netRPCTransport struct {
+	mu      sync.Mutex
+	server  *http.Server
+	clients map[string]*rpc.Client
+	// Set for mutual TLS; see tls.go.
+	tls *tls.Config
+	// How long a call waits for its response. A peer that never
+	// answers would otherwise hold up replication to it for good.
+	timeout time.Duration
+}
+
+// NewNetRPCTransport returns the default transport, net/rpc over
+// HTTP on TCP.
+func NewNetRPCTransport() Transport {
+	return &netRPCTransport{clients: map[string]*rpc.Client{}, timeout: defaultRPCTimeout()}
+}
+
+// defaultRPCTimeout is the longest election timeout of the default
+// config. A response that takes longer is of no use: by then the peer
+// has given up on the sender, or the sender on it.
+func defaultRPCTimeout() time.Duration {
+	return Config{}.withDefaults().ElectionTimeoutMax
+}
+
+// newTransport returns the transport config asks for, timing out
+// calls after config's longest election timeout. config must have its
+// defaults filled in.
+func newTransport(config Config) (Transport, error) {
+	transport := NewNetRPCTransport()
+	if config.TLSCertFile != "" {
+		var err error
+		transport, err = NewTLSTransport(config.TLSCertFile, config.TLSKeyFile, config.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	transport.(*netRPCTransport).timeout = config.ElectionTimeoutMax
+	return transport, nil
+}
+
+func (t *netRPCTransport) Listen(address string, handler RPCHandler) error {
+	mux := http.NewServeMux()
+	if t.tls != nil {
+		mux.Handle(rpc.DefaultRPCPath, serveTLS(handler))
+	} else {
+		rpcServer := rpc.NewServer()
+		if err := rpcServer.RegisterName("Server", handler); err != nil {
+			return err
+		}
+		mux.Handle(rpc.DefaultRPCPath, rpcServer)
+	}
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if t.tls != nil {
+		l = tls.NewListener(l, t.tls)
+	}
+
+	t.mu.Lock()
+	t.server = &http.Server{Handler: mux}
+	server := t.server
+	t.mu.Unlock()
+
+	go server.Serve(l)
+	return nil
+}
+
+func (t *netRPCTransport) call(id uint64, address, name string, req, rsp any, timeout time.Duration) error {
+	t.mu.Lock()
+	client := t.clients[address]
+	t.mu.Unlock()
+
+	if client == nil {
+		var err error
+		if t.tls != nil {
+			client, err = t.dialTLS(id, address)
+		} else {
+			client, err = rpc.DialHTTP("tcp", address)
+		}
+		if err != nil {
+			return err
+		}
+
+		t.mu.Lock()
+		if existing := t.clients[address]; existing != nil {
+			// Lost a race with another caller; use theirs.
+			client.Close()
+			client = existing
+		} else {
+			t.clients[address] = client
+		}
+		t.mu.Unlock()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case call := <-client.Go(name, req, rsp, make(chan *rpc.Call, 1)).Done:
+		err = call.Error
+	case <-timer.C:
+		// Closing the connection fails the call; the caller must not
+		// look at rsp, which may still be written to until then.
+		err = ErrRPCTimeout
+	}
+	if err != nil {
+		// Close the bad connection so the next call redials.
+		t.mu.Lock()
+		if t.clients[address] == client {
+			delete(t.clients, address)
+		}
+		t.mu.Unlock()
+		client.Close()
+	}
+
+	return err
+}
+
+func (t *netRPCTransport) RequestVote(id uint64, address string, req RequestVoteRequest, rsp *RequestVoteResponse) error {
+	return t.call(id, address, "Server.HandleRequestVoteRequest", req, rsp, t.timeout)
+}
+
+func (t *netRPCTransport) AppendEntries(id uint64, address string, req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	return t.call(id, address, "Server.HandleAppendEntriesRequest", req, rsp, t.timeout)
+}
+
+func (t *netRPCTransport) InstallSnapshot(id uint64, address string, req InstallSnapshotRequest, rsp *InstallSnapshotResponse) error {
+	return t.call(id, address, "Server.HandleInstallSnapshotRequest", req, rsp, max(t.timeout, INSTALL_SNAPSHOT_TIMEOUT))
+}
+
+func (t *netRPCTransport) TimeoutNow(id uint64, address string, req TimeoutNowRequest, rsp *TimeoutNowResponse) error {
+	return t.call(id, address, "Server.HandleTimeoutNowRequest", req, rsp, t.timeout)
+}
+
+func (t *netRPCTransport) AppendEntriesBatch(id uint64, address string, req AppendEntriesBatch, rsp *AppendEntriesBatchResponse) error {
+	return t.call(id, address, "Server.HandleAppendEntriesBatch", req, rsp, t.timeout)
+}
+
+func (t *netRPCTransport) ClosePeer(id uint64, address string) {
+	t.mu.Lock()
+	client := t.clients[address]
+	delete(t.clients, address)
+	t.mu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+}
+
+func (t *netRPCTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for address, client := range t.clients {
+		client.Close()
+		delete(t.clients, address)
+	}
+
+	if t.server == nil {
+		return nil
+	}
+
+	err := t.server.Close()
+	t.server = nil
+	return err
+}
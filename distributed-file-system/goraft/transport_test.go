@@ -0,0 +1,50 @@
+package goraft
+
+import (
+	"testing"
+	"time"
+)
+
+// stuckHandler answers AppendEntries only once release is closed.
+type stuckHandler struct {
+	recordingHandler
+	release chan struct{}
+}
+
+func (h *stuckHandler) HandleAppendEntriesRequest(req AppendEntriesRequest, rsp *AppendEntriesResponse) error {
+	<-h.release
+	rsp.Success = true
+	return nil
+}
+
+func Test_rpc_timeout(t *testing.T) {
+	server := NewNetRPCTransport()
+	handler := &stuckHandler{release: make(chan struct{})}
+	address := freeAddress(t)
+	if err := server.Listen(address, handler); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	defer close(handler.release)
+
+	client := NewNetRPCTransport().(*netRPCTransport)
+	defer client.Close()
+	client.timeout = 50 * time.Millisecond
+
+	var rsp AppendEntriesResponse
+	start := time.Now()
+	if err := client.AppendEntries(1, address, AppendEntriesRequest{}, &rsp); err != ErrRPCTimeout {
+		t.Fatalf("Expected ErrRPCTimeout from a peer that doesn't answer, got %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("Expected the call to give up after its timeout, waited %s", waited)
+	}
+
+	// The hung connection is dropped, so the next call redials.
+	client.mu.Lock()
+	clients := len(client.clients)
+	client.mu.Unlock()
+	if clients != 0 {
+		t.Errorf("Expected the connection closed after the timeout, %d still open", clients)
+	}
+}
@@ -5,19 +5,11 @@
 
 package goraft
 
-import (
-	"context"
-)
+import "context"
 
+// Shutdown stops the server, waiting as long as that takes.
 func (s *Server) Shutdown() {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	s.debug("Shutting down.")
-	s.fd.Close()
-	s.fd = nil
-	s.server.Shutdown(context.Background())
-	s.done = true
+	s.Stop(context.Background())
 }
 
 func (s *Server) Id() uint64 {
@@ -30,16 +22,24 @@ func (s *Server) IsLeader() bool {
 	return s.state == leaderState
 }
 
+// Leader returns the id of the leader of the current term, or 0 if
+// this server hasn't heard from one yet.
+func (s *Server) Leader() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaderId
+}
+
 // Excludes blank entries
 func (s *Server) AllCommitted() (bool, float64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	for i := max(s.commitIndex, 1) - 1; i > 0; i-- {
-		e := s.log[i]
+	for i := max(s.commitIndex, 1) - 1; i > s.snapshotIndex; i-- {
+		e := s.log[s.entryIndex(i)]
 		// Last entry in the log that is applied by the user.
-		if len(e.Command) > 0 {
-			return s.lastApplied >= uint64(i), float64(s.lastApplied) / float64(len(s.log)) * 100
+		if e.Kind == CommandEntry && len(e.Command) > 0 {
+			return s.lastApplied >= i, float64(s.lastApplied) / float64(s.lastLogIndex()+1) * 100
 		}
 	}
 
@@ -53,15 +53,18 @@ type EntriesIterator struct {
 	Entry Entry
 }
 
+// Next advances to the next user-submitted entry. Entries that have
+// been compacted into a snapshot are skipped.
 func (ei *EntriesIterator) Next() (int, bool) {
 	ei.s.mu.Lock()
 	defer ei.s.mu.Unlock()
 
-	for ei.index < len(ei.s.log) {
-		ei.Entry = ei.s.log[ei.index]
+	ei.index = max(ei.index, int(ei.s.snapshotIndex)+1)
+	for uint64(ei.index) <= ei.s.lastLogIndex() {
+		ei.Entry = ei.s.log[ei.s.entryIndex(uint64(ei.index))]
 		ei.index++
 		// Skip ahead until you find the next user-submitted message.
-		if len(ei.Entry.Command) > 0 {
+		if ei.Entry.Kind == CommandEntry && len(ei.Entry.Command) > 0 {
 			break
 		}
 	}
@@ -71,8 +74,8 @@ func (ei *EntriesIterator) Next() (int, bool) {
 	// after non-blank messages, Next() wouldn't otherwise know
 	// there is not more. So we peek here.
 	hasMore := false
-	for i := ei.index; i < len(ei.s.log); i++ {
-		if len(ei.s.log[i].Command) > 0 {
+	for i := ei.s.entryIndex(uint64(ei.index)); i < len(ei.s.log); i++ {
+		if e := ei.s.log[i]; e.Kind == CommandEntry && len(e.Command) > 0 {
 			hasMore = true
 			break
 		}
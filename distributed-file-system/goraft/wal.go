@@ -0,0 +1,403 @@
+package goraft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The log is stored as a sequence of segment files, each named after
+// the index of the first entry it holds. Every record is
+//
+//	[0:4]   payload length
+//	[4:8]   CRC-32C of the payload
+//	[8:16]  entry index
+//	[16:24] entry term
+//	[24]    entry kind
+//	[25:]   command
+//
+// Records within a segment have consecutive indexes. A record that
+// fails its checksum or runs past the end of the last segment is
+// treated as a torn write and truncated away on open.
+
+// A new segment is started once the current one grows past this size.
+const WAL_SEGMENT_SIZE = 64 * 1024 * 1024
+
+const WAL_RECORD_HEADER = 8
+const WAL_ENTRY_HEADER = 17
+const WAL_SEGMENT_EXT = ".wal"
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var ErrWalCorrupt = errors.New("WAL is corrupt")
+
+type walSegment struct {
+	name       string
+	firstIndex uint64
+	// offsets[i] is the file offset of the record for firstIndex+i.
+	offsets []int64
+	size    int64
+}
+
+func (seg *walSegment) lastIndex() uint64 {
+	return seg.firstIndex + uint64(len(seg.offsets)) - 1
+}
+
+type walRecord struct {
+	index uint64
+	entry Entry
+}
+
+type wal struct {
+	dir         string
+	segmentSize int64
+	// Skip syncing to disk; see FsyncNever.
+	noSync   bool
+	segments []*walSegment
+	// Open for appending to the last segment.
+	fd *os.File
+}
+
+func segmentName(firstIndex uint64) string {
+	return fmt.Sprintf("%020d%s", firstIndex, WAL_SEGMENT_EXT)
+}
+
+// openWal loads every record in dir, creating it if needed. A torn
+// record at the end of the last segment is truncated away; corruption
+// anywhere else is reported as ErrWalCorrupt.
+func openWal(dir string) (*wal, []walRecord, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	w := &wal{dir: dir, segmentSize: WAL_SEGMENT_SIZE}
+	for _, de := range dirEntries {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), WAL_SEGMENT_EXT) {
+			continue
+		}
+
+		var firstIndex uint64
+		if _, err := fmt.Sscanf(de.Name(), "%d"+WAL_SEGMENT_EXT, &firstIndex); err != nil {
+			return nil, nil, fmt.Errorf("%w: bad segment name %s", ErrWalCorrupt, de.Name())
+		}
+		w.segments = append(w.segments, &walSegment{name: de.Name(), firstIndex: firstIndex})
+	}
+
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].firstIndex < w.segments[j].firstIndex
+	})
+
+	var records []walRecord
+	for i, seg := range w.segments {
+		last := i == len(w.segments)-1
+		segRecords, err := w.readSegment(seg, last)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(records) > 0 && len(segRecords) > 0 &&
+			segRecords[0].index != records[len(records)-1].index+1 {
+			return nil, nil, fmt.Errorf("%w: segment %s does not follow index %d",
+				ErrWalCorrupt, seg.name, records[len(records)-1].index)
+		}
+		records = append(records, segRecords...)
+	}
+
+	// Drop an empty tail segment left behind by a crash right after
+	// rollover; the next append recreates it.
+	if n := len(w.segments); n > 0 && len(w.segments[n-1].offsets) == 0 {
+		if err := os.Remove(path.Join(dir, w.segments[n-1].name)); err != nil {
+			return nil, nil, err
+		}
+		w.segments = w.segments[:n-1]
+	}
+
+	if err := w.openTail(); err != nil {
+		return nil, nil, err
+	}
+
+	return w, records, nil
+}
+
+func (w *wal) readSegment(seg *walSegment, last bool) ([]walRecord, error) {
+	name := path.Join(w.dir, seg.name)
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []walRecord
+	var offset int64
+	for offset < int64(len(data)) {
+		rec, n, ok := decodeWalRecord(data[offset:])
+		if ok && rec.index != seg.firstIndex+uint64(len(records)) {
+			return nil, fmt.Errorf("%w: segment %s has index %d at offset %d",
+				ErrWalCorrupt, seg.name, rec.index, offset)
+		}
+
+		if !ok {
+			if !last {
+				return nil, fmt.Errorf("%w: bad record in segment %s at offset %d",
+					ErrWalCorrupt, seg.name, offset)
+			}
+
+			// Torn write at the tail of the log.
+			if err := os.Truncate(name, offset); err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		seg.offsets = append(seg.offsets, offset)
+		records = append(records, rec)
+		offset += int64(n)
+	}
+
+	seg.size = offset
+	return records, nil
+}
+
+func decodeWalRecord(data []byte) (walRecord, int, bool) {
+	if len(data) < WAL_RECORD_HEADER {
+		return walRecord{}, 0, false
+	}
+
+	length := int(binary.LittleEndian.Uint32(data[:4]))
+	sum := binary.LittleEndian.Uint32(data[4:8])
+	if length < WAL_ENTRY_HEADER || len(data) < WAL_RECORD_HEADER+length {
+		return walRecord{}, 0, false
+	}
+
+	payload := data[WAL_RECORD_HEADER : WAL_RECORD_HEADER+length]
+	if crc32.Checksum(payload, walCrcTable) != sum {
+		return walRecord{}, 0, false
+	}
+
+	rec := walRecord{
+		index: binary.LittleEndian.Uint64(payload[:8]),
+		entry: Entry{
+			Term:    binary.LittleEndian.Uint64(payload[8:16]),
+			Kind:    EntryKind(payload[16]),
+			Command: make([]byte, length-WAL_ENTRY_HEADER),
+		},
+	}
+	copy(rec.entry.Command, payload[WAL_ENTRY_HEADER:])
+
+	return rec, WAL_RECORD_HEADER + length, true
+}
+
+func encodeWalRecord(index uint64, e Entry) []byte {
+	record := make([]byte, WAL_RECORD_HEADER+WAL_ENTRY_HEADER+len(e.Command))
+	payload := record[WAL_RECORD_HEADER:]
+	binary.LittleEndian.PutUint64(payload[:8], index)
+	binary.LittleEndian.PutUint64(payload[8:16], e.Term)
+	payload[16] = byte(e.Kind)
+	copy(payload[WAL_ENTRY_HEADER:], e.Command)
+
+	binary.LittleEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCrcTable))
+	return record
+}
+
+func (w *wal) openTail() error {
+	if w.fd != nil {
+		w.fd.Close()
+		w.fd = nil
+	}
+
+	if len(w.segments) == 0 {
+		return nil
+	}
+
+	var err error
+	w.fd, err = os.OpenFile(path.Join(w.dir, w.tail().name), os.O_CREATE|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.fd.Seek(w.tail().size, 0)
+	return err
+}
+
+func (w *wal) tail() *walSegment {
+	return w.segments[len(w.segments)-1]
+}
+
+func (w *wal) lastIndex() (uint64, bool) {
+	if len(w.segments) == 0 {
+		return 0, false
+	}
+	return w.tail().lastIndex(), true
+}
+
+func (w *wal) newSegment(firstIndex uint64) error {
+	w.segments = append(w.segments, &walSegment{name: segmentName(firstIndex), firstIndex: firstIndex})
+	if err := w.openTail(); err != nil {
+		return err
+	}
+	return w.syncDir()
+}
+
+// append writes entries starting at firstIndex, first discarding any
+// existing records at or after firstIndex. The write is not durable
+// until sync is called.
+func (w *wal) append(firstIndex uint64, entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	last, ok := w.lastIndex()
+	if ok && firstIndex <= last {
+		if err := w.truncateFrom(firstIndex); err != nil {
+			return err
+		}
+		last, ok = w.lastIndex()
+	}
+
+	if !ok || firstIndex > last+1 {
+		// Nothing to continue from, e.g. after a snapshot install
+		// replaced the whole log. Older segments are all covered by the
+		// snapshot.
+		if err := w.removeSegments(len(w.segments)); err != nil {
+			return err
+		}
+		if err := w.newSegment(firstIndex); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w.fd)
+	for i, e := range entries {
+		index := firstIndex + uint64(i)
+		seg := w.tail()
+
+		if seg.size >= w.segmentSize && len(seg.offsets) > 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if err := w.sync(); err != nil {
+				return err
+			}
+			if err := w.newSegment(index); err != nil {
+				return err
+			}
+			seg = w.tail()
+			bw.Reset(w.fd)
+		}
+
+		record := encodeWalRecord(index, e)
+		if _, err := bw.Write(record); err != nil {
+			return err
+		}
+		seg.offsets = append(seg.offsets, seg.size)
+		seg.size += int64(len(record))
+	}
+
+	return bw.Flush()
+}
+
+// truncateFrom discards every record at or after index.
+func (w *wal) truncateFrom(index uint64) error {
+	keep := len(w.segments)
+	for keep > 0 && w.segments[keep-1].firstIndex >= index {
+		keep--
+	}
+
+	for _, seg := range w.segments[keep:] {
+		if err := os.Remove(path.Join(w.dir, seg.name)); err != nil {
+			return err
+		}
+	}
+	w.segments = w.segments[:keep]
+
+	if keep > 0 {
+		seg := w.tail()
+		if index <= seg.lastIndex() {
+			n := index - seg.firstIndex
+			seg.size = seg.offsets[n]
+			seg.offsets = seg.offsets[:n]
+			if err := os.Truncate(path.Join(w.dir, seg.name), seg.size); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := w.openTail(); err != nil {
+		return err
+	}
+	return w.syncDir()
+}
+
+// compact removes segments holding only entries at or before index.
+// The tail segment is always kept so appends can continue from it.
+func (w *wal) compact(index uint64) error {
+	n := 0
+	for n < len(w.segments)-1 && w.segments[n].lastIndex() <= index {
+		n++
+	}
+	return w.removeSegments(n)
+}
+
+// removeSegments deletes the first n segments.
+func (w *wal) removeSegments(n int) error {
+	if n == 0 {
+		return nil
+	}
+
+	for _, seg := range w.segments[:n] {
+		if err := os.Remove(path.Join(w.dir, seg.name)); err != nil {
+			return err
+		}
+	}
+	w.segments = w.segments[n:]
+
+	if err := w.openTail(); err != nil {
+		return err
+	}
+	return w.syncDir()
+}
+
+func (w *wal) sync() error {
+	if w.fd == nil || w.noSync {
+		return nil
+	}
+	return w.fd.Sync()
+}
+
+func (w *wal) syncDir() error {
+	if w.noSync {
+		return nil
+	}
+	return syncDir(w.dir)
+}
+
+// syncDir makes the creation, removal and renaming of files in dir
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (w *wal) close() error {
+	if w.fd == nil {
+		return nil
+	}
+	err := w.fd.Close()
+	w.fd = nil
+	return err
+}
@@ -0,0 +1,155 @@
+package goraft
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+)
+
+func walEntries(n int, size int) []Entry {
+	var entries []Entry
+	for i := 0; i < n; i++ {
+		entries = append(entries, Entry{
+			Term:    uint64(i/10 + 1),
+			Command: bytes.Repeat([]byte{byte('a' + i%26)}, size),
+		})
+	}
+	return entries
+}
+
+func Test_wal_rollover_and_reopen(t *testing.T) {
+	dir := t.TempDir()
+	w, records, err := openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("Expected empty WAL, got %d records", len(records))
+	}
+
+	// Larger than the old fixed-size entries, and enough to roll over.
+	w.segmentSize = 4096
+	entries := walEntries(100, 500)
+	if err := w.append(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.sync(); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.segments) < 2 {
+		t.Errorf("Expected segment rollover, got %d segments", len(w.segments))
+	}
+	w.close()
+
+	w, records, err = openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	if len(records) != len(entries) {
+		t.Fatalf("Expected %d records, got %d", len(entries), len(records))
+	}
+	for i, r := range records {
+		if r.index != uint64(i+1) || r.entry.Term != entries[i].Term || !bytes.Equal(r.entry.Command, entries[i].Command) {
+			t.Fatalf("Record %d does not match what was written", i)
+		}
+	}
+
+	// Overwrite a suffix spanning segments, then drop old segments.
+	if err := w.append(50, walEntries(3, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.compact(40); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	_, records, err = openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := records[len(records)-1]
+	if last.index != 52 || len(last.entry.Command) != 10 {
+		t.Errorf("Expected log to end at index 52 with the new entry, got index %d", last.index)
+	}
+	if records[0].index > 41 {
+		t.Errorf("Compaction removed entries after index 40, first index is %d", records[0].index)
+	}
+}
+
+func Test_wal_torn_write(t *testing.T) {
+	dir := t.TempDir()
+	w, _, err := openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.append(1, walEntries(5, 200)); err != nil {
+		t.Fatal(err)
+	}
+	name := path.Join(dir, w.tail().name)
+	size := w.tail().size
+	lastOffset := w.tail().offsets[4]
+	w.close()
+
+	// Simulate a crash halfway through writing the last record.
+	if err := os.Truncate(name, size-50); err != nil {
+		t.Fatal(err)
+	}
+
+	w, records, err := openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Errorf("Expected torn record to be dropped, got %d records", len(records))
+	}
+	if info, _ := os.Stat(name); info.Size() != lastOffset {
+		t.Errorf("Expected segment truncated to %d bytes, is %d", lastOffset, info.Size())
+	}
+
+	// Appending continues where the intact log ends.
+	if err := w.append(5, walEntries(1, 200)); err != nil {
+		t.Fatal(err)
+	}
+	w.close()
+
+	_, records, err = openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 5 {
+		t.Errorf("Expected 5 records after re-append, got %d", len(records))
+	}
+}
+
+func Test_wal_corrupt_segment(t *testing.T) {
+	dir := t.TempDir()
+	w, _, err := openWal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.segmentSize = 1024
+	if err := w.append(1, walEntries(20, 200)); err != nil {
+		t.Fatal(err)
+	}
+	first := path.Join(dir, w.segments[0].name)
+	w.close()
+
+	// A flipped bit in a sealed segment is not a torn write.
+	data, err := os.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[WAL_RECORD_HEADER+WAL_ENTRY_HEADER] ^= 0xff
+	if err := os.WriteFile(first, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = openWal(dir)
+	if !errors.Is(err, ErrWalCorrupt) {
+		t.Errorf("Expected ErrWalCorrupt, got %v", err)
+	}
+}
@@ -1,64 +1,410 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	crypto "crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"distributed-file-system/command"
 	"distributed-file-system/goraft"
 )
 
 type File struct {
 	Name         string    `json:"name"`
-	Size         int64     `json:"size"`
+	Size         int64     `json:"size,omitempty"`
 	LastModified time.Time `json:"last_modified"`
+	Dir          bool      `json:"dir,omitempty"`
+	// The content's hash and the node it was uploaded to; see
+	// blobs.go. Empty for files uploaded before content was
+	// replicated, whose content is only on the node that took the
+	// upload.
+	Hash   string `json:"hash,omitempty"`
+	Origin string `json:"origin,omitempty"`
 }
 
+var (
+	errFileNotFound = errors.New("file not found")
+	errFileExists   = errors.New("file already exists")
+)
+
+// DFSStateMachine holds the namespace, and keeps each file's content
+// on disk under its full path below <data>/files. The namespace is
+// saved in <data>/state.db along with the index of the last entry
+// applied, so a restarted node only applies entries it hasn't yet;
+// see store.go.
 type DFSStateMachine struct {
-	files *sync.Map
+	mu sync.RWMutex
+	ns *namespace
+	// The HTTP URL of each node that has been leader, by Raft id, so
+	// followers know where to forward writes.
+	nodes map[uint64]string
+
+	kv      *kvStore
+	applied uint64
+	// Set while changes applied through applied wait for Flush.
+	unsaved bool
+	// Changes outside the namespace made by the command being applied.
+	pending map[string][]byte
+
+	blobs   *blobStore
+	dataDir string
+	// This node's own HTTP URL, which is never a source to fetch
+	// content from.
+	self string
+}
+
+func NewDFSStateMachine(blobs *blobStore, dataDir, self string) (*DFSStateMachine, error) {
+	s := &DFSStateMachine{
+		ns:      newNamespace(),
+		nodes:   map[uint64]string{},
+		pending: map[string][]byte{},
+		blobs:   blobs,
+		dataDir: dataDir,
+		self:    self,
+	}
+	blobs.sources = s.sources
+	blobs.arrived = s.placeAll
+
+	var err error
+	s.kv, err = openKV(filepath.Join(dataDir, "state.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	if v, ok := s.kv.get(appliedKey); ok {
+		s.applied = binary.LittleEndian.Uint64(v)
+	}
+	var files []File
+	var scanErr error
+	s.kv.scan(fileKeyPrefix, func(key string, value []byte) {
+		var f File
+		if err := json.Unmarshal(value, &f); err != nil {
+			scanErr = fmt.Errorf("entry %s: %w", key, err)
+		}
+		files = append(files, f)
+	})
+	s.kv.scan(nodeKeyPrefix, func(key string, value []byte) {
+		id, err := strconv.ParseUint(strings.TrimPrefix(key, nodeKeyPrefix), 10, 64)
+		if err != nil {
+			scanErr = fmt.Errorf("entry %s: %w", key, err)
+		}
+		s.nodes[id] = string(value)
+	})
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if err := s.load(files); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d entries applied through index %d", len(files), s.applied)
+	return s, nil
+}
+
+// Keys in the state machine's store.
+const (
+	appliedKey    = "applied"
+	fileKeyPrefix = "file:"
+	nodeKeyPrefix = "node:"
+)
+
+func fileKey(name string) string {
+	return fileKeyPrefix + name
+}
+
+func nodeKey(id uint64) string {
+	return nodeKeyPrefix + strconv.FormatUint(id, 10)
+}
+
+// diskPath is where the content of name is kept on this node.
+func (s *DFSStateMachine) diskPath(name string) string {
+	return filepath.Join(s.dataDir, "files", filepath.FromSlash(name))
+}
+
+// legacyPath is where files uploaded before content was replicated
+// kept their content, by base name only.
+func (s *DFSStateMachine) legacyPath(name string) string {
+	return filepath.Join(s.dataDir, filepath.Base(name))
+}
+
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// local returns where this node has the content hash, or "".
+func (s *DFSStateMachine) local(hash string) string {
+	if s.blobs.has(hash) {
+		return s.blobs.path(hash)
+	}
+	for _, n := range s.ns.withHash(hash) {
+		if exists(s.diskPath(n.Name)) {
+			return s.diskPath(n.Name)
+		}
+	}
+	return ""
+}
+
+// place puts the content hash at name on disk, from the staging area
+// or from another file with the same content, and reports whether it
+// could. Called with s.mu held.
+func (s *DFSStateMachine) place(name, hash string) bool {
+	if !validHash(hash) {
+		return false
+	}
+	src := s.local(hash)
+	if src == "" {
+		return false
+	}
+
+	dst := s.diskPath(name)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	if err := linkOrCopy(src, dst); err != nil {
+		log.Printf("Placing content of %s: %s", name, err)
+		return false
+	}
+	return true
+}
+
+// placeAll puts fetched content at every file that is waiting for it.
+func (s *DFSStateMachine) placeAll(hash string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, n := range s.ns.withHash(hash) {
+		if !exists(s.diskPath(n.Name)) && s.place(n.Name, hash) {
+			s.confirm(n.File)
+		}
+	}
+	s.blobs.discard(hash)
+}
+
+// confirm tells the node f was uploaded to that this node has its
+// content.
+func (s *DFSStateMachine) confirm(f File) {
+	if f.Origin != s.self {
+		s.blobs.confirm(f.Origin, f.Hash)
+	}
+}
+
+// sources lists the nodes to fetch content from: those the files with
+// that content were uploaded to, then every other node known to have
+// taken an upload. It also reports whether any file here is still
+// missing that content.
+func (s *DFSStateMachine) sources(hash string) ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var first, rest []string
+	seen := map[string]bool{"": true, s.self: true}
+	needed := false
+	for _, n := range s.ns.withHash(hash) {
+		needed = needed || !exists(s.diskPath(n.Name))
+		if !seen[n.Origin] {
+			first = append(first, n.Origin)
+			seen[n.Origin] = true
+		}
+	}
+	for origin := range s.ns.origins {
+		if !seen[origin] {
+			rest = append(rest, origin)
+		}
+	}
+	sort.Strings(rest)
+	return append(first, rest...), needed
+}
+
+// removeContent deletes what this node stores for the file n.
+func (s *DFSStateMachine) removeContent(n *node) {
+	if n.Hash == "" {
+		os.Remove(s.legacyPath(n.Name))
+	}
+	os.Remove(s.diskPath(n.Name))
 }
 
-func NewDFSStateMachine() *DFSStateMachine {
-	return &DFSStateMachine{
-		files: &sync.Map{},
+// ApplyIndex applies cmd, the entry at index. Its changes are saved
+// along with index by Flush.
+func (s *DFSStateMachine) ApplyIndex(index uint64, cmd []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.apply(command.Decode(cmd))
+	s.applied = index
+	s.unsaved = true
+	return res, err
+}
+
+// Flush saves the changes of the entries applied since it was last
+// called in one batch, with a single fsync.
+func (s *DFSStateMachine) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unsaved {
+		s.save(s.applied)
 	}
+	return nil
 }
 
+// Apply is ApplyIndex for a server that doesn't pass indexes on. The
+// applied index stays where it is.
 func (s *DFSStateMachine) Apply(cmd []byte) ([]byte, error) {
-	c := decodeCommand(cmd)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res, err := s.apply(command.Decode(cmd))
+	s.save(s.applied)
+	return res, err
+}
+
+func (s *DFSStateMachine) AppliedIndex() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.applied
+}
+
+func encodeIndex(index uint64) []byte {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], index)
+	return b[:]
+}
+
+// save writes the changes made since it was last called in one batch,
+// along with index as the last entry applied. If it can't, the node
+// stops: carrying on would leave the store at an index its contents
+// don't match. Called with s.mu held.
+func (s *DFSStateMachine) save(index uint64) {
+	b := kvBatch{Put: s.pending}
+	s.pending = map[string][]byte{}
+
+	b.Put[appliedKey] = encodeIndex(index)
+	for name, n := range s.ns.flush() {
+		if n == nil {
+			b.Delete = append(b.Delete, fileKey(name))
+			continue
+		}
+		b.Put[fileKey(name)], _ = json.Marshal(n.File)
+	}
+
+	if err := s.kv.commit(b); err != nil {
+		log.Fatalf("Saving state at index %d: %s", index, err)
+	}
+	s.applied = index
+	s.unsaved = false
+}
+
+// apply carries out c. Called with s.mu held.
+func (s *DFSStateMachine) apply(c command.Command) ([]byte, error) {
+	// Every node takes the time from the command. Commands written
+	// before the leader set it fall back to the local clock.
+	modified := time.Now()
+	if c.Time != 0 {
+		modified = time.Unix(0, c.Time)
+	}
+
 	switch c.Kind {
-	case CreateFile:
-		s.files.Store(c.Path, &File{
-			Name:         c.Path,
-			Size:         c.Size,
-			LastModified: time.Now(),
-		})
-		log.Printf("Applied CreateFile: %s (%d bytes)", c.Path, c.Size)
-
-	case DeleteFile:
-		s.files.Delete(c.Path)
-		log.Printf("Applied DeleteFile: %s", c.Path)
-
-	case RenameFile:
-		s.files.Delete(c.OldPath)
-		s.files.Store(c.NewPath, &File{
-			Name:         c.NewPath,
+	case command.CreateFile:
+		name := cleanPath(c.Path)
+		f := File{
+			Name:         name,
 			Size:         c.Size,
-			LastModified: time.Now(),
-		})
-		log.Printf("Applied RenameFile: %s -> %s", c.OldPath, c.NewPath)
+			LastModified: modified,
+			Hash:         c.Hash,
+			Origin:       c.Origin,
+		}
+		old, err := s.ns.put(f)
+		if err != nil {
+			return nil, err
+		}
+		if old != nil && (old.Hash != c.Hash || c.Hash == "") {
+			s.removeContent(old)
+		}
+		if exists(s.diskPath(name)) || s.place(name, c.Hash) {
+			s.confirm(f)
+		} else {
+			s.blobs.want(c.Hash)
+		}
+		log.Printf("Applied CreateFile: %s (%d bytes)", name, c.Size)
+
+	case command.DeleteFile:
+		name := cleanPath(c.Path)
+		n := s.ns.lookup(name)
+		if n == nil {
+			return nil, errFileNotFound
+		}
+		if n.Dir {
+			return nil, errIsDirectory
+		}
+		s.ns.remove(name)
+		s.removeContent(n)
+		log.Printf("Applied DeleteFile: %s", name)
+
+	case command.RenameFile:
+		from, to := cleanPath(c.OldPath), cleanPath(c.NewPath)
+		if err := s.ns.move(from, to, modified); err != nil {
+			return nil, err
+		}
+
+		// Directories and content move along with the entry.
+		os.MkdirAll(filepath.Dir(s.diskPath(to)), 0755)
+		if err := os.Rename(s.diskPath(from), s.diskPath(to)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Moving content of %s: %s", from, err)
+		}
+		if n := s.ns.lookup(to); !n.Dir && n.Hash == "" {
+			if err := os.Rename(s.legacyPath(from), s.legacyPath(to)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Moving content of %s: %s", from, err)
+			}
+		}
+		log.Printf("Applied RenameFile: %s -> %s", from, to)
+
+	case command.MakeDir:
+		name := cleanPath(c.Path)
+		if s.ns.lookup(name) != nil {
+			return nil, errFileExists
+		}
+		if _, err := s.ns.mkdirAll(name, modified); err != nil {
+			return nil, err
+		}
+		os.MkdirAll(s.diskPath(name), 0755)
+		log.Printf("Applied MakeDir: %s", name)
+
+	case command.RemoveDir:
+		name := cleanPath(c.Path)
+		n := s.ns.lookup(name)
+		switch {
+		case name == "/":
+			return nil, errRootDirectory
+		case n == nil:
+			return nil, errFileNotFound
+		case !n.Dir:
+			return nil, errNotDirectory
+		case len(n.children) > 0:
+			return nil, errDirNotEmpty
+		}
+		s.ns.remove(name)
+		os.Remove(s.diskPath(name))
+		log.Printf("Applied RemoveDir: %s", name)
+
+	case command.SetNodeAddress:
+		s.nodes[c.Node] = c.Origin
+		s.pending[nodeKey(c.Node)] = []byte(c.Origin)
+		log.Printf("Applied SetNodeAddress: node %d at %s", c.Node, c.Origin)
 
 	default:
 		return nil, fmt.Errorf("unknown command: %v", c.Kind)
@@ -66,132 +412,584 @@ func (s *DFSStateMachine) Apply(cmd []byte) ([]byte, error) {
 	return nil, nil
 }
 
-type commandKind uint8
-
-const (
-	CreateFile commandKind = iota
-	DeleteFile
-	RenameFile
-)
-
-type command struct {
-	Kind    commandKind
-	Path    string
-	OldPath string
-	NewPath string
-	Size    int64
+// nodeAddress returns the HTTP URL of node id, or "" if it hasn't
+// announced one.
+func (s *DFSStateMachine) nodeAddress(id uint64) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.nodes[id]
 }
 
-func encodeCommand(c command) []byte {
-	msg := bytes.NewBuffer(nil)
-	msg.WriteByte(uint8(c.Kind))
-
-	binary.Write(msg, binary.LittleEndian, uint64(len(c.Path)))
-	msg.WriteString(c.Path)
-
-	binary.Write(msg, binary.LittleEndian, uint64(len(c.OldPath)))
-	msg.WriteString(c.OldPath)
+type snapshot struct {
+	// Every directory and file, each directory before its contents.
+	Entries []File            `json:"entries"`
+	Nodes   map[uint64]string `json:"nodes,omitempty"`
+}
 
-	binary.Write(msg, binary.LittleEndian, uint64(len(c.NewPath)))
-	msg.WriteString(c.NewPath)
+func (s *DFSStateMachine) Snapshot() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	binary.Write(msg, binary.LittleEndian, uint64(c.Size))
+	snap := snapshot{Nodes: s.nodes}
+	walk(s.ns.root, true, func(n *node) bool {
+		snap.Entries = append(snap.Entries, n.File)
+		return true
+	})
 
-	return msg.Bytes()
+	return json.Marshal(snap)
 }
 
-func decodeCommand(msg []byte) command {
-	var c command
-	buf := bytes.NewBuffer(msg)
+func (s *DFSStateMachine) Restore(data []byte) error {
+	return s.RestoreIndex(s.AppliedIndex(), data)
+}
 
-	c.Kind = commandKind(buf.Next(1)[0])
+// RestoreIndex replaces the namespace with a snapshot taken at index,
+// and saves it in place of everything stored before.
+func (s *DFSStateMachine) RestoreIndex(index uint64, data []byte) error {
+	// Snapshots taken before node addresses were replicated are just
+	// the list of entries. An empty one resets the state machine.
+	var snap snapshot
+	var err error
+	switch trimmed := strings.TrimSpace(string(data)); {
+	case trimmed == "":
+	case strings.HasPrefix(trimmed, "["):
+		err = json.Unmarshal(data, &snap.Entries)
+	default:
+		err = json.Unmarshal(data, &snap)
+	}
+	if err != nil {
+		return err
+	}
 
-	var pathLen, oldPathLen, newPathLen, size uint64
-	binary.Read(buf, binary.LittleEndian, &pathLen)
-	c.Path = string(buf.Next(int(pathLen)))
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	binary.Read(buf, binary.LittleEndian, &oldPathLen)
-	c.OldPath = string(buf.Next(int(oldPathLen)))
+	s.nodes = snap.Nodes
+	if s.nodes == nil {
+		s.nodes = map[uint64]string{}
+	}
+	if err := s.load(snap.Entries); err != nil {
+		return err
+	}
 
-	binary.Read(buf, binary.LittleEndian, &newPathLen)
-	c.NewPath = string(buf.Next(int(newPathLen)))
+	stored := map[string][]byte{appliedKey: encodeIndex(index)}
+	for id, address := range s.nodes {
+		stored[nodeKey(id)] = []byte(address)
+	}
+	walk(s.ns.root, true, func(n *node) bool {
+		stored[fileKey(n.Name)], _ = json.Marshal(n.File)
+		return true
+	})
+	if err := s.kv.reset(stored); err != nil {
+		return err
+	}
+	s.pending = map[string][]byte{}
+	s.applied = index
+	s.unsaved = false
 
-	binary.Read(buf, binary.LittleEndian, &size)
-	c.Size = int64(size)
+	log.Printf("Restored snapshot at index %d: %d entries", index, len(snap.Entries))
+	return nil
+}
 
-	return c
+// load rebuilds the namespace from entries in any order, and looks for
+// the content of files this node doesn't have yet. Called with s.mu
+// held, or before s is in use.
+func (s *DFSStateMachine) load(entries []File) error {
+	// Snapshots taken before directories existed hold only files;
+	// their directories are created along the way.
+	s.ns = newNamespace()
+	for _, f := range entries {
+		f.Name = cleanPath(f.Name)
+		if f.Dir {
+			if n, err := s.ns.mkdirAll(f.Name, f.LastModified); err == nil {
+				n.LastModified = f.LastModified
+			}
+			os.MkdirAll(s.diskPath(f.Name), 0755)
+			continue
+		}
+		if _, err := s.ns.put(f); err != nil {
+			return err
+		}
+		if !exists(s.diskPath(f.Name)) && !s.place(f.Name, f.Hash) {
+			s.blobs.want(f.Hash)
+		}
+	}
+	s.ns.flush()
+	return nil
 }
 
 type httpServer struct {
 	raft         *goraft.Server
 	stateMachine *DFSStateMachine
+	blobs        *blobStore
+	dataDir      string
+	// This node's HTTP URL as other nodes reach it.
+	advertise string
+
+	// Started when this node becomes leader and cancelled when it
+	// steps down.
+	leaderTasks []func(ctx context.Context)
+
+	// Closed on shutdown to end the event streams, which would
+	// otherwise hold the HTTP server open.
+	closing chan struct{}
+}
+
+// watchLeadership starts and stops the leader-only tasks as leadership
+// moves to and away from this node.
+func (hs *httpServer) watchLeadership() {
+	events := make(chan goraft.Event, 256)
+	hs.raft.Observe(events)
+
+	// Check the server itself rather than trusting each event, in case
+	// a leadership change was dropped from a full channel.
+	var cancel context.CancelFunc
+	update := func() {
+		leading := hs.raft.IsLeader()
+		if leading == (cancel != nil) {
+			return
+		}
+
+		if leading {
+			log.Printf("Became leader, starting %d leader tasks", len(hs.leaderTasks))
+			var ctx context.Context
+			ctx, cancel = context.WithCancel(context.Background())
+			for _, task := range hs.leaderTasks {
+				go task(ctx)
+			}
+		} else {
+			log.Printf("No longer leader, stopping leader tasks")
+			cancel()
+			cancel = nil
+		}
+	}
+
+	update()
+	for range events {
+		update()
+	}
 }
 
 func (hs *httpServer) statusHandler(w http.ResponseWriter, r *http.Request) {
 	isLeader := hs.raft.IsLeader()
+	leaderURL := hs.leaderURL()
+	if isLeader {
+		leaderURL = hs.advertise
+	}
 	status := map[string]interface{}{
-		"node_id":   hs.raft.Id(),
-		"is_leader": isLeader,
-		"status":    "healthy",
-		"timestamp": time.Now(),
+		"node_id":    hs.raft.Id(),
+		"is_leader":  isLeader,
+		"leader_id":  hs.raft.Leader(),
+		"leader_url": leaderURL,
+		"status":     "healthy",
+		"timestamp":  time.Now(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
+// eventsHandler streams this node's Raft events (leader changes, new
+// terms, commits, unreachable peers) as server-sent events, so clients
+// don't have to poll /status.
+func (hs *httpServer) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := make(chan goraft.Event, 64)
+	stop := hs.raft.Observe(events)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-hs.closing:
+			return
+		case e := <-events:
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (hs *httpServer) clusterHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hs.raft.Members())
+}
+
+func (hs *httpServer) membershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id == 0 {
+		http.Error(w, "Expected non-zero integer for id", http.StatusBadRequest)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/cluster/add":
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "Missing address", http.StatusBadRequest)
+			return
+		}
+		priority := 0
+		if p := r.URL.Query().Get("priority"); p != "" {
+			priority, err = strconv.Atoi(p)
+			if err != nil {
+				http.Error(w, "Expected integer for priority", http.StatusBadRequest)
+				return
+			}
+		}
+		switch r.URL.Query().Get("role") {
+		case "", "voter":
+			log.Printf("Received AddMember request for node %d (%s) with priority %d", id, address, priority)
+			err = hs.raft.AddMember(id, address, priority)
+		case "learner":
+			log.Printf("Received AddLearner request for node %d (%s) with priority %d", id, address, priority)
+			err = hs.raft.AddLearner(id, address, priority)
+		default:
+			http.Error(w, "Expected role voter or learner", http.StatusBadRequest)
+			return
+		}
+
+	case "/cluster/promote":
+		log.Printf("Received PromoteLearner request for node %d", id)
+		err = hs.raft.PromoteLearner(id)
+
+	case "/cluster/remove":
+		log.Printf("Received RemoveMember request for node %d", id)
+		err = hs.raft.RemoveMember(id)
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	switch err {
+	case nil:
+	case goraft.ErrApplyToLeader:
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
+		return
+	case goraft.ErrLeadershipLost:
+		http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		return
+	case goraft.ErrMemberExists, goraft.ErrConfigChangeInProgress,
+		goraft.ErrNotLearner, goraft.ErrLearnerBehind:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case goraft.ErrUnknownMember:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		log.Printf("Membership change error: %s", err)
+		http.Error(w, "Failed to change cluster membership", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(hs.raft.Members())
+}
+
+func (hs *httpServer) transferLeadershipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// An empty id lets the leader pick the most up-to-date follower.
+	var id uint64
+	if v := r.URL.Query().Get("id"); v != "" {
+		var err error
+		id, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Expected integer for id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	log.Printf("Received TransferLeadership request to node %d", id)
+	err := hs.raft.TransferLeadership(id)
+	switch err {
+	case nil:
+	case goraft.ErrApplyToLeader:
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
+		return
+	case goraft.ErrLeadershipTransferInProgress, goraft.ErrNotVoter:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case goraft.ErrUnknownMember:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		log.Printf("Leadership transfer error: %s", err)
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+
+	fmt.Fprintf(w, "Node %d is no longer the leader", hs.raft.Id())
+}
+
+// How long a read waits for the leader to confirm it is up to date.
+const readTimeout = 5 * time.Second
+
+// consistentRead waits until the local state machine is recent enough
+// for the consistency level in the request's query string:
+//
+//	linearizable (default)  reflects every write that completed before the request, leader only
+//	lease                   same, but trusts the leader's lease instead of a round of heartbeats
+//	stale                   whatever this node has applied so far, any node
+//
+// If the read can't be served here it forwards the request to the
+// leader or writes the error, and returns false.
+func (hs *httpServer) consistentRead(w http.ResponseWriter, r *http.Request) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), readTimeout)
+	defer cancel()
+
+	var err error
+	switch level := r.URL.Query().Get("consistency"); level {
+	case "", "linearizable":
+		_, err = hs.raft.ReadIndex(ctx)
+	case "lease":
+		_, err = hs.raft.LeaseRead(ctx)
+	case "stale":
+	default:
+		http.Error(w, fmt.Sprintf("Unknown consistency level '%s'", level), http.StatusBadRequest)
+		return false
+	}
+
+	switch err {
+	case nil:
+		return true
+	case goraft.ErrApplyToLeader:
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node or use consistency=stale", http.StatusServiceUnavailable)
+		}
+	case context.DeadlineExceeded:
+		http.Error(w, "Timed out confirming leadership", http.StatusGatewayTimeout)
+	default:
+		log.Printf("Read error: %s", err)
+		http.Error(w, "Failed to read", http.StatusInternalServerError)
+	}
+	return false
+}
+
+// listFilesHandler returns every file in the tree as a flat JSON
+// array, in name order. Directories are listed under /dirs/.
 func (hs *httpServer) listFilesHandler(w http.ResponseWriter, r *http.Request) {
-	var files []File
-	hs.stateMachine.files.Range(func(key, value interface{}) bool {
-		files = append(files, *value.(*File))
+	if !hs.consistentRead(w, r) {
+		return
+	}
+
+	files := []File{}
+	hs.stateMachine.mu.RLock()
+	walk(hs.stateMachine.ns.root, true, func(n *node) bool {
+		if !n.Dir {
+			files = append(files, n.File)
+		}
 		return true
 	})
+	hs.stateMachine.mu.RUnlock()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(files)
 }
 
+// How many entries a directory listing returns unless asked for fewer,
+// and the most it returns at once.
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// dirHandler serves /dirs/<path>: GET lists the directory, POST creates
+// it (or renames it with ?to=<new path>) and DELETE removes it if it is
+// empty.
+func (hs *httpServer) dirHandler(w http.ResponseWriter, r *http.Request) {
+	name := cleanPath(strings.TrimPrefix(r.URL.Path, "/dirs"))
+
+	switch r.Method {
+	case http.MethodGet:
+		hs.listDir(w, r, name)
+	case http.MethodPost:
+		if r.URL.Query().Get("to") != "" {
+			hs.renameFile(w, r, name)
+			return
+		}
+		hs.applyDir(w, r, command.MakeDir, name)
+	case http.MethodDelete:
+		hs.applyDir(w, r, command.RemoveDir, name)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listDir writes a page of the entries in directory name:
+//
+//	recursive=true  include everything below name, not just its children
+//	prefix          only names starting with this, relative to name unless absolute
+//	after           only names after this one, as returned in next
+//	limit           at most this many entries
+//
+// next is set to the last name returned when there are more to fetch.
+func (hs *httpServer) listDir(w http.ResponseWriter, r *http.Request, name string) {
+	q := r.URL.Query()
+
+	limit := defaultListLimit
+	if v := q.Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Expected positive integer for limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxListLimit {
+			limit = maxListLimit
+		}
+	}
+
+	prefix := q.Get("prefix")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = strings.TrimSuffix(name, "/") + "/" + prefix
+	}
+
+	if !hs.consistentRead(w, r) {
+		return
+	}
+
+	hs.stateMachine.mu.RLock()
+	dir := hs.stateMachine.ns.lookup(name)
+	var entries []File
+	var more bool
+	if dir != nil && dir.Dir {
+		entries, more = list(dir, q.Get("recursive") == "true", prefix, q.Get("after"), limit)
+	}
+	hs.stateMachine.mu.RUnlock()
+
+	if dir == nil {
+		http.Error(w, "Directory not found", http.StatusNotFound)
+		return
+	}
+	if !dir.Dir {
+		http.Error(w, "Not a directory", http.StatusBadRequest)
+		return
+	}
+
+	page := struct {
+		Entries []File `json:"entries"`
+		Next    string `json:"next,omitempty"`
+	}{Entries: entries}
+	if page.Entries == nil {
+		page.Entries = []File{}
+	}
+	if more {
+		page.Next = entries[len(entries)-1].Name
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (hs *httpServer) applyDir(w http.ResponseWriter, r *http.Request, kind command.Kind, name string) {
+	if !hs.raft.IsLeader() {
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	log.Printf("Received %s request for %s", kind, name)
+	cmd := command.Command{
+		Kind: kind,
+		Path: name,
+	}
+	if !hs.apply(w, r, cmd) {
+		return
+	}
+
+	if kind == command.MakeDir {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "Directory '%s' created", name)
+		return
+	}
+	fmt.Fprintf(w, "Directory '%s' removed", name)
+}
+
 func (hs *httpServer) createFileHandler(w http.ResponseWriter, r *http.Request) {
+	// Files are named by the path they were uploaded to, so that is
+	// where they are downloaded from too.
+	if r.Method == http.MethodGet {
+		hs.getFileHandler(w, r)
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	if !hs.raft.IsLeader() {
-		http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
 		return
 	}
 
 	filePath := r.URL.Path
 	log.Printf("Received CreateFile request for %s", filePath)
 
-	dataDir := "./data"
-	os.MkdirAll(dataDir, 0755)
-
-	dataFilePath := filepath.Join(dataDir, filepath.Base(filePath))
-	file, err := os.Create(dataFilePath)
+	// The content is stored before the command is replicated, so it is
+	// here for the followers to fetch as soon as they apply it.
+	hash, n, err := hs.blobs.write(r.Body, "", true)
 	if err != nil {
-		http.Error(w, "Failed to create local file", http.StatusInternalServerError)
+		log.Printf("Storing content for %s: %s", filePath, err)
+		http.Error(w, "Failed to write file content", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	defer hs.blobs.unpin(hash)
 
-	n, err := io.Copy(file, r.Body)
-	if err != nil {
-		http.Error(w, "Failed to write file content", http.StatusInternalServerError)
-		return
+	cmd := command.Command{
+		Kind:   command.CreateFile,
+		Path:   filePath,
+		Size:   n,
+		Hash:   hash,
+		Origin: hs.advertise,
 	}
 
-	cmd := command{
-		Kind: CreateFile,
-		Path: filePath,
-		Size: n,
+	// Confirmations can arrive as soon as followers apply the command,
+	// before it is applied here.
+	stopExpecting := hs.blobs.expect(hash)
+	defer stopExpecting()
+
+	if !hs.apply(w, r, cmd) {
+		return
 	}
 
-	_, err = hs.raft.Apply([][]byte{encodeCommand(cmd)})
-	if err != nil {
-		log.Printf("Raft Apply error: %s", err)
-		http.Error(w, "Failed to replicate file metadata", http.StatusInternalServerError)
+	ctx, cancel := context.WithTimeout(r.Context(), blobConfirmTimeout)
+	defer cancel()
+	if !hs.blobs.waitConfirmed(ctx, hash, hs.majorityHas) {
+		log.Printf("Content of %s not confirmed by a majority", filePath)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "File '%s' created (%d bytes), but its content is not yet stored on a majority of nodes", filePath, n)
 		return
 	}
 
@@ -199,40 +997,331 @@ func (hs *httpServer) createFileHandler(w http.ResponseWriter, r *http.Request)
 	fmt.Fprintf(w, "File '%s' created successfully (%d bytes)", filePath, n)
 }
 
+// majorityHas reports whether this node and the nodes that confirmed
+// content are a majority of the voters.
+func (hs *httpServer) majorityHas(confirmed map[uint64]bool) bool {
+	voters, have := 0, 0
+	for _, m := range hs.raft.Members() {
+		if m.Role == goraft.Learner {
+			continue
+		}
+		voters++
+		if m.Id == hs.raft.Id() || confirmed[m.Id] {
+			have++
+		}
+	}
+	return have > voters/2
+}
+
+// sessionHandler registers a client session. Writes that pass the
+// returned client id along with a sequence number are applied exactly
+// once, however often they are retried.
+func (hs *httpServer) sessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+
+	id, err := hs.raft.RegisterClient(ctx)
+	if err == goraft.ErrApplyToLeader && hs.forward(w, r) {
+		return
+	} else if err == goraft.ErrApplyToLeader || err == goraft.ErrLeadershipTransferInProgress || err == goraft.ErrLeadershipLost {
+		http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		return
+	} else if err == context.DeadlineExceeded {
+		http.Error(w, "Timed out registering client", http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
+		log.Printf("Register client error: %s", err)
+		http.Error(w, "Failed to register client", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{"client_id": id})
+}
+
+// How long a write waits to be committed and applied.
+const writeTimeout = 10 * time.Second
+
+// How long in-flight requests and Raft goroutines get to finish when
+// the node is asked to shut down.
+const shutdownTimeout = 10 * time.Second
+
+// apply replicates c, stamped with this node's clock, within the
+// client session named by the request's client and seq parameters if
+// it has them. If the command fails it writes the error and returns
+// false.
+func (hs *httpServer) apply(w http.ResponseWriter, r *http.Request, c command.Command) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), writeTimeout)
+	defer cancel()
+
+	c.Time = time.Now().UnixNano()
+	cmd := command.Encode(c)
+
+	var results []goraft.ApplyResult
+	var err error
+
+	if client := r.URL.Query().Get("client"); client == "" {
+		results, err = hs.raft.ApplyContext(ctx, [][]byte{cmd})
+	} else {
+		clientId, clientErr := strconv.ParseUint(client, 10, 64)
+		seq, seqErr := strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		if clientErr != nil || seqErr != nil {
+			http.Error(w, "Expected integers for client and seq", http.StatusBadRequest)
+			return false
+		}
+		results, err = hs.raft.ApplySession(ctx, clientId, seq, [][]byte{cmd})
+	}
+
+	if err == nil {
+		err = results[0].Error
+		// A retried session write gets back a copy of the state
+		// machine's error, so those are matched by message.
+		for _, e := range []error{errFileNotFound, errFileExists, errNotDirectory,
+			errIsDirectory, errDirNotEmpty, errInvalidMove, errRootDirectory} {
+			if err != nil && err.Error() == e.Error() {
+				err = e
+			}
+		}
+	}
+
+	switch err {
+	case nil:
+		return true
+	case errFileNotFound:
+		http.Error(w, "File not found", http.StatusNotFound)
+	case errFileExists:
+		http.Error(w, "A file with that name already exists", http.StatusConflict)
+	case errNotDirectory, errIsDirectory, errDirNotEmpty, errInvalidMove, errRootDirectory:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case goraft.ErrApplyToLeader, goraft.ErrLeadershipTransferInProgress:
+		http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+	case goraft.ErrLeadershipLost:
+		http.Error(w, "Leader stepped down before the write was committed; it may or may not have been applied", http.StatusServiceUnavailable)
+	case context.DeadlineExceeded:
+		http.Error(w, "Timed out waiting for the write to commit; it may or may not have been applied", http.StatusGatewayTimeout)
+	case goraft.ErrSessionExpired, goraft.ErrResultDiscarded:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("Raft Apply error: %s", err)
+		http.Error(w, "Failed to replicate file metadata", http.StatusInternalServerError)
+	}
+	return false
+}
+
 func (hs *httpServer) getFileHandler(w http.ResponseWriter, r *http.Request) {
-	filePath := r.URL.Path
+	hs.serveFile(w, r, r.URL.Path)
+}
+
+// fileHandler serves /files/<name>: GET downloads the file, DELETE
+// deletes it and POST with ?to=<new name> renames it. Names are full
+// paths, such as /upload/report.txt.
+func (hs *httpServer) fileHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/files")
+
+	switch r.Method {
+	case http.MethodGet:
+		hs.serveFile(w, r, name)
+	case http.MethodDelete:
+		hs.deleteFile(w, r, name)
+	case http.MethodPost:
+		hs.renameFile(w, r, name)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (hs *httpServer) deleteFile(w http.ResponseWriter, r *http.Request, name string) {
+	if !hs.raft.IsLeader() {
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	log.Printf("Received DeleteFile request for %s", name)
+	cmd := command.Command{
+		Kind: command.DeleteFile,
+		Path: name,
+	}
+	if !hs.apply(w, r, cmd) {
+		return
+	}
+
+	fmt.Fprintf(w, "File '%s' deleted", name)
+}
+
+func (hs *httpServer) renameFile(w http.ResponseWriter, r *http.Request, name string) {
+	to := r.URL.Query().Get("to")
+	if to == "" {
+		http.Error(w, "Missing to", http.StatusBadRequest)
+		return
+	}
+	if !strings.HasPrefix(to, "/") {
+		to = "/" + to
+	}
+
+	if !hs.raft.IsLeader() {
+		if !hs.forward(w, r) {
+			http.Error(w, "Not the leader - try another node", http.StatusServiceUnavailable)
+		}
+		return
+	}
+
+	log.Printf("Received RenameFile request for %s -> %s", name, to)
+	cmd := command.Command{
+		Kind:    command.RenameFile,
+		OldPath: name,
+		NewPath: to,
+	}
+	if !hs.apply(w, r, cmd) {
+		return
+	}
+
+	fmt.Fprintf(w, "File '%s' renamed to '%s'", name, to)
+}
+
+func (hs *httpServer) serveFile(w http.ResponseWriter, r *http.Request, filePath string) {
 	log.Printf("Received GetFile request for %s", filePath)
 
-	_, ok := hs.stateMachine.files.Load(filePath)
-	if !ok {
+	if !hs.consistentRead(w, r) {
+		return
+	}
+
+	sm := hs.stateMachine
+	name := cleanPath(filePath)
+	sm.mu.RLock()
+	var f File
+	n := sm.ns.lookup(name)
+	if n != nil {
+		f = n.File
+	}
+	sm.mu.RUnlock()
+
+	if n == nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if f.Dir {
+		http.Error(w, "Is a directory", http.StatusBadRequest)
+		return
+	}
 
-	dataDir := "./data"
-	dataFilePath := filepath.Join(dataDir, filepath.Base(filePath))
+	if f.Hash == "" {
+		dataFilePath := sm.legacyPath(name)
+		if !exists(dataFilePath) {
+			http.Error(w, "File content not found locally", http.StatusNotFound)
+			return
+		}
+		http.ServeFile(w, r, dataFilePath)
+		return
+	}
 
-	if _, err := os.Stat(dataFilePath); os.IsNotExist(err) {
-		http.Error(w, "File content not found locally", http.StatusNotFound)
+	// Content that hasn't arrived yet is fetched now rather than
+	// waiting for the background fetcher.
+	if !exists(sm.diskPath(name)) {
+		if err := hs.blobs.fetch(r.Context(), f.Hash); err != nil {
+			log.Printf("Fetching content of %s: %s", name, err)
+			http.Error(w, "File content not available from any node", http.StatusBadGateway)
+			return
+		}
+	}
+
+	content, err := os.Open(sm.diskPath(name))
+	if err != nil {
+		http.Error(w, "Failed to read file content", http.StatusInternalServerError)
 		return
 	}
+	defer content.Close()
+	http.ServeContent(w, r, path.Base(name), f.LastModified, content)
+}
 
-	http.ServeFile(w, r, dataFilePath)
+// blobHandler serves content to peers by hash, from wherever this node
+// keeps it.
+func (hs *httpServer) blobHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	if !validHash(hash) {
+		http.Error(w, "Expected a SHA-256 hash", http.StatusBadRequest)
+		return
+	}
+
+	// A node that has placed content uploaded here confirms it.
+	if r.Method == http.MethodPost {
+		node, err := strconv.ParseUint(r.URL.Query().Get("node"), 10, 64)
+		if err != nil || node == 0 {
+			http.Error(w, "Expected non-zero integer for node", http.StatusBadRequest)
+			return
+		}
+		hs.blobs.confirmedBy(hash, node)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	hs.stateMachine.mu.RLock()
+	src := hs.stateMachine.local(hash)
+	var content *os.File
+	var err error
+	if src != "" {
+		content, err = os.Open(src)
+	}
+	hs.stateMachine.mu.RUnlock()
+
+	if src == "" || err != nil {
+		http.Error(w, "Content not stored on this node", http.StatusNotFound)
+		return
+	}
+	defer content.Close()
+	http.ServeContent(w, r, hash, time.Time{}, content)
+}
+
+func (hs *httpServer) register(mux *http.ServeMux) {
+	mux.HandleFunc("/status", hs.statusHandler)
+	mux.HandleFunc("/events", hs.eventsHandler)
+	mux.HandleFunc("/files", hs.listFilesHandler)
+	mux.HandleFunc("/files/", hs.fileHandler)
+	mux.HandleFunc("/cluster", hs.clusterHandler)
+	mux.HandleFunc("/cluster/", hs.membershipHandler)
+	mux.HandleFunc("/admin/transfer-leadership", hs.transferLeadershipHandler)
+	mux.HandleFunc("/session", hs.sessionHandler)
+	mux.HandleFunc("/upload/", hs.createFileHandler)
+	mux.HandleFunc("/dirs/", hs.dirHandler)
+	mux.HandleFunc("/blobs/", hs.blobHandler)
+	mux.HandleFunc("/", hs.getFileHandler)
 }
 
 type config struct {
-	cluster []goraft.ClusterMember
-	index   int
-	http    string
+	cluster   []goraft.ClusterMember
+	index     int
+	http      string
+	advertise string
+	data      string
+	join      bool
+
+	tlsCert string
+	tlsKey  string
+	tlsCA   string
 }
 
 func getConfig() config {
 	cfg := config{}
 	var node string
 
-	for i := 0; i < len(os.Args)-1; i++ {
+	for i := 0; i < len(os.Args); i++ {
 		arg := os.Args[i]
 
+		if arg == "--join" {
+			cfg.join = true
+			continue
+		}
+
+		if i == len(os.Args)-1 {
+			break
+		}
+
 		if arg == "--node" {
 			var err error
 			node = os.Args[i+1]
@@ -250,12 +1339,42 @@ func getConfig() config {
 			continue
 		}
 
+		if arg == "--advertise" {
+			cfg.advertise = os.Args[i+1]
+			i++
+			continue
+		}
+
+		if arg == "--data" {
+			cfg.data = os.Args[i+1]
+			i++
+			continue
+		}
+
+		if arg == "--tls-cert" {
+			cfg.tlsCert = os.Args[i+1]
+			i++
+			continue
+		}
+
+		if arg == "--tls-key" {
+			cfg.tlsKey = os.Args[i+1]
+			i++
+			continue
+		}
+
+		if arg == "--tls-ca" {
+			cfg.tlsCA = os.Args[i+1]
+			i++
+			continue
+		}
+
 		if arg == "--cluster" {
 			cluster := os.Args[i+1]
 			for _, part := range strings.Split(cluster, ";") {
 				idAddress := strings.Split(part, ",")
-				if len(idAddress) != 2 {
-					log.Fatalf("Invalid cluster format. Expected: id,address")
+				if len(idAddress) != 2 && len(idAddress) != 3 {
+					log.Fatalf("Invalid cluster format. Expected: id,address[,priority]")
 				}
 
 				var clusterEntry goraft.ClusterMember
@@ -265,6 +1384,12 @@ func getConfig() config {
 					log.Fatalf("Expected integer for cluster ID, got: %s", idAddress[0])
 				}
 				clusterEntry.Address = idAddress[1]
+				if len(idAddress) == 3 {
+					clusterEntry.Priority, err = strconv.Atoi(idAddress[2])
+					if err != nil {
+						log.Fatalf("Expected integer for priority, got: %s", idAddress[2])
+					}
+				}
 				cfg.cluster = append(cfg.cluster, clusterEntry)
 			}
 			i++
@@ -281,6 +1406,16 @@ func getConfig() config {
 	if len(cfg.cluster) == 0 {
 		log.Fatal("Missing required parameter: --cluster <id1,addr1;id2,addr2;...>")
 	}
+	if cfg.advertise == "" {
+		host := cfg.http
+		if strings.HasPrefix(host, ":") {
+			host = "localhost" + host
+		}
+		cfg.advertise = "http://" + host
+	}
+	if cfg.data == "" {
+		cfg.data = "./data"
+	}
 
 	return cfg
 }
@@ -295,10 +1430,24 @@ func main() {
 
 	cfg := getConfig()
 
-	sm := NewDFSStateMachine()
+	blobs := newBlobStore(filepath.Join(cfg.data, "blobs"))
+	sm, err := NewDFSStateMachine(blobs, cfg.data, cfg.advertise)
+	if err != nil {
+		log.Fatalf("Loading state from %s: %s", cfg.data, err)
+	}
 
-	s := goraft.NewServer(cfg.cluster, sm, ".", cfg.index)
-	s.Debug = true
+	s, err := goraft.NewServer(cfg.cluster, sm, goraft.Config{
+		MetadataDir: ".",
+		Debug:       true,
+		TLSCertFile: cfg.tlsCert,
+		TLSKeyFile:  cfg.tlsKey,
+		TLSCAFile:   cfg.tlsCA,
+	}, cfg.index)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Joining = cfg.join
+	blobs.node = s.Id()
 
 	go s.Start()
 	time.Sleep(500 * time.Millisecond)
@@ -306,18 +1455,52 @@ func main() {
 	hs := &httpServer{
 		raft:         s,
 		stateMachine: sm,
+		blobs:        blobs,
+		dataDir:      cfg.data,
+		advertise:    cfg.advertise,
+		closing:      make(chan struct{}),
 	}
+	hs.leaderTasks = append(hs.leaderTasks, hs.announceAddress)
+	go hs.watchLeadership()
 
-	http.HandleFunc("/status", hs.statusHandler)
-	http.HandleFunc("/files", hs.listFilesHandler)
-	http.HandleFunc("/upload/", hs.createFileHandler)
-	http.HandleFunc("/", hs.getFileHandler)
+	fetchCtx, stopFetching := context.WithCancel(context.Background())
+	go blobs.run(fetchCtx)
+
+	hs.register(http.DefaultServeMux)
 
 	log.Printf("Node %d starting HTTP server on %s", s.Id(), cfg.http)
-	log.Printf("Cluster: %d nodes", len(cfg.cluster))
+	if cfg.join {
+		log.Printf("Joining existing cluster; waiting to be added by the leader")
+	} else {
+		log.Printf("Cluster: %d nodes", len(cfg.cluster))
+	}
 
-	err = http.ListenAndServe(cfg.http, nil)
-	if err != nil {
+	srv := &http.Server{Addr: cfg.http}
+	srv.RegisterOnShutdown(func() { close(hs.closing) })
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Printf("Shutting down")
+		stopFetching()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("HTTP server shutdown: %s", err)
+		}
+		if err := s.Stop(ctx); err != nil {
+			log.Printf("Raft server shutdown: %s", err)
+		}
+	}()
+
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
 		panic(err)
 	}
+	<-stopped
 }
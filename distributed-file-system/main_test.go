@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-file-system/command"
+	"distributed-file-system/goraft"
+)
+
+// startTestCluster runs n DFS nodes inside the test, talking Raft over
+// an in-memory network and serving HTTP on test servers.
+func startTestCluster(t *testing.T, n int) []*httpServer {
+	nodes := newTestCluster(t, n)
+	for _, hs := range nodes {
+		hs.raft.Start()
+	}
+	return nodes
+}
+
+// newTestCluster is startTestCluster without starting Raft.
+func newTestCluster(t *testing.T, n int) []*httpServer {
+	network := goraft.NewInmemNetwork()
+	var cluster []goraft.ClusterMember
+	for i := 1; i <= n; i++ {
+		cluster = append(cluster, goraft.ClusterMember{Id: uint64(i), Address: fmt.Sprintf("node%d", i)})
+	}
+
+	var nodes []*httpServer
+	for i := range cluster {
+		dir := t.TempDir()
+		mux := http.NewServeMux()
+		srv := httptest.NewServer(mux)
+		t.Cleanup(srv.Close)
+
+		blobs := newBlobStore(filepath.Join(dir, "blobs"))
+		sm, err := NewDFSStateMachine(blobs, dir, srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { sm.kv.fd.Close() })
+
+		s, err := goraft.NewServer(cluster, sm, goraft.Config{
+			MetadataDir: dir,
+			Fsync:       goraft.FsyncNever,
+			LogOutput:   io.Discard,
+		}, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Transport = network.NewTransport()
+		blobs.node = s.Id()
+		t.Cleanup(func() { s.Stop(context.Background()) })
+
+		hs := &httpServer{
+			raft:         s,
+			stateMachine: sm,
+			blobs:        blobs,
+			dataDir:      dir,
+			advertise:    srv.URL,
+			closing:      make(chan struct{}),
+		}
+		hs.register(mux)
+		nodes = append(nodes, hs)
+	}
+	return nodes
+}
+
+func waitFor(t *testing.T, msg string, cond func() bool) {
+	for i := 0; i < 500; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %s", msg)
+}
+
+// waitForLeader returns the leader once one is elected.
+func waitForLeader(t *testing.T, nodes []*httpServer) *httpServer {
+	var leader *httpServer
+	waitFor(t, "a leader", func() bool {
+		for _, hs := range nodes {
+			if hs.raft.IsLeader() {
+				leader = hs
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+// do sends a request to hs and returns the status and body of the
+// response.
+func do(t *testing.T, hs *httpServer, method, path, body string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, hs.advertise+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	b, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rsp.StatusCode, string(b)
+}
+
+func Test_delete_and_rename(t *testing.T) {
+	hs := waitForLeader(t, startTestCluster(t, 1))
+
+	for name, content := range map[string]string{"a.txt": "one", "b.txt": "two"} {
+		if code, body := do(t, hs, http.MethodPost, "/upload/"+name, content); code != http.StatusCreated {
+			t.Fatalf("Uploading %s: %d %s", name, code, body)
+		}
+	}
+	expectContent := func(name, content string) {
+		t.Helper()
+		if code, body := do(t, hs, http.MethodGet, "/files/upload/"+name, ""); code != http.StatusOK || body != content {
+			t.Errorf("Expected %s to hold %q, got %d %q", name, content, code, body)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		code   int
+	}{
+		{"delete a missing file", http.MethodDelete, "/files/upload/missing.txt", http.StatusNotFound},
+		{"rename a missing file", http.MethodPost, "/files/upload/missing.txt?to=/upload/c.txt", http.StatusNotFound},
+		{"rename onto an existing file", http.MethodPost, "/files/upload/a.txt?to=/upload/b.txt", http.StatusConflict},
+	} {
+		if code, body := do(t, hs, tc.method, tc.path, ""); code != tc.code {
+			t.Errorf("%s: expected %d, got %d %s", tc.name, tc.code, code, body)
+		}
+	}
+	expectContent("a.txt", "one")
+	expectContent("b.txt", "two")
+
+	if code, body := do(t, hs, http.MethodPost, "/files/upload/a.txt?to=/upload/c.txt", ""); code != http.StatusOK {
+		t.Fatalf("Renaming a.txt: %d %s", code, body)
+	}
+	expectContent("c.txt", "one")
+	if code, body := do(t, hs, http.MethodDelete, "/files/upload/c.txt", ""); code != http.StatusOK {
+		t.Fatalf("Deleting c.txt: %d %s", code, body)
+	}
+	if code, _ := do(t, hs, http.MethodGet, "/files/upload/c.txt", ""); code != http.StatusNotFound {
+		t.Errorf("Expected c.txt gone after the delete, got %d", code)
+	}
+}
+
+// stage writes content to s's staging area as an upload would, and
+// returns its hash.
+func stage(t *testing.T, s *DFSStateMachine, content string) string {
+	t.Helper()
+	hash, _, err := s.blobs.write(strings.NewReader(content), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+func applyAll(t *testing.T, s *DFSStateMachine, cmds ...command.Command) {
+	t.Helper()
+	for _, c := range cmds {
+		if _, err := s.Apply(command.Encode(c)); err != nil {
+			t.Fatalf("%s: %s", c, err)
+		}
+	}
+}
+
+func Test_content_removed_with_last_file(t *testing.T) {
+	s := openDFS(t, t.TempDir())
+
+	hello := stage(t, s, "hello")
+	applyAll(t, s,
+		command.Command{Kind: command.CreateFile, Path: "/a", Size: 5, Hash: hello, Origin: s.self},
+		command.Command{Kind: command.CreateFile, Path: "/b", Size: 5, Hash: hello, Origin: s.self},
+	)
+	s.blobs.unpin(hello)
+
+	// Another file still has the content.
+	applyAll(t, s, command.Command{Kind: command.DeleteFile, Path: "/a"})
+	if exists(s.diskPath("/a")) {
+		t.Error("Expected the content of /a removed")
+	}
+	if src := s.local(hello); src != s.diskPath("/b") {
+		t.Fatalf("Expected the content still at /b, got %q", src)
+	}
+
+	// Overwriting the last file with it removes it.
+	bye := stage(t, s, "bye")
+	applyAll(t, s, command.Command{Kind: command.CreateFile, Path: "/b", Size: 3, Hash: bye, Origin: s.self})
+	s.blobs.unpin(bye)
+	if src := s.local(hello); src != "" {
+		t.Errorf("Expected no copy of the old content left, got %q", src)
+	}
+	if content, err := os.ReadFile(s.diskPath("/b")); err != nil || string(content) != "bye" {
+		t.Errorf("Expected /b to hold the new content, got %q (%v)", content, err)
+	}
+}
+
+func Test_pinned_upload_survives_delete(t *testing.T) {
+	s := openDFS(t, t.TempDir())
+
+	hello := stage(t, s, "hello")
+	applyAll(t, s, command.Command{Kind: command.CreateFile, Path: "/a", Size: 5, Hash: hello, Origin: s.self})
+	s.blobs.unpin(hello)
+
+	// A second upload of the same content is staged while /a is
+	// deleted, and the fetcher places what arrived meanwhile.
+	stage(t, s, "hello")
+	applyAll(t, s, command.Command{Kind: command.DeleteFile, Path: "/a"})
+	s.placeAll(hello)
+	if !s.blobs.has(hello) {
+		t.Fatal("Expected the pinned upload to stay staged")
+	}
+
+	applyAll(t, s, command.Command{Kind: command.CreateFile, Path: "/b", Size: 5, Hash: hello, Origin: s.self})
+	s.blobs.unpin(hello)
+	if content, err := os.ReadFile(s.diskPath("/b")); err != nil || string(content) != "hello" {
+		t.Errorf("Expected /b to hold the upload, got %q (%v)", content, err)
+	}
+	if s.blobs.has(hello) {
+		t.Error("Expected the upload unstaged once done")
+	}
+}
+
+func Test_rename_legacy_file(t *testing.T) {
+	s := openDFS(t, t.TempDir())
+
+	// Files uploaded before content was replicated have no hash, and
+	// keep their content under their base name.
+	applyAll(t, s, command.Command{Kind: command.CreateFile, Path: "/upload/old.txt", Size: 5})
+	if err := os.WriteFile(s.legacyPath("/upload/old.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	applyAll(t, s, command.Command{Kind: command.RenameFile, OldPath: "/upload/old.txt", NewPath: "/upload/new.txt"})
+	if exists(s.legacyPath("/upload/old.txt")) {
+		t.Error("Expected the old content moved away")
+	}
+	if content, err := os.ReadFile(s.legacyPath("/upload/new.txt")); err != nil || string(content) != "hello" {
+		t.Errorf("Expected the content under the new name, got %q (%v)", content, err)
+	}
+}
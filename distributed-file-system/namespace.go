@@ -0,0 +1,274 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The namespace is a tree of directories and files under "/". Names
+// are always clean absolute paths with forward slashes, and each
+// entry's File.Name is its full path. Parent directories are created
+// as needed when a file is created or moved into them.
+
+var (
+	errNotDirectory  = errors.New("not a directory")
+	errIsDirectory   = errors.New("is a directory")
+	errDirNotEmpty   = errors.New("directory not empty")
+	errInvalidMove   = errors.New("cannot move a directory into itself")
+	errRootDirectory = errors.New("cannot remove or move the root directory")
+)
+
+type node struct {
+	File
+	// Set for directories.
+	children map[string]*node
+}
+
+func newDir(name string, modified time.Time) *node {
+	return &node{
+		File:     File{Name: name, Dir: true, LastModified: modified},
+		children: map[string]*node{},
+	}
+}
+
+type namespace struct {
+	root *node
+	// The entries added, changed or removed since the last call to
+	// flush, by name, with nil for those removed.
+	changed map[string]*node
+	// The files with each content hash, and how many files were
+	// uploaded to each node, so finding content doesn't mean walking
+	// the whole tree.
+	byHash  map[string]map[*node]bool
+	origins map[string]int
+}
+
+func newNamespace() *namespace {
+	return &namespace{
+		root:    newDir("/", time.Time{}),
+		changed: map[string]*node{},
+		byHash:  map[string]map[*node]bool{},
+		origins: map[string]int{},
+	}
+}
+
+// withHash returns the files with content hash, in name order.
+func (ns *namespace) withHash(hash string) []*node {
+	var files []*node
+	for n := range ns.byHash[hash] {
+		files = append(files, n)
+	}
+	sort.Slice(files, func(i, j int) bool { return pathLess(files[i].Name, files[j].Name) })
+	return files
+}
+
+// index adds the files in the tree at n to byHash and origins, or
+// takes them out again if delta is -1.
+func (ns *namespace) index(n *node, delta int) {
+	if n.Dir {
+		for _, child := range n.children {
+			ns.index(child, delta)
+		}
+		return
+	}
+
+	if ns.origins[n.Origin] += delta; ns.origins[n.Origin] <= 0 {
+		delete(ns.origins, n.Origin)
+	}
+	if n.Hash == "" {
+		return
+	}
+	files := ns.byHash[n.Hash]
+	if delta > 0 {
+		if files == nil {
+			files = map[*node]bool{}
+			ns.byHash[n.Hash] = files
+		}
+		files[n] = true
+	} else if delete(files, n); len(files) == 0 {
+		delete(ns.byHash, n.Hash)
+	}
+}
+
+// flush returns the entries changed since it was last called.
+func (ns *namespace) flush() map[string]*node {
+	changed := ns.changed
+	ns.changed = map[string]*node{}
+	return changed
+}
+
+func cleanPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func components(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
+
+// pathLess orders names component by component, so a directory sorts
+// right before its contents. It is the order walk visits entries in.
+func pathLess(a, b string) bool {
+	ac, bc := components(a), components(b)
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if ac[i] != bc[i] {
+			return ac[i] < bc[i]
+		}
+	}
+	return len(ac) < len(bc)
+}
+
+func (ns *namespace) lookup(p string) *node {
+	n := ns.root
+	for _, part := range components(p) {
+		if n.children == nil {
+			return nil
+		}
+		if n = n.children[part]; n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// mkdirAll returns directory p, creating it and any missing parents.
+func (ns *namespace) mkdirAll(p string, modified time.Time) (*node, error) {
+	n := ns.root
+	for _, part := range components(p) {
+		child := n.children[part]
+		if child == nil {
+			child = newDir(path.Join(n.Name, part), modified)
+			n.children[part] = child
+			ns.changed[child.Name] = child
+		} else if !child.Dir {
+			return nil, errNotDirectory
+		}
+		n = child
+	}
+	return n, nil
+}
+
+// put stores f, replacing any file already there, and returns the file
+// it replaced.
+func (ns *namespace) put(f File) (*node, error) {
+	parent, err := ns.mkdirAll(path.Dir(f.Name), f.LastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	base := path.Base(f.Name)
+	old := parent.children[base]
+	if old != nil && old.Dir {
+		return nil, errIsDirectory
+	}
+	n := &node{File: f}
+	parent.children[base] = n
+	ns.changed[f.Name] = n
+	if old != nil {
+		ns.index(old, -1)
+	}
+	ns.index(n, 1)
+	return old, nil
+}
+
+// remove takes the entry at p, with everything under it, out of the
+// tree.
+func (ns *namespace) remove(p string) {
+	parent := ns.lookup(path.Dir(p))
+	if parent == nil || !parent.Dir {
+		return
+	}
+	n := parent.children[path.Base(p)]
+	if n == nil {
+		return
+	}
+
+	delete(parent.children, path.Base(p))
+	ns.index(n, -1)
+	ns.changed[n.Name] = nil
+	walk(n, true, func(child *node) bool {
+		ns.changed[child.Name] = nil
+		return true
+	})
+}
+
+// move renames the entry at from, with everything under it, to to.
+func (ns *namespace) move(from, to string, modified time.Time) error {
+	if from == "/" || to == "/" {
+		return errRootDirectory
+	}
+	n := ns.lookup(from)
+	if n == nil {
+		return errFileNotFound
+	}
+	if ns.lookup(to) != nil {
+		return errFileExists
+	}
+	if n.Dir && strings.HasPrefix(to, from+"/") {
+		return errInvalidMove
+	}
+
+	parent, err := ns.mkdirAll(path.Dir(to), modified)
+	if err != nil {
+		return err
+	}
+	ns.remove(from)
+	parent.children[path.Base(to)] = n
+	ns.rename(n, to)
+	ns.index(n, 1)
+	n.LastModified = modified
+	return nil
+}
+
+func (ns *namespace) rename(n *node, name string) {
+	n.Name = name
+	ns.changed[name] = n
+	for base, child := range n.children {
+		ns.rename(child, path.Join(name, base))
+	}
+}
+
+// walk calls fn on every entry in directory n in name order,
+// descending into subdirectories if recursive, until fn returns false.
+func walk(n *node, recursive bool, fn func(*node) bool) bool {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := n.children[name]
+		if !fn(child) {
+			return false
+		}
+		if recursive && child.Dir && !walk(child, true, fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// list returns up to limit entries of directory dir whose names start
+// with prefix and sort after after, and whether there are more.
+func list(dir *node, recursive bool, prefix, after string, limit int) ([]File, bool) {
+	var entries []File
+	more := false
+	walk(dir, recursive, func(n *node) bool {
+		if !strings.HasPrefix(n.Name, prefix) || (after != "" && !pathLess(after, n.Name)) {
+			return true
+		}
+		if len(entries) == limit {
+			more = true
+			return false
+		}
+		entries = append(entries, n.File)
+		return true
+	})
+	return entries, more
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testNamespace holds the directories and files given by name, files
+// being those without a trailing slash.
+func testNamespace(t *testing.T, names ...string) *namespace {
+	ns := newNamespace()
+	for _, name := range names {
+		var err error
+		if name[len(name)-1] == '/' {
+			_, err = ns.mkdirAll(cleanPath(name), time.Time{})
+		} else {
+			_, err = ns.put(File{Name: name})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ns.flush()
+	return ns
+}
+
+func names(files []File) []string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	return names
+}
+
+func Test_pathLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		less bool
+	}{
+		{"/", "/a", true},
+		{"/a", "/", false},
+		{"/a", "/a", false},
+		{"/a", "/b", true},
+		{"/a", "/a/b", true},
+		{"/a/b", "/a", false},
+		// "/a/z" is under "/a", which sorts before "/a-b" even though
+		// '-' sorts before '/'.
+		{"/a/z", "/a-b", true},
+		{"/a-b", "/a/z", false},
+		{"/a/b/c", "/a/c", true},
+	}
+
+	for _, test := range tests {
+		if got := pathLess(test.a, test.b); got != test.less {
+			t.Errorf("pathLess(%q, %q) = %v, expected %v", test.a, test.b, got, test.less)
+		}
+	}
+}
+
+func Test_move(t *testing.T) {
+	modified := time.Unix(100, 0)
+	tests := []struct {
+		from, to string
+		err      error
+		// The entries under "/" afterwards, recursively.
+		after []string
+	}{
+		{"/a/f", "/g", nil, []string{"/a", "/a/b", "/a/b/h", "/e", "/g"}},
+		{"/a/f", "/x/y/f", nil, []string{"/a", "/a/b", "/a/b/h", "/e", "/x", "/x/y", "/x/y/f"}},
+		{"/a", "/z", nil, []string{"/e", "/z", "/z/b", "/z/b/h", "/z/f"}},
+		{"/a/b", "/a/b2", nil, []string{"/a", "/a/b2", "/a/b2/h", "/a/f", "/e"}},
+		{"/a", "/a/b/c", errInvalidMove, nil},
+		{"/a", "/a/c", errInvalidMove, nil},
+		{"/a", "/", errRootDirectory, nil},
+		{"/", "/x", errRootDirectory, nil},
+		{"/missing", "/x", errFileNotFound, nil},
+		{"/a/f", "/e", errFileExists, nil},
+		{"/a/f", "/a/b", errFileExists, nil},
+		{"/a/f", "/e/x", errNotDirectory, nil},
+	}
+
+	for _, test := range tests {
+		ns := testNamespace(t, "/a/f", "/a/b/h", "/e")
+		before, _ := list(ns.root, true, "", "", 100)
+
+		err := ns.move(test.from, test.to, modified)
+		if err != test.err {
+			t.Errorf("move(%q, %q): expected %v, got %v", test.from, test.to, test.err, err)
+			continue
+		}
+
+		entries, _ := list(ns.root, true, "", "", 100)
+		if err != nil {
+			if !reflect.DeepEqual(entries, before) {
+				t.Errorf("move(%q, %q) failed but changed the tree to %v", test.from, test.to, names(entries))
+			}
+			continue
+		}
+		if got := names(entries); !reflect.DeepEqual(got, test.after) {
+			t.Errorf("move(%q, %q): expected %v, got %v", test.from, test.to, test.after, got)
+		}
+
+		// The old names are removed and the new ones saved.
+		changed := ns.flush()
+		if n, ok := changed[test.from]; !ok || n != nil {
+			t.Errorf("move(%q, %q): expected %q marked removed", test.from, test.to, test.from)
+		}
+		if n := changed[test.to]; n == nil || n.LastModified != modified {
+			t.Errorf("move(%q, %q): expected %q saved with the new time", test.from, test.to, test.to)
+		}
+	}
+}
+
+func Test_list(t *testing.T) {
+	ns := testNamespace(t, "/d/a", "/d/b/c", "/d/b/d", "/d/b-x", "/d/c", "/e")
+	dir := ns.lookup("/d")
+
+	tests := []struct {
+		name      string
+		recursive bool
+		prefix    string
+		after     string
+		limit     int
+		entries   []string
+		more      bool
+	}{
+		{"all", false, "", "", 10, []string{"/d/a", "/d/b", "/d/b-x", "/d/c"}, false},
+		{"recursive", true, "", "", 10, []string{"/d/a", "/d/b", "/d/b/c", "/d/b/d", "/d/b-x", "/d/c"}, false},
+		{"first page", true, "", "", 2, []string{"/d/a", "/d/b"}, true},
+		{"second page", true, "", "/d/b", 2, []string{"/d/b/c", "/d/b/d"}, true},
+		{"last page", true, "", "/d/b/d", 2, []string{"/d/b-x", "/d/c"}, false},
+		{"exact page", false, "", "", 4, []string{"/d/a", "/d/b", "/d/b-x", "/d/c"}, false},
+		{"after a name not there", false, "", "/d/bb", 10, []string{"/d/c"}, false},
+		{"prefix", false, "/d/b", "", 10, []string{"/d/b", "/d/b-x"}, false},
+		{"recursive prefix", true, "/d/b", "", 10, []string{"/d/b", "/d/b/c", "/d/b/d", "/d/b-x"}, false},
+		{"prefix and after", true, "/d/b", "/d/b/c", 10, []string{"/d/b/d", "/d/b-x"}, false},
+		{"no match", true, "/d/z", "", 10, nil, false},
+	}
+
+	for _, test := range tests {
+		entries, more := list(dir, test.recursive, test.prefix, test.after, test.limit)
+		if got := names(entries); !reflect.DeepEqual(got, test.entries) || more != test.more {
+			t.Errorf("%s: expected %v (more %v), got %v (more %v)", test.name, test.entries, test.more, got, more)
+		}
+	}
+}
+
+func Test_hash_index(t *testing.T) {
+	ns := newNamespace()
+	put := func(name, hash, origin string) {
+		if _, err := ns.put(File{Name: name, Hash: hash, Origin: origin}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withHash := func(hash string) []string {
+		var names []string
+		for _, n := range ns.withHash(hash) {
+			names = append(names, n.Name)
+		}
+		return names
+	}
+
+	put("/d/a", "h1", "http://n1")
+	put("/d/b", "h1", "http://n2")
+	put("/e", "h2", "http://n1")
+	put("/old", "", "")
+
+	if got := withHash("h1"); !reflect.DeepEqual(got, []string{"/d/a", "/d/b"}) {
+		t.Errorf("Expected both files with h1, got %v", got)
+	}
+
+	// Files keep their content when their directory moves.
+	if err := ns.move("/d", "/x/d", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := withHash("h1"); !reflect.DeepEqual(got, []string{"/x/d/a", "/x/d/b"}) {
+		t.Errorf("Expected h1 at the new names, got %v", got)
+	}
+
+	// Overwriting or removing a file drops it from its hash.
+	put("/x/d/a", "h2", "http://n1")
+	ns.remove("/x/d/b")
+	if got := withHash("h1"); got != nil {
+		t.Errorf("Expected no file left with h1, got %v", got)
+	}
+	if got := withHash("h2"); !reflect.DeepEqual(got, []string{"/e", "/x/d/a"}) {
+		t.Errorf("Expected both files with h2, got %v", got)
+	}
+	if want := map[string]int{"http://n1": 2, "": 1}; !reflect.DeepEqual(ns.origins, want) {
+		t.Errorf("Expected origins %v, got %v", want, ns.origins)
+	}
+}
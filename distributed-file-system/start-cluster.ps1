@@ -1,7 +1,7 @@
 # Remove the problematic single quotes
-Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 0 --http :8081 --cluster 1,:3030;2,:3031;3,:3032"
-Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 1 --http :8082 --cluster 1,:3030;2,:3031;3,:3032"
-Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 2 --http :8083 --cluster 1,:3030;2,:3031;3,:3032"
+Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 0 --http :8081 --data ./data1 --cluster 1,:3030;2,:3031;3,:3032"
+Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 1 --http :8082 --data ./data2 --cluster 1,:3030;2,:3031;3,:3032"
+Start-Process -FilePath ".\dfsapi.exe" -ArgumentList "--node 2 --http :8083 --data ./data3 --cluster 1,:3030;2,:3031;3,:3032"
 
 Write-Host "All nodes started!"
 Write-Host "HTTP APIs available on:"
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The state machine keeps its contents in a small embedded key-value
+// store: a map held in memory and backed by one file of batches. Each
+// batch is
+//
+//	[0:4]  payload length
+//	[4:8]  CRC-32C of the payload
+//	[8:]   the batch as JSON
+//
+// and is appended and synced in a single write, so either all of it
+// takes effect or none of it does. A batch that is cut short or fails
+// its checksum can only be the last one, left by a crash while it was
+// written, and is truncated away on open. Once the file holds many
+// more batches than there are keys, it is rewritten with only the
+// current contents.
+
+const kvRecordHeader = 8
+
+// The file is rewritten once it holds this many more batches than keys.
+const kvCompactSlack = 1024
+
+var kvCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type kvBatch struct {
+	Put    map[string][]byte `json:"put,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+}
+
+type kvStore struct {
+	path string
+	fd   *os.File
+	data map[string][]byte
+	// Batches in the file.
+	batches int
+}
+
+// openKV loads the store in the file name, creating it if needed.
+func openKV(name string) (*kvStore, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+	fd, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := &kvStore{path: name, fd: fd, data: map[string][]byte{}}
+	if err := kv.load(); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (kv *kvStore) load() error {
+	contents, err := io.ReadAll(kv.fd)
+	if err != nil {
+		return err
+	}
+
+	offset := 0
+	for len(contents)-offset >= kvRecordHeader {
+		header := contents[offset : offset+kvRecordHeader]
+		n := int(binary.LittleEndian.Uint32(header[0:4]))
+		if len(contents)-offset-kvRecordHeader < n {
+			break
+		}
+		payload := contents[offset+kvRecordHeader : offset+kvRecordHeader+n]
+		if crc32.Checksum(payload, kvCrcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			break
+		}
+
+		var b kvBatch
+		if err := json.Unmarshal(payload, &b); err != nil {
+			break
+		}
+		kv.apply(b)
+		kv.batches++
+		offset += kvRecordHeader + n
+	}
+
+	if offset < len(contents) {
+		if err := kv.fd.Truncate(int64(offset)); err != nil {
+			return err
+		}
+	}
+	_, err = kv.fd.Seek(int64(offset), io.SeekStart)
+	return err
+}
+
+func (kv *kvStore) apply(b kvBatch) {
+	for _, key := range b.Delete {
+		delete(kv.data, key)
+	}
+	for key, value := range b.Put {
+		kv.data[key] = value
+	}
+}
+
+func (kv *kvStore) get(key string) ([]byte, bool) {
+	value, ok := kv.data[key]
+	return value, ok
+}
+
+// scan calls fn on every key starting with prefix, in no particular
+// order.
+func (kv *kvStore) scan(prefix string, fn func(key string, value []byte)) {
+	for key, value := range kv.data {
+		if strings.HasPrefix(key, prefix) {
+			fn(key, value)
+		}
+	}
+}
+
+func encodeBatch(b kvBatch) ([]byte, error) {
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]byte, kvRecordHeader, kvRecordHeader+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, kvCrcTable))
+	return append(record, payload...), nil
+}
+
+// commit makes b durable, then applies it.
+func (kv *kvStore) commit(b kvBatch) error {
+	record, err := encodeBatch(b)
+	if err != nil {
+		return err
+	}
+	if _, err := kv.fd.Write(record); err != nil {
+		return err
+	}
+	if err := kv.fd.Sync(); err != nil {
+		return err
+	}
+
+	kv.apply(b)
+	kv.batches++
+	if kv.batches > len(kv.data)+kvCompactSlack {
+		return kv.reset(kv.data)
+	}
+	return nil
+}
+
+// reset replaces the whole contents of the store with data, writing a
+// new file and renaming it over the old one.
+func (kv *kvStore) reset(data map[string][]byte) error {
+	record, err := encodeBatch(kvBatch{Put: data})
+	if err != nil {
+		return err
+	}
+
+	tmp := kv.path + ".tmp"
+	if err := writeSynced(tmp, record); err != nil {
+		return err
+	}
+
+	// Windows can't rename over an open file.
+	kv.fd.Close()
+	if err := os.Rename(tmp, kv.path); err != nil {
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(kv.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	fd, err := os.OpenFile(kv.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	kv.fd = fd
+	kv.data = data
+	kv.batches = 1
+	return nil
+}
+
+func writeSynced(name string, data []byte) error {
+	fd, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Sync(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
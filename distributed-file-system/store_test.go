@@ -0,0 +1,200 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"distributed-file-system/command"
+)
+
+func reopenKV(t *testing.T, kv *kvStore) *kvStore {
+	kv.fd.Close()
+	kv, err := openKV(kv.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { kv.fd.Close() })
+	return kv
+}
+
+func Test_kv_torn_tail(t *testing.T) {
+	kv, err := openKV(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.commit(kvBatch{Put: map[string][]byte{"a": []byte("1"), "b": []byte("2")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.commit(kvBatch{Put: map[string][]byte{"c": []byte("3")}, Delete: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := kv.fd.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"b": []byte("2"), "c": []byte("3")}
+
+	// A batch cut short by a crash, and one that fails its checksum.
+	record, err := encodeBatch(kvBatch{Put: map[string][]byte{"d": []byte("4")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := append([]byte(nil), record...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	for _, tail := range [][]byte{record[:len(record)-1], record[:kvRecordHeader/2], corrupt} {
+		if err := os.Truncate(kv.path, fi.Size()); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(kv.path, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(tail)
+		f.Close()
+
+		kv = reopenKV(t, kv)
+		if !reflect.DeepEqual(kv.data, want) || kv.batches != 2 {
+			t.Fatalf("Expected %v in 2 batches, got %v in %d", want, kv.data, kv.batches)
+		}
+		if size, _ := kv.fd.Seek(0, 1); size != fi.Size() {
+			t.Fatalf("Expected the tail truncated to %d bytes, at %d", fi.Size(), size)
+		}
+	}
+
+	// Batches go on after the last good one.
+	if err := kv.commit(kvBatch{Put: map[string][]byte{"d": []byte("4")}}); err != nil {
+		t.Fatal(err)
+	}
+	kv = reopenKV(t, kv)
+	want["d"] = []byte("4")
+	if !reflect.DeepEqual(kv.data, want) {
+		t.Errorf("Expected %v, got %v", want, kv.data)
+	}
+}
+
+func Test_kv_reset(t *testing.T) {
+	kv, err := openKV(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting one key over and over compacts the file.
+	for i := 0; i <= kvCompactSlack+1; i++ {
+		if err := kv.commit(kvBatch{Put: map[string][]byte{"a": encodeIndex(uint64(i))}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if kv.batches > 2 {
+		t.Fatalf("Expected the file compacted, has %d batches", kv.batches)
+	}
+	kv = reopenKV(t, kv)
+	if v, _ := kv.get("a"); !reflect.DeepEqual(v, encodeIndex(kvCompactSlack+1)) || kv.batches > 2 {
+		t.Fatalf("Expected the last value in at most 2 batches, got %v in %d", v, kv.batches)
+	}
+
+	want := map[string][]byte{"b": []byte("2")}
+	if err := kv.reset(map[string][]byte{"b": []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.commit(kvBatch{Put: map[string][]byte{"c": []byte("3")}}); err != nil {
+		t.Fatal(err)
+	}
+	want["c"] = []byte("3")
+	kv = reopenKV(t, kv)
+	if !reflect.DeepEqual(kv.data, want) || kv.batches != 2 {
+		t.Errorf("Expected %v in 2 batches, got %v in %d", want, kv.data, kv.batches)
+	}
+	if _, err := os.Stat(kv.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("Expected no temporary file left, got %v", err)
+	}
+}
+
+func openDFS(t *testing.T, dir string) *DFSStateMachine {
+	s, err := NewDFSStateMachine(newBlobStore(filepath.Join(dir, "blobs")), dir, "http://self")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.kv.fd.Close() })
+	return s
+}
+
+func Test_dfs_state_reopen(t *testing.T) {
+	dir := t.TempDir()
+	s := openDFS(t, dir)
+
+	modified := time.Unix(100, 0)
+	hash := hashOf("hello")
+	cmds := []command.Command{
+		{Kind: command.MakeDir, Path: "/d", Time: modified.UnixNano()},
+		{Kind: command.CreateFile, Path: "/d/f", Size: 5, Hash: hash, Origin: "http://other", Time: modified.UnixNano()},
+		{Kind: command.CreateFile, Path: "/d/g", Size: 5, Hash: hash, Origin: "http://other", Time: modified.UnixNano()},
+		{Kind: command.DeleteFile, Path: "/d/g"},
+		{Kind: command.SetNodeAddress, Node: 2, Origin: "http://other"},
+	}
+	for i, c := range cmds {
+		if _, err := s.ApplyIndex(uint64(i+1), command.Encode(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Nothing is saved until the entries applied together are flushed.
+	if reopened := openDFS(t, dir); reopened.AppliedIndex() != 0 {
+		t.Fatalf("Expected nothing saved before Flush, got index %d", reopened.AppliedIndex())
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if s.kv.batches != 1 {
+		t.Errorf("Expected one batch for the entries applied together, got %d", s.kv.batches)
+	}
+
+	check := func(s *DFSStateMachine, index uint64) {
+		t.Helper()
+		if s.AppliedIndex() != index {
+			t.Errorf("Expected index %d applied, got %d", index, s.AppliedIndex())
+		}
+		f := s.ns.lookup("/d/f")
+		if f == nil || f.Hash != hash || f.Size != 5 || !f.LastModified.Equal(modified) {
+			t.Errorf("Expected /d/f as created, got %+v", f)
+		}
+		if d := s.ns.lookup("/d"); d == nil || !d.Dir {
+			t.Errorf("Expected /d to be a directory, got %+v", d)
+		}
+		if g := s.ns.lookup("/d/g"); g != nil {
+			t.Errorf("Expected /d/g deleted, got %+v", g)
+		}
+		if address := s.nodeAddress(2); address != "http://other" {
+			t.Errorf("Expected node 2 at http://other, got %q", address)
+		}
+	}
+	check(openDFS(t, dir), 5)
+
+	// A snapshot restored later replaces everything, at its index.
+	snap, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ApplyIndex(6, command.Encode(command.Command{Kind: command.DeleteFile, Path: "/d/f"})); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RestoreIndex(10, snap); err != nil {
+		t.Fatal(err)
+	}
+	check(s, 10)
+	check(openDFS(t, dir), 10)
+
+	// An empty snapshot resets it.
+	if err := s.RestoreIndex(0, nil); err != nil {
+		t.Fatal(err)
+	}
+	reopened := openDFS(t, dir)
+	if reopened.AppliedIndex() != 0 || reopened.ns.lookup("/d") != nil || reopened.nodeAddress(2) != "" {
+		t.Errorf("Expected an empty state machine, got index %d", reopened.AppliedIndex())
+	}
+}